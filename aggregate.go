@@ -0,0 +1,238 @@
+package tardigrade
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Agg is an aggregation computed over the records of a group, built with Count, Sum, Avg, Min,
+// Max, DistinctCount or Percentile
+type Agg struct {
+	Name  string  // key of the result in AggGroup.Values, "sum(cost)" and the like by default
+	Func  string  // count, sum, avg, min, max, distinct or percentile
+	Field string  // empty for count, which then counts records
+	P     float64 // percentile between 0 and 100
+}
+
+// AggGroup holds the aggregations of the records sharing the values Group of the group-by
+// fields. Aggregations without a value, such as the average of a field no record has, are
+// left out of Values.
+type AggGroup struct {
+	Group  map[string]string  `json:"group"`
+	Count  int                `json:"count"`
+	Values map[string]float64 `json:"values"`
+}
+
+// Count counts the records of a group, or those having field when one is given
+func Count(field ...string) Agg {
+	a := Agg{Func: "count"}
+	if len(field) > 0 {
+		a.Field = field[0]
+	}
+	return a
+}
+
+// Sum adds up the numeric values of field
+func Sum(field string) Agg {
+	return Agg{Func: "sum", Field: field}
+}
+
+// Avg averages the numeric values of field
+func Avg(field string) Agg {
+	return Agg{Func: "avg", Field: field}
+}
+
+// Min returns the lowest numeric value of field
+func Min(field string) Agg {
+	return Agg{Func: "min", Field: field}
+}
+
+// Max returns the highest numeric value of field
+func Max(field string) Agg {
+	return Agg{Func: "max", Field: field}
+}
+
+// DistinctCount counts the different values of field, numeric or not
+func DistinctCount(field string) Agg {
+	return Agg{Func: "distinct", Field: field}
+}
+
+// Percentile returns the p-th percentile (0 to 100) of the numeric values of field,
+// interpolating between the two closest values
+func Percentile(field string, p float64) Agg {
+	return Agg{Func: "percentile", Field: field, P: p}
+}
+
+// Aggregate groups the records of db matching the filters of q (nil for every record) by the
+// values of the groupBy fields and computes aggs for each group. Values are parsed as numbers
+// for sum, avg, min, max and percentile, others and NaN or infinite ones are skipped. A record without a group-by field
+// falls in the group where it is "". Groups come back ordered by their values, the ordering,
+// paging and projection of q are not used.
+// Usage: groups, err := tar.Aggregate("app.db", nil, []string{"billing"}, tardigrade.Sum("cost"))
+func (tar *Tardigrade) Aggregate(db string, q *Query, groupBy []string, aggs ...Agg) ([]AggGroup, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, newError("Aggregate", db, 0, err)
+	}
+	defer unlock()
+
+	groups, err := aggregate(pathView(db), q, groupBy, aggs)
+	return groups, newError("Aggregate", db, 0, err)
+}
+
+// name returns the key of the aggregation in AggGroup.Values
+func (a Agg) name() string {
+	switch {
+	case a.Name != "":
+		return a.Name
+	case a.Func == "percentile":
+		return fmt.Sprintf("p%s(%s)", strconv.FormatFloat(a.P, 'f', -1, 64), a.Field)
+	case a.Field == "":
+		return a.Func
+	}
+	return a.Func + "(" + a.Field + ")"
+}
+
+// checkAggs rejects unknown aggregations, those missing a field and percentiles out of range
+func checkAggs(aggs []Agg) error {
+	for _, a := range aggs {
+		switch a.Func {
+		case "count":
+			continue
+		case "sum", "avg", "min", "max", "distinct":
+		case "percentile":
+			if a.P < 0 || a.P > 100 || math.IsNaN(a.P) {
+				return fmt.Errorf("%w: percentile %v out of range", ErrInvalidQuery, a.P)
+			}
+		default:
+			return fmt.Errorf("%w: unknown aggregation %q", ErrInvalidQuery, a.Func)
+		}
+		if a.Field == "" {
+			return fmt.Errorf("%w: %s without a field", ErrInvalidQuery, a.Func)
+		}
+	}
+	return nil
+}
+
+// aggregate groups the records of v matching q and computes aggs for each group
+func aggregate(v view, q *Query, groupBy []string, aggs []Agg) ([]AggGroup, error) {
+	if q == nil {
+		q = NewQuery()
+	}
+	if err := checkAggs(aggs); err != nil {
+		return nil, err
+	}
+	rows, _, err := filterRows(v, q)
+	if err != nil {
+		return nil, err
+	}
+
+	var order []string
+	members := make(map[string][]map[string]string)
+	for _, row := range rows {
+		values := make([]string, len(groupBy))
+		for i, field := range groupBy {
+			values[i], _ = fieldValue(row, field)
+		}
+		key := strings.Join(values, indexSep)
+		if _, ok := members[key]; !ok {
+			order = append(order, key)
+		}
+		members[key] = append(members[key], row)
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := strings.Split(order[i], indexSep), strings.Split(order[j], indexSep)
+		for k := range groupBy {
+			if c := sortCompare(a[k], b[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+
+	groups := make([]AggGroup, 0, len(order))
+	for _, key := range order {
+		group := AggGroup{Group: make(map[string]string), Count: len(members[key]), Values: make(map[string]float64)}
+		for i, value := range strings.Split(key, indexSep) {
+			if i < len(groupBy) {
+				group.Group[groupBy[i]] = value
+			}
+		}
+		for _, a := range aggs {
+			if value, ok := a.compute(members[key]); ok {
+				group.Values[a.name()] = value
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// compute returns the aggregation over rows, false when it has no value
+func (a Agg) compute(rows []map[string]string) (float64, bool) {
+	switch a.Func {
+	case "count":
+		n := 0
+		for _, row := range rows {
+			if _, ok := fieldValue(row, a.Field); ok || a.Field == "" {
+				n++
+			}
+		}
+		return float64(n), true
+	case "distinct":
+		seen := make(map[string]bool)
+		for _, row := range rows {
+			if value, ok := fieldValue(row, a.Field); ok {
+				seen[value] = true
+			}
+		}
+		return float64(len(seen)), true
+	}
+
+	var nums []float64
+	for _, row := range rows {
+		value, _ := fieldValue(row, a.Field)
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err == nil && !math.IsNaN(n) && !math.IsInf(n, 0) {
+			nums = append(nums, n)
+		}
+	}
+	sum := 0.0
+	for _, n := range nums {
+		sum += n
+	}
+	if a.Func == "sum" {
+		return sum, true
+	}
+	if len(nums) == 0 {
+		return 0, false
+	}
+	sort.Float64s(nums)
+	switch a.Func {
+	case "avg":
+		return sum / float64(len(nums)), true
+	case "min":
+		return nums[0], true
+	case "max":
+		return nums[len(nums)-1], true
+	}
+	rank := a.P / 100 * float64(len(nums)-1)
+	lo := int(math.Floor(rank))
+	if lo+1 >= len(nums) {
+		return nums[lo], true
+	}
+	return nums[lo] + (rank-float64(lo))*(nums[lo+1]-nums[lo]), true
+}
+
+// Aggregate groups the records of the database matching q, see Tardigrade.Aggregate
+func (d *DB) Aggregate(q *Query, groupBy []string, aggs ...Agg) ([]AggGroup, error) {
+	var groups []AggGroup
+	err := d.read("Aggregate", func(v view) (err error) {
+		groups, err = aggregate(v, q, groupBy, aggs)
+		return newError("Aggregate", d.path, 0, err)
+	})
+	return groups, err
+}
@@ -0,0 +1,30 @@
+package tardigrade
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestAggregateSkipsNonFinite(t *testing.T) {
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "agg.db")
+	tar.CreateDB(db)
+	for _, cost := range []string{"10", "NaN", "20", "+Inf", "-inf", "abc"} {
+		if _, err := tar.AddFlexFieldE("item", map[string]string{"cost": cost}, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	groups, err := tar.Aggregate(db, nil, nil, Sum("cost"), Avg("cost"), Max("cost"), Min("cost"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(groups) != 1 {
+		t.Fatalf("groups = %+v", groups)
+	}
+	want := map[string]float64{"sum(cost)": 30, "avg(cost)": 15, "max(cost)": 20, "min(cost)": 10}
+	for name, value := range want {
+		if got, ok := groups[0].Values[name]; !ok || got != value {
+			t.Fatalf("%s = %v, %v, want %v", name, got, ok, value)
+		}
+	}
+}
@@ -0,0 +1,304 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Alert is a record added or modified while matching a registered alert query
+type Alert struct {
+	Name   string          `json:"alert"`
+	Query  string          `json:"query"`
+	Op     string          `json:"op"` // add or modify
+	Id     int             `json:"id"`
+	Key    string          `json:"key"`
+	Record json.RawMessage `json:"record"` // the stored record, decode it into MyStruct or FlexStruct
+}
+
+// AlertHandler is called with every record matching an alert registered in this process. It
+// runs in the goroutine that made the write, once the write lock is released, so it may
+// write to any database.
+type AlertHandler func(a Alert)
+
+// AlertRule is an alert query stored in <db>.meta. Target is the database every match is
+// appended to, empty when the alert only calls handlers.
+type AlertRule struct {
+	Name   string `json:"name"`
+	Query  string `json:"query"`
+	Target string `json:"target,omitempty"`
+}
+
+// RegisterAlert stores query (see ParseSearch) under name in the settings of db and calls
+// handler in this process with every record a later add or modify stores matching it.
+// Registering a name again replaces its query and handler.
+// Usage: err := tar.RegisterAlert("linux-errors", "status:error os:linux", func(a tardigrade.Alert) { log.Println(a.Key) }, "monitor.db")
+func (tar *Tardigrade) RegisterAlert(name, query string, handler AlertHandler, db string) error {
+	return tar.registerAlert(AlertRule{Name: name, Query: query}, handler, db)
+}
+
+// RegisterAlertTo stores query under name in the settings of db so that every process adding
+// or modifying a record matching it appends the Alert to alertsDB as a flexible record stored
+// under name with the fields query, op, id, key and record
+func (tar *Tardigrade) RegisterAlertTo(name, query, alertsDB string, db string) error {
+	return tar.registerAlert(AlertRule{Name: name, Query: query, Target: alertsDB}, nil, db)
+}
+
+// RemoveAlert deletes the alert name from db and drops its handler in this process
+func (tar *Tardigrade) RemoveAlert(name string, db string) error {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return newError("RemoveAlert", db, 0, err)
+	}
+	defer unlock()
+
+	meta, err := loadMeta(db)
+	if err != nil {
+		return newError("RemoveAlert", db, 0, err)
+	}
+	delete(stateFor(db).alerts, name)
+	kept := meta.Alerts[:0]
+	for _, rule := range meta.Alerts {
+		if rule.Name != name {
+			kept = append(kept, rule)
+		}
+	}
+	if len(kept) == len(meta.Alerts) {
+		return newError("RemoveAlert", db, 0, fmt.Errorf("%w: alert %q", ErrNotFound, name))
+	}
+	meta.Alerts = kept
+	return newError("RemoveAlert", db, 0, saveMeta(db, meta))
+}
+
+// Alerts returns the alert queries stored for db
+func (tar *Tardigrade) Alerts(db string) ([]AlertRule, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, newError("Alerts", db, 0, err)
+	}
+	defer unlock()
+
+	meta, err := loadMeta(db)
+	if err != nil {
+		return nil, newError("Alerts", db, 0, err)
+	}
+	return meta.Alerts, nil
+}
+
+// registerAlert validates and stores rule, then keeps handler for it
+func (tar *Tardigrade) registerAlert(rule AlertRule, handler AlertHandler, db string) error {
+	if err := checkAlert(rule, db); err != nil {
+		return newError("RegisterAlert", db, 0, err)
+	}
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return newError("RegisterAlert", db, 0, err)
+	}
+	defer unlock()
+
+	if _, err := statDB(db); err != nil {
+		return newError("RegisterAlert", db, 0, err)
+	}
+	meta, err := loadMeta(db)
+	if err != nil {
+		return newError("RegisterAlert", db, 0, err)
+	}
+	replaced := false
+	for i := range meta.Alerts {
+		if meta.Alerts[i].Name == rule.Name {
+			meta.Alerts[i], replaced = rule, true
+		}
+	}
+	if !replaced {
+		meta.Alerts = append(meta.Alerts, rule)
+	}
+	if err := saveMeta(db, meta); err != nil {
+		return newError("RegisterAlert", db, 0, err)
+	}
+	s := stateFor(db)
+	delete(s.alerts, rule.Name)
+	if handler != nil {
+		if s.alerts == nil {
+			s.alerts = make(map[string]AlertHandler)
+		}
+		s.alerts[rule.Name] = handler
+	}
+	return nil
+}
+
+// checkAlert rejects an alert without a name, with a query that does not parse or sending its
+// matches to the database it watches, directly or through the alerts of its targets
+func checkAlert(rule AlertRule, db string) error {
+	if rule.Name == "" {
+		return fmt.Errorf("%w: alert without a name", ErrInvalidQuery)
+	}
+	if _, err := ParseSearch(rule.Query); err != nil {
+		return err
+	}
+	seen := make(map[*dbState]bool)
+	for targets := []string{rule.Target}; len(targets) > 0; targets = targets[1:] {
+		target := targets[0]
+		if target == "" || seen[stateFor(target)] {
+			continue
+		}
+		if stateFor(target) == stateFor(db) {
+			return errors.New("alert target must not be the database it watches or send alerts back to it")
+		}
+		seen[stateFor(target)] = true
+		meta, err := loadMeta(target)
+		if err != nil {
+			return err
+		}
+		for _, r := range meta.Alerts {
+			targets = append(targets, r.Target)
+		}
+	}
+	return nil
+}
+
+// queuedAlert is an alert matched by a write and waiting for the write lock to be released
+type queuedAlert struct {
+	alert   Alert
+	handler AlertHandler
+	target  string
+	from    Tardigrade // settings of the writer, used to deliver and report
+}
+
+// alertRules holds the alerts of a database ready to match, cached in its dbState until its
+// settings change
+type alertRules struct {
+	rules    []AlertRule
+	exprs    []*SearchExpr // parsed query of each rule, nil when it does not parse
+	errs     []error
+	analysis *analysis
+}
+
+// alertRules returns the parsed alerts of the database, nil when it has none
+func (s *dbState) alertRules() (*alertRules, error) {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	meta, err := s.cachedMeta()
+	if err != nil || len(meta.Alerts) == 0 {
+		return nil, err
+	}
+	if s.rules != nil {
+		return s.rules, nil
+	}
+	a, err := analyzersOf(meta)
+	if err != nil {
+		return nil, err
+	}
+	rules := &alertRules{rules: meta.Alerts, analysis: a}
+	for _, rule := range meta.Alerts {
+		expr, err := ParseSearch(rule.Query)
+		rules.exprs = append(rules.exprs, expr)
+		rules.errs = append(rules.errs, err)
+	}
+	s.rules = rules
+	return rules, nil
+}
+
+// percolate checks a record just stored by op against the alerts of db and queues those it
+// matches for deliverAlerts. The write is done by then, so a failure is reported to
+// OnAlertError rather than to the writer. The caller holds the write lock of db.
+func (tar *Tardigrade) percolate(db, op string, record []byte) {
+	if op != "add" && op != "modify" {
+		return
+	}
+	s := stateFor(db)
+	rules, err := s.alertRules()
+	if rules == nil && err == nil {
+		return
+	}
+	record = []byte(strings.TrimSpace(string(record)))
+	if err != nil {
+		tar.alertFailed(Alert{Op: op, Record: json.RawMessage(record)}, err)
+		return
+	}
+	var head recordHead
+	if err := json.Unmarshal(record, &head); err != nil {
+		tar.alertFailed(Alert{Op: op, Record: json.RawMessage(record)}, corrupt(err))
+		return
+	}
+	r := newMatchRecord(rules.analysis, record)
+	for i, rule := range rules.rules {
+		alert := Alert{Name: rule.Name, Query: rule.Query, Op: op, Id: head.Id, Key: head.Key, Record: json.RawMessage(record)}
+		if rules.errs[i] != nil {
+			tar.alertFailed(alert, rules.errs[i])
+			continue
+		}
+		if !rules.exprs[i].root.match(r) {
+			continue
+		}
+		s.alertMu.Lock()
+		s.queued = append(s.queued, queuedAlert{alert: alert, handler: s.alerts[rule.Name], target: rule.Target, from: *tar})
+		s.alertMu.Unlock()
+	}
+}
+
+// deliverAlerts calls the handlers of the alerts queued by the writes to s and appends them to
+// their target databases. It runs once the write lock is released, so neither a handler nor
+// a target waits on the database that matched.
+func deliverAlerts(s *dbState) {
+	s.alertMu.Lock()
+	queued := s.queued
+	s.queued = nil
+	s.alertMu.Unlock()
+
+	for _, q := range queued {
+		if q.handler != nil {
+			q.handler(q.alert)
+		}
+		if q.target == "" {
+			continue
+		}
+		fields := map[string]string{
+			"query":  q.alert.Query,
+			"op":     q.alert.Op,
+			"id":     strconv.Itoa(q.alert.Id),
+			"key":    q.alert.Key,
+			"record": string(q.alert.Record),
+		}
+		if _, err := q.from.AddFlexFieldE(q.alert.Name, fields, q.target); err != nil {
+			q.from.alertFailed(q.alert, fmt.Errorf("alert %s to %s: %w", q.alert.Name, q.target, err))
+		}
+	}
+}
+
+// alertFailed reports an alert that could not be checked or delivered
+func (tar *Tardigrade) alertFailed(a Alert, err error) {
+	if tar.OnAlertError != nil {
+		tar.OnAlertError(a, err)
+		return
+	}
+	log.Printf("tardigrade: alert %s on record %d: %v", a.Name, a.Id, err)
+}
+
+// RegisterAlert stores query under name and calls handler with matching records, see
+// Tardigrade.RegisterAlert
+func (d *DB) RegisterAlert(name, query string, handler AlertHandler) error {
+	if err := d.writable("RegisterAlert"); err != nil {
+		return err
+	}
+	return d.tar.RegisterAlert(name, query, handler, d.path)
+}
+
+// RegisterAlertTo stores query under name and appends matching records to alertsDB, see
+// Tardigrade.RegisterAlertTo
+func (d *DB) RegisterAlertTo(name, query, alertsDB string) error {
+	if err := d.writable("RegisterAlertTo"); err != nil {
+		return err
+	}
+	return d.tar.RegisterAlertTo(name, query, alertsDB, d.path)
+}
+
+// RemoveAlert deletes the alert name from the database
+func (d *DB) RemoveAlert(name string) error {
+	if err := d.writable("RemoveAlert"); err != nil {
+		return err
+	}
+	return d.tar.RemoveAlert(name, d.path)
+}
@@ -0,0 +1,154 @@
+package tardigrade
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAlertHandlerMayWrite(t *testing.T) {
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "watched.db")
+	tar.CreateDB(db)
+	var seen []Alert
+	err := tar.RegisterAlert("errors", "status:error", func(a Alert) {
+		seen = append(seen, a)
+		if _, err := tar.AddFlexFieldE("note", map[string]string{"status": "seen"}, db); err != nil {
+			t.Error(err)
+		}
+	}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := tar.AddFlexFieldE("job", map[string]string{"status": "error"}, db)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a handler writing to the database it watches deadlocked")
+	}
+	if len(seen) != 1 || seen[0].Id != 1 || seen[0].Op != "add" {
+		t.Fatalf("alerts = %+v", seen)
+	}
+	if n := tar.CountSize(db); n != 2 {
+		t.Fatalf("CountSize = %d, want the record and the note", n)
+	}
+}
+
+func TestAlertTargetCycle(t *testing.T) {
+	tar := &Tardigrade{}
+	dir := t.TempDir()
+	a, b, c := filepath.Join(dir, "a.db"), filepath.Join(dir, "b.db"), filepath.Join(dir, "c.db")
+	for _, db := range []string{a, b, c} {
+		tar.CreateDB(db)
+	}
+	if err := tar.RegisterAlertTo("ab", "x", b, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := tar.RegisterAlertTo("bc", "x", c, b); err != nil {
+		t.Fatal(err)
+	}
+	if err := tar.RegisterAlertTo("ca", "x", a, c); err == nil {
+		t.Fatal("RegisterAlertTo closing a cycle of targets succeeded")
+	}
+	if err := tar.RegisterAlertTo("aa", "x", a, a); err == nil {
+		t.Fatal("RegisterAlertTo targeting the watched database succeeded")
+	}
+}
+
+func TestAlertFailureKeepsWrite(t *testing.T) {
+	var failures []error
+	tar := &Tardigrade{OnAlertError: func(a Alert, err error) { failures = append(failures, err) }}
+	dir := t.TempDir()
+	db := filepath.Join(dir, "watched.db")
+	tar.CreateDB(db)
+	if err := tar.RegisterAlertTo("errors", "status:error", filepath.Join(dir, "missing", "alerts.db"), db); err != nil {
+		t.Fatal(err)
+	}
+	id, err := tar.AddFlexFieldE("job", map[string]string{"status": "error"}, db)
+	if err != nil || id != 1 {
+		t.Fatalf("AddFlexFieldE = %d, %v, want the write to succeed", id, err)
+	}
+	if len(failures) != 1 {
+		t.Fatalf("OnAlertError called %d times, want 1", len(failures))
+	}
+}
+
+func TestAlertTxFinalState(t *testing.T) {
+	dir := t.TempDir()
+	alerts := filepath.Join(dir, "alerts.db")
+	d, err := Open(filepath.Join(dir, "watched.db"), Options{Create: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.RegisterAlertTo("errors", "status:error", alerts); err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := d.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := tx.AddFlex("a", map[string]string{"status": "ok"})
+	if err := tx.ModifyFlex(id, "a", map[string]string{"status": "error"}); err != nil {
+		t.Fatal(err)
+	}
+	gone, _ := tx.AddFlex("b", map[string]string{"status": "error"})
+	if err := tx.Remove(gone); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	tar := &Tardigrade{}
+	rows, err := tar.SelectFlexSearchE("", alerts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0].Fields["op"] != "add" || rows[0].Fields["id"] != "1" || rows[0].Fields["record"] != `{"id":1,"key":"a","fields":{"status":"error"}}` {
+		t.Fatalf("alerts = %+v, want one add with the final record", rows)
+	}
+}
+
+func TestAlertRulesCached(t *testing.T) {
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "watched.db")
+	tar.CreateDB(db)
+	fired := 0
+	if err := tar.RegisterAlert("errors", "status:error", func(Alert) { fired++ }, db); err != nil {
+		t.Fatal(err)
+	}
+	s := stateFor(db)
+	if _, err := tar.AddFlexFieldE("a", map[string]string{"status": "error"}, db); err != nil {
+		t.Fatal(err)
+	}
+	rules := s.rules
+	if rules == nil || len(rules.exprs) != 1 {
+		t.Fatalf("rules not cached: %+v", rules)
+	}
+	if _, err := tar.AddFlexFieldE("b", map[string]string{"status": "error"}, db); err != nil {
+		t.Fatal(err)
+	}
+	if s.rules != rules || fired != 2 {
+		t.Fatalf("rules parsed again or alert missed, fired %d", fired)
+	}
+
+	if err := tar.RemoveAlert("errors", db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tar.AddFlexFieldE("c", map[string]string{"status": "error"}, db); err != nil {
+		t.Fatal(err)
+	}
+	if s.rules != nil || fired != 2 {
+		t.Fatalf("removed alert still cached or fired, fired %d", fired)
+	}
+}
@@ -0,0 +1,394 @@
+package tardigrade
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Token is a term produced by an Analyzer and the byte range of the word it came from
+type Token struct {
+	Term       string
+	Start, End int
+}
+
+// Analyzer turns a text into the terms that are indexed and searched for. query is true when
+// text is a search query rather than a stored value, so an analyzer can expand stored values
+// (edge n-grams) without expanding queries.
+type Analyzer interface {
+	Analyze(text string, query bool) []Token
+}
+
+// TokenFilter transforms the tokens of a text, see NewAnalyzer
+type TokenFilter func(tokens []Token, query bool) []Token
+
+// chain splits texts into words and runs the filters over them
+type chain []TokenFilter
+
+// NewAnalyzer returns an analyzer splitting texts into runs of letters and digits and passing
+// them through filters in order
+// Usage: tardigrade.RegisterAnalyzer("names", tardigrade.NewAnalyzer(tardigrade.LowerCase, tardigrade.FoldDiacritics))
+func NewAnalyzer(filters ...TokenFilter) Analyzer {
+	return chain(filters)
+}
+
+// Analyze returns the filtered words of text
+func (c chain) Analyze(text string, query bool) []Token {
+	toks := splitWords(text)
+	for _, filter := range c {
+		toks = filter(toks, query)
+	}
+	return toks
+}
+
+// Built-in analyzers, registered under their names
+var (
+	// StandardAnalyzer lower-cases words, the default of every database
+	StandardAnalyzer = NewAnalyzer(LowerCase)
+	// FoldingAnalyzer also folds diacritics, so "Jose" matches "José"
+	FoldingAnalyzer = NewAnalyzer(LowerCase, FoldDiacritics)
+	// EnglishAnalyzer also drops English stop words and stems, so "running" matches "runs"
+	EnglishAnalyzer = NewAnalyzer(LowerCase, FoldDiacritics, StopWords(), EnglishStem)
+	// PrefixAnalyzer indexes the leading 1 to 20 characters of every word, so a query for
+	// "tard" matches "tardigrade"
+	PrefixAnalyzer = NewAnalyzer(LowerCase, FoldDiacritics, EdgeNGrams(1, 20))
+)
+
+// analyzers holds every analyzer a database can be configured with, by name
+var analyzers = struct {
+	sync.RWMutex
+	byName map[string]Analyzer
+}{byName: map[string]Analyzer{
+	"standard": StandardAnalyzer,
+	"folding":  FoldingAnalyzer,
+	"english":  EnglishAnalyzer,
+	"prefix":   PrefixAnalyzer,
+}}
+
+// RegisterAnalyzer makes a available to SetAnalyzer under name. Databases only store the name,
+// so every process using one must register it before searching.
+func RegisterAnalyzer(name string, a Analyzer) {
+	analyzers.Lock()
+	defer analyzers.Unlock()
+	analyzers.byName[name] = a
+}
+
+// lookupAnalyzer returns the analyzer registered under name
+func lookupAnalyzer(name string) (Analyzer, error) {
+	analyzers.RLock()
+	defer analyzers.RUnlock()
+	a, ok := analyzers.byName[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown analyzer %q", name)
+	}
+	return a, nil
+}
+
+// SetAnalyzer selects the analyzer, by registered name, that search uses for the flex field
+// field of db, or for every field without one of its own when field is empty. The key and
+// data of a record are the fields "key" and "data". An empty name reverts to the default.
+// Once a database has an analyzer SelectSearch and SelectFlexSearch match analyzed words
+// instead of substrings of the stored line.
+// Usage: tar.SetAnalyzer("people.db", "", "folding"); tar.SetAnalyzer("people.db", "bio", "english")
+func (tar *Tardigrade) SetAnalyzer(db, field, name string) error {
+	if name != "" {
+		if _, err := lookupAnalyzer(name); err != nil {
+			return newError("SetAnalyzer", db, 0, err)
+		}
+	}
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return newError("SetAnalyzer", db, 0, err)
+	}
+	defer unlock()
+
+	if _, err := statDB(db); err != nil {
+		return newError("SetAnalyzer", db, 0, err)
+	}
+	meta, err := loadMeta(db)
+	if err != nil {
+		return newError("SetAnalyzer", db, 0, err)
+	}
+	if field == "" {
+		meta.Analyzer = name
+	} else if name == "" {
+		delete(meta.FieldAnalyzers, field)
+	} else {
+		if meta.FieldAnalyzers == nil {
+			meta.FieldAnalyzers = make(map[string]string)
+		}
+		meta.FieldAnalyzers[field] = name
+	}
+	return newError("SetAnalyzer", db, 0, saveMeta(db, meta))
+}
+
+// analysis is the analyzer configuration of a database resolved against the registry
+type analysis struct {
+	configured bool              // the database has analyzers, otherwise everything is "standard"
+	signature  string            // see analyzerSignature
+	def        string            // analyzer of the fields without one of their own
+	fields     map[string]string // analyzer of each field
+	byName     map[string]Analyzer
+}
+
+// analyzersOf resolves the analyzers configured in meta
+func analyzersOf(meta dbMeta) (*analysis, error) {
+	a := &analysis{
+		configured: meta.Analyzer != "" || len(meta.FieldAnalyzers) > 0,
+		signature:  analyzerSignature(meta),
+		def:        meta.Analyzer,
+		fields:     meta.FieldAnalyzers,
+		byName:     make(map[string]Analyzer),
+	}
+	if a.def == "" {
+		a.def = "standard"
+	}
+	for _, name := range a.names() {
+		an, err := lookupAnalyzer(name)
+		if err != nil {
+			return nil, err
+		}
+		a.byName[name] = an
+	}
+	return a, nil
+}
+
+// analysisFor returns the analyzers configured for db
+func analysisFor(db string) (*analysis, error) {
+	meta, err := loadMeta(db)
+	if err != nil {
+		return nil, err
+	}
+	return analyzersOf(meta)
+}
+
+// analyzerSignature identifies the analyzer configuration of meta
+func analyzerSignature(meta dbMeta) string {
+	fields := make([]string, 0, len(meta.FieldAnalyzers))
+	for field, name := range meta.FieldAnalyzers {
+		fields = append(fields, field+"="+name)
+	}
+	sort.Strings(fields)
+	return meta.Analyzer + ";" + strings.Join(fields, ";")
+}
+
+// names returns the name of every analyzer in use once, the default first
+func (a *analysis) names() []string {
+	names := []string{a.def}
+	var others []string
+	for _, name := range a.fields {
+		others = append(others, name)
+	}
+	sort.Strings(others)
+	for _, name := range others {
+		if name != names[len(names)-1] && name != a.def {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// analyzer returns the analyzer of field
+func (a *analysis) analyzer(field string) Analyzer {
+	if name, ok := a.fields[field]; ok {
+		return a.byName[name]
+	}
+	return a.byName[a.def]
+}
+
+// queryTerms returns the distinct terms of query under every analyzer in use, so a word
+// reaches fields analyzed differently
+func (a *analysis) queryTerms(query string) []string {
+	var terms []string
+	for _, name := range a.names() {
+		for _, tok := range a.byName[name].Analyze(query, true) {
+			terms = append(terms, tok.Term)
+		}
+	}
+	return distinct(terms)
+}
+
+// terms returns every term of the texts of a stored record
+func (a *analysis) terms(body []byte) map[string]bool {
+	terms := make(map[string]bool)
+	for _, f := range recordTexts(body) {
+		for _, tok := range a.analyzer(f.name).Analyze(f.text, false) {
+			terms[tok.Term] = true
+		}
+	}
+	return terms
+}
+
+// match reports whether line holds every keyword: as analyzed words when the database has
+// analyzers, as substrings of the lower-cased line otherwise
+func (a *analysis) match(line string, keywords []string) bool {
+	if !a.configured {
+		return containsAll(strings.ToLower(line), keywords)
+	}
+	return a.matchWords(line, keywords)
+}
+
+// matchWords reports whether the record stored in line holds every keyword, a keyword
+// matching when any of its analyzed terms is a term of the record. Keywords without terms,
+// such as stop words, are ignored.
+func (a *analysis) matchWords(line string, keywords []string) bool {
+	var terms map[string]bool
+	for _, keyword := range keywords {
+		wanted := a.queryTerms(keyword)
+		if len(wanted) == 0 {
+			continue
+		}
+		if terms == nil {
+			terms = a.terms([]byte(line))
+		}
+		found := false
+		for _, term := range wanted {
+			found = found || terms[term]
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// splitWords splits text into runs of letters and digits
+func splitWords(text string) []Token {
+	var out []Token
+	start := -1
+	for i, r := range text {
+		word := unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.Is(unicode.Mn, r)
+		if word && start < 0 {
+			start = i
+		}
+		if !word && start >= 0 {
+			out = append(out, Token{Term: text[start:i], Start: start, End: i})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		out = append(out, Token{Term: text[start:], Start: start, End: len(text)})
+	}
+	return out
+}
+
+// LowerCase lower-cases every token
+func LowerCase(tokens []Token, query bool) []Token {
+	for i := range tokens {
+		tokens[i].Term = strings.ToLower(tokens[i].Term)
+	}
+	return tokens
+}
+
+// FoldDiacritics replaces accented Latin letters by their base letters and drops combining
+// marks, so "José", "José" and "Jose" give the same term
+func FoldDiacritics(tokens []Token, query bool) []Token {
+	for i := range tokens {
+		tokens[i].Term = foldText(tokens[i].Term)
+	}
+	return tokens
+}
+
+// foldFrom and foldTo pair every accented letter folded to a single letter
+const (
+	foldFrom = "ÀÁÂÃÄÅÇÈÉÊËÌÍÎÏÐÑÒÓÔÕÖØÙÚÛÜÝàáâãäåçèéêëìíîïðñòóôõöøùúûüýÿĀāĂăĄąĆćĈĉĊċČčĎďĐđĒēĔĕĖėĘęĚěĜĝĞğĠġĢģĤĥĦħĨĩĪīĬĭĮįİıĴĵĶķĹĺĻļĽľĿŀŁłŃńŅņŇňŌōŎŏŐőŔŕŖŗŘřŚśŜŝŞşŠšŢţŤťŨũŪūŬŭŮůŰűŲųŴŵŶŷŸŹźŻżŽž"
+	foldTo   = "AAAAAACEEEEIIIIDNOOOOOOUUUUYaaaaaaceeeeiiiidnoooooouuuuyyAaAaAaCcCcCcCcDdDdEeEeEeEeEeGgGgGgGgHhHhIiIiIiIiIiJjKkLlLlLlLlLlNnNnNnOoOoOoRrRrRrSsSsSsSsTtTtUuUuUuUuUuUuWwYyYZzZzZz"
+)
+
+// folds maps every accented letter to its replacement
+var folds = func() map[rune]string {
+	m := map[rune]string{'Æ': "AE", 'æ': "ae", 'Œ': "OE", 'œ': "oe", 'ß': "ss", 'Þ': "TH", 'þ': "th"}
+	to := []rune(foldTo)
+	for i, r := range []rune(foldFrom) {
+		m[r] = string(to[i])
+	}
+	return m
+}()
+
+// foldText folds the diacritics of s, see FoldDiacritics
+func foldText(s string) string {
+	ascii := true
+	for i := 0; i < len(s) && ascii; i++ {
+		ascii = s[i] < utf8.RuneSelf
+	}
+	if ascii {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+		if f, ok := folds[r]; ok {
+			b.WriteString(f)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// englishStopWords are dropped by StopWords when it is given no words
+var englishStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "but", "by", "for", "if", "in", "into", "is",
+	"it", "no", "not", "of", "on", "or", "such", "that", "the", "their", "then", "there",
+	"these", "they", "this", "to", "was", "will", "with",
+}
+
+// StopWords returns a filter dropping the given words, or common English words when none are
+// given. Put it after LowerCase and FoldDiacritics.
+func StopWords(words ...string) TokenFilter {
+	if len(words) == 0 {
+		words = englishStopWords
+	}
+	stop := make(map[string]bool, len(words))
+	for _, w := range words {
+		stop[w] = true
+	}
+	return func(tokens []Token, query bool) []Token {
+		kept := tokens[:0]
+		for _, tok := range tokens {
+			if !stop[tok.Term] {
+				kept = append(kept, tok)
+			}
+		}
+		return kept
+	}
+}
+
+// EnglishStem reduces lower-case English words to their stem with the Porter algorithm,
+// "connected", "connecting" and "connection" all give "connect"
+func EnglishStem(tokens []Token, query bool) []Token {
+	for i := range tokens {
+		tokens[i].Term = porterStem(tokens[i].Term)
+	}
+	return tokens
+}
+
+// EdgeNGrams returns a filter replacing every stored word by its leading min to max
+// characters, and the whole word when it is longer, so queries match word prefixes. Queries
+// are left alone.
+func EdgeNGrams(min, max int) TokenFilter {
+	if min < 1 {
+		min = 1
+	}
+	return func(tokens []Token, query bool) []Token {
+		if query {
+			return tokens
+		}
+		var out []Token
+		for _, tok := range tokens {
+			runes := []rune(tok.Term)
+			for n := min; n <= max && n <= len(runes); n++ {
+				out = append(out, Token{Term: string(runes[:n]), Start: tok.Start, End: tok.End})
+			}
+			if len(runes) > max || len(runes) < min {
+				out = append(out, tok)
+			}
+		}
+		return out
+	}
+}
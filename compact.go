@@ -0,0 +1,276 @@
+package tardigrade
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// compactMinDead is the number of dead lines below which Options.CompactRatio never triggers
+const compactMinDead = 64
+
+// errCompactRaced is returned when the database was replaced while it was being compacted
+var errCompactRaced = errors.New("database replaced during compaction")
+
+// CompactStats describes the outcome of a compaction
+type CompactStats struct {
+	SizeBefore    int64 // file size before the swap
+	SizeAfter     int64
+	Reclaimed     int64 // SizeBefore - SizeAfter
+	RecordsBefore int   // lines before, including superseded versions, tombstones and blank lines
+	RecordsAfter  int   // lines after
+	Duration      time.Duration
+}
+
+// String returns a one line summary of the compaction
+func (c CompactStats) String() string {
+	return fmt.Sprintf("reclaimed %d bytes (%d -> %d), records %d -> %d in %s",
+		c.Reclaimed, c.SizeBefore, c.SizeAfter, c.RecordsBefore, c.RecordsAfter, c.Duration)
+}
+
+// Compact rewrites db with its live records only and swaps the new file in atomically. In
+// append storage the copy is made while readers and writers carry on, only the final swap
+// waits for the exclusive lock. A rewrite storage database just loses its blank lines.
+func (tar *Tardigrade) Compact(db string) (CompactStats, error) {
+	stats, err := tar.compact(db)
+	if err != nil {
+		return stats, newError("Compact", db, 0, err)
+	}
+	return stats, nil
+}
+
+// compact runs one compaction of db, a single one at a time per database in this process
+func (tar *Tardigrade) compact(db string) (CompactStats, error) {
+	start := time.Now()
+	s := stateFor(db)
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	var stats CompactStats
+	var err error
+	if kd := s.keydir(); kd != nil {
+		stats, err = tar.compactAppend(db, kd)
+	} else {
+		stats, err = tar.compactRewrite(db)
+	}
+	stats.Reclaimed = stats.SizeBefore - stats.SizeAfter
+	stats.Duration = time.Since(start)
+	return stats, err
+}
+
+// compactRewrite drops the blank lines of a rewrite storage database under the write lock
+func (tar *Tardigrade) compactRewrite(db string) (CompactStats, error) {
+	var stats CompactStats
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return stats, err
+	}
+	defer unlock()
+
+	if stats.SizeBefore, err = statDB(db); err != nil {
+		return stats, err
+	}
+	err = rewriteDB(db, tar.Durability, func(lines []string) ([]string, error) {
+		stats.RecordsBefore = len(lines)
+		kept := lines[:0]
+		for _, line := range lines {
+			if len(strings.TrimSpace(line)) > 0 {
+				kept = append(kept, line)
+			}
+		}
+		stats.RecordsAfter = len(kept)
+		return kept, nil
+	})
+	if err != nil {
+		return stats, err
+	}
+	stats.SizeAfter, err = statDB(db)
+	return stats, err
+}
+
+// compactAppend copies the live versions of an append storage database to a new file without
+// holding any lock, then takes the write lock to copy whatever was appended meanwhile and
+// swap the files
+func (tar *Tardigrade) compactAppend(db string, kd *keydir) (CompactStats, error) {
+	var stats CompactStats
+	file, err := os.Open(db)
+	if errors.Is(err, os.ErrNotExist) {
+		return stats, ErrDBMissing
+	}
+	if err != nil {
+		return stats, err
+	}
+	defer file.Close()
+
+	// snapshot the directory, appends only ever go past the snapshot size
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return stats, err
+	}
+	kd.mu.Lock()
+	err = kd.catchUp(file)
+	snapSize, lastID, indexes := kd.size, kd.lastID, kd.indexNames()
+	ids := make([]int, 0, len(kd.entries))
+	for id := range kd.entries {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	live := make([]keydirEntry, len(ids))
+	for i, id := range ids {
+		live[i] = kd.entries[id]
+	}
+	kd.mu.Unlock()
+	unlock()
+	if err != nil {
+		return stats, err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(db), "."+filepath.Base(db)+".tmp*")
+	if err != nil {
+		return stats, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	entries := make(map[int]keydirEntry, len(live))
+	var size int64
+	for i, e := range live {
+		line, err := readVersion(file, e)
+		if err != nil {
+			return stats, err
+		}
+		if _, err := tmp.Write(append(line, '\n')); err != nil {
+			return stats, err
+		}
+		e.Offset = size
+		entries[ids[i]] = e
+		size += int64(e.Length) + 1
+	}
+	dead := 0
+	if lastID > 0 && (len(ids) == 0 || ids[len(ids)-1] < lastID) {
+		// keep the tombstone of the highest id so a rebuilt directory never hands it out again
+		n, err := tmp.Write(tombstone(lastID))
+		if err != nil {
+			return stats, err
+		}
+		size += int64(n)
+		dead++
+	}
+
+	unlock, err = tar.writeLock(db)
+	if err != nil {
+		return stats, err
+	}
+	defer unlock()
+	info, err := file.Stat()
+	if err != nil {
+		return stats, err
+	}
+	if current, err := os.Stat(db); err != nil || !os.SameFile(info, current) {
+		return stats, errCompactRaced
+	}
+
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	if err := kd.catchUp(file); err != nil {
+		return stats, err
+	}
+	stats.SizeBefore = kd.info.Size()
+	stats.RecordsBefore = len(kd.entries) + kd.dead
+	if kd.size < snapSize || !sameNames(indexes, kd.indexNames()) {
+		return stats, errCompactRaced
+	}
+	tail, err := io.Copy(tmp, io.NewSectionReader(file, snapSize, kd.size-snapSize))
+	if err != nil {
+		return stats, err
+	}
+	if tar.Durability != SyncNone {
+		if err := tmp.Sync(); err != nil {
+			return stats, err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return stats, err
+	}
+	if err := os.Chmod(tmp.Name(), info.Mode().Perm()); err != nil {
+		return stats, err
+	}
+	if err := os.Rename(tmp.Name(), db); err != nil {
+		return stats, err
+	}
+	if tar.Durability == SyncOnWrite {
+		if err := syncDir(filepath.Dir(db)); err != nil {
+			return stats, err
+		}
+	}
+
+	// index the new file: the copied versions are known, the tail is scanned
+	compacted, err := os.Open(db)
+	if err != nil {
+		return stats, err
+	}
+	defer compacted.Close()
+	kd.reset()
+	kd.entries, kd.size, kd.lastID, kd.dead = entries, size, lastID, dead
+	kd.rebuildKeys()
+	if kd.info, err = compacted.Stat(); err != nil {
+		return stats, err
+	}
+	if err := kd.scan(compacted, size+tail); err != nil {
+		return stats, err
+	}
+	stats.RecordsAfter = len(live) + dead + kd.unsaved
+	stats.SizeAfter = kd.size
+	return stats, kd.saveHint(tar.Durability)
+}
+
+// deadRatio returns the share of the lines of the database that are not live records
+func (kd *keydir) deadRatio() (float64, int) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	total := len(kd.entries) + kd.dead
+	if total == 0 {
+		return 0, 0
+	}
+	return float64(kd.dead) / float64(total), kd.dead
+}
+
+// Compact rewrites the database with its live records only, see Tardigrade.Compact
+func (d *DB) Compact() (CompactStats, error) {
+	if err := d.writable("Compact"); err != nil {
+		return CompactStats{}, err
+	}
+	stats, err := d.tar.compact(d.path)
+	if err != nil {
+		return stats, newError("Compact", d.path, 0, err)
+	}
+	return stats, nil
+}
+
+// compactIfNeeded starts a background compaction once the dead ratio passes
+// Options.CompactRatio, a single one at a time per handle
+func (d *DB) compactIfNeeded(kd *keydir) {
+	if d.opts.CompactRatio <= 0 {
+		return
+	}
+	if ratio, dead := kd.deadRatio(); ratio <= d.opts.CompactRatio || dead < compactMinDead {
+		return
+	}
+	if !d.compacting.CompareAndSwap(false, true) {
+		return
+	}
+	d.background.Add(1)
+	go func() {
+		defer d.background.Done()
+		defer d.compacting.Store(false)
+		stats, err := d.tar.compact(d.path)
+		if d.opts.OnCompact != nil {
+			d.opts.OnCompact(stats, newError("Compact", d.path, 0, err))
+		}
+	}()
+}
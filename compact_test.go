@@ -0,0 +1,140 @@
+package tardigrade
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompactReadOnly(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "ro.db")
+	d, err := Open(db, Options{Create: true, Storage: StorageAppend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Add("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Modify(1, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	before, err := os.ReadFile(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ro, err := Open(db, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if _, err := ro.Compact(); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("Compact on a read-only handle = %v, want ErrReadOnly", err)
+	}
+	if after, _ := os.ReadFile(db); string(after) != string(before) {
+		t.Fatalf("read-only Compact rewrote the file:\n%s", after)
+	}
+}
+
+func TestCompactWhileWriting(t *testing.T) {
+	const records, rounds = 8, 100
+	var compactions atomic.Int32
+	failed := make(chan error, 1)
+	d, err := Open(filepath.Join(t.TempDir(), "busy.db"), Options{
+		Create: true, Storage: StorageAppend, CompactRatio: 0.3,
+		OnCompact: func(stats CompactStats, err error) {
+			if err != nil {
+				select {
+				case failed <- err:
+				default:
+				}
+				return
+			}
+			compactions.Add(1)
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= records; i++ {
+		if _, err := d.Add(fmt.Sprintf("k%d", i), "0"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4*records)
+	for id := 1; id <= records; id++ {
+		wg.Add(2)
+		go func(id int) {
+			defer wg.Done()
+			for round := 1; round <= rounds; round++ {
+				if err := d.Modify(id, fmt.Sprintf("k%d", id), strconv.Itoa(round)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(id)
+		go func(id int) {
+			defer wg.Done()
+			seen := 0
+			for round := 0; round < rounds; round++ {
+				got, err := d.Get(id)
+				if err != nil {
+					errs <- err
+					return
+				}
+				n, _ := strconv.Atoi(got.Data)
+				if got.Key != fmt.Sprintf("k%d", id) || n < seen {
+					errs <- fmt.Errorf("Get(%d) = %+v after seeing %d", id, got, seen)
+					return
+				}
+				seen = n
+			}
+		}(id)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if _, err := d.Compact(); err != nil {
+			errs <- err
+		}
+	}()
+	wg.Wait()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-failed:
+		t.Fatalf("background compaction: %v", err)
+	default:
+	}
+	if compactions.Load() == 0 {
+		t.Fatal("CompactRatio never triggered a compaction")
+	}
+
+	d, err = Open(d.Path(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	rows, err := d.Search("")
+	if err != nil || len(rows) != records {
+		t.Fatalf("records after compaction = %d, %v, want %d", len(rows), err, records)
+	}
+	for _, row := range rows {
+		if row.Data != strconv.Itoa(rounds) {
+			t.Fatalf("record %d = %+v, lost an update", row.Id, row)
+		}
+	}
+}
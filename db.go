@@ -0,0 +1,616 @@
+package tardigrade
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options configures a database handle returned by Open
+type Options struct {
+	// Create makes Open create the database file when it does not exist
+	Create bool
+	// ReadOnly rejects every write made through the handle with ErrReadOnly
+	ReadOnly bool
+	// LockTimeout bounds how long a call waits for another process to release the database,
+	// zero means DefaultLockTimeout
+	LockTimeout time.Duration
+	// Durability selects when writes are forced to stable storage, zero means SyncOnClose
+	Durability Durability
+	// WAL logs every write to <db>.wal before applying it. Entries left behind by a crash are
+	// replayed by Open, a database that already has a log is always replayed.
+	WAL bool
+	// CheckpointEvery folds the log into the database after this many entries, zero means
+	// DefaultCheckpointEvery and a negative value only checkpoints on Checkpoint and Close
+	CheckpointEvery int
+	// WALArchive keeps checkpointed log segments and base copies in this directory so the
+	// database can be rebuilt with RecoverTo. Every handle on the database must agree on it.
+	WALArchive string
+	// Storage set to StorageAppend converts the database to append storage, zero keeps the
+	// mode the file already uses
+	Storage StorageMode
+	// CompactRatio compacts an append storage database in the background once this share of
+	// its lines are superseded versions or tombstones (0.4 for 40%), and at least
+	// compactMinDead of them. Zero leaves compaction to Compact.
+	CompactRatio float64
+	// OnCompact is called with the outcome of every background compaction
+	OnCompact func(CompactStats, error)
+	// OnAlertError is called when an alert cannot be delivered, see Tardigrade.OnAlertError
+	OnAlertError func(a Alert, err error)
+	// UniqueKeys turns on the unique key constraint of the database, see
+	// Tardigrade.SetUniqueKeys. False leaves the setting stored with the database alone.
+	UniqueKeys bool
+	// FullText turns on the full-text index of the database, see Tardigrade.SetFullText
+	FullText bool
+}
+
+// DB is a long lived handle on a single database file. It keeps the file open and caches
+// the last id and record count between calls, the cache is refreshed whenever the file is
+// changed behind its back. Release it with Close.
+type DB struct {
+	tar   Tardigrade
+	path  string
+	opts  Options
+	state *dbState // shared with every other user of the file in this process
+
+	compacting atomic.Bool    // a background compaction is running
+	background sync.WaitGroup // background compactions, awaited by Close
+
+	mu      sync.Mutex // guards the fields below
+	file    *os.File
+	dirty   bool      // appended since the last flush
+	size    int64     // file size the cache was computed for
+	modTime time.Time // file modification time the cache was computed for
+	lastID  int
+	count   int
+}
+
+// Open returns a handle on the database stored at path
+// Usage: db, err := tardigrade.Open("mydb.db", tardigrade.Options{Create: true})
+func Open(path string, opts Options) (*DB, error) {
+	flag := os.O_RDWR
+	if opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	if opts.Create && !opts.ReadOnly {
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, newError("Open", path, 0, ErrDBMissing)
+	}
+	if err != nil {
+		return nil, newError("Open", path, 0, err)
+	}
+	d := &DB{
+		tar:   Tardigrade{LockTimeout: opts.LockTimeout, Durability: opts.Durability, OnAlertError: opts.OnAlertError},
+		path:  path,
+		opts:  opts,
+		file:  file,
+		state: stateFor(path),
+	}
+	if _, err := os.Stat(walPath(path)); opts.WAL || err == nil {
+		if err := d.openWAL(); err != nil {
+			file.Close()
+			return nil, newError("Open", path, 0, err)
+		}
+	}
+	if opts.Storage == StorageAppend && !opts.ReadOnly {
+		if err := d.tar.ConvertStorage(path, StorageAppend); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if opts.UniqueKeys && !opts.ReadOnly {
+		if err := d.tar.SetUniqueKeys(path, true); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if opts.FullText && !opts.ReadOnly {
+		if err := d.tar.SetFullText(path, true); err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	if err := d.refresh(); err != nil {
+		file.Close()
+		return nil, newError("Open", path, 0, err)
+	}
+	return d, nil
+}
+
+// openWAL enables the write-ahead log and replays it, swapping in the replayed file
+func (d *DB) openWAL() error {
+	if d.opts.ReadOnly {
+		return nil
+	}
+	unlock, err := d.tar.writeLock(d.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := d.state.enableWAL(d.opts.Durability, d.opts.CheckpointEvery, d.opts.WALArchive); err != nil {
+		return err
+	}
+	return d.reopen()
+}
+
+// Checkpoint folds the write-ahead log into the database, moving the checkpointed entries to
+// the archive when one is configured
+func (d *DB) Checkpoint() error {
+	return d.write("Checkpoint", func() error {
+		return newError("Checkpoint", d.path, 0, d.state.checkpointWAL(d.opts.Durability))
+	})
+}
+
+// BaseBackup stores a copy of the database in the WAL archive and returns its path, RecoverTo
+// starts from the newest base copy taken before the requested time
+func (d *DB) BaseBackup() (string, error) {
+	var path string
+	err := d.write("BaseBackup", func() (err error) {
+		path, err = d.state.baseBackup()
+		return newError("BaseBackup", d.path, 0, err)
+	})
+	return path, err
+}
+
+// RecoverTo rebuilds the database as it was at t and writes it to dst, the live database is
+// not touched. It needs a WALArchive holding a base copy taken before t.
+func (d *DB) RecoverTo(t time.Time, dst string) error {
+	return d.write("RecoverTo", func() error {
+		return newError("RecoverTo", d.path, 0, d.state.recoverTo(t, dst))
+	})
+}
+
+// Path returns the database file the handle was opened on
+func (d *DB) Path() string {
+	return d.path
+}
+
+// Close releases the file held by the handle once every pending call has finished. The
+// handle is closed even when the final checkpoint fails, ErrLockTimeout included, and that
+// error is returned.
+func (d *DB) Close() error {
+	d.background.Wait()
+	d.state.mu.Lock()
+	defer d.state.mu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return newError("Close", d.path, 0, ErrClosed)
+	}
+	var err error
+	if !d.opts.ReadOnly {
+		// the handle is closed even when the final checkpoint cannot get the lock
+		var fl *fileLock
+		if fl, err = acquireFileLock(d.state.path, true, d.opts.LockTimeout); err == nil {
+			if err = d.state.syncWAL(d.opts.Durability); err == nil {
+				err = d.state.checkpointWAL(d.opts.Durability)
+			}
+			if kd := d.state.keydir(); kd != nil && err == nil {
+				err = d.saveHint(kd)
+			}
+			fl.release()
+		}
+	}
+	if d.dirty && d.opts.Durability != SyncNone {
+		if serr := d.file.Sync(); err == nil {
+			err = serr
+		}
+	}
+	if cerr := d.file.Close(); err == nil {
+		err = cerr
+	}
+	d.file = nil
+	if err != nil {
+		return newError("Close", d.path, 0, err)
+	}
+	return nil
+}
+
+// Locked reports whether another process or handle currently holds the lock of the database
+func (d *DB) Locked() bool {
+	return d.tar.Locked(d.path)
+}
+
+// LockInfo returns the state of the cross-process lock of the database
+func (d *DB) LockInfo() (LockInfo, error) {
+	return d.tar.LockInfo(d.path)
+}
+
+// LastID returns the id of the last record in the database
+func (d *DB) LastID() (int, error) {
+	var id int
+	err := d.read("LastID", func(v view) error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		id = d.lastID
+		return nil
+	})
+	return id, err
+}
+
+// Count returns the number of records in the database
+func (d *DB) Count() (int, error) {
+	var count int
+	err := d.read("Count", func(v view) error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		count = d.count
+		return nil
+	})
+	return count, err
+}
+
+// Add appends a new record and returns the id assigned to it
+func (d *DB) Add(key, data string) (int, error) {
+	return d.add("Add", key, func(id int) interface{} {
+		return MyStruct{Id: id, Key: key, Data: data}
+	})
+}
+
+// AddFlex appends a new flexible record and returns the id assigned to it
+func (d *DB) AddFlex(key string, fields map[string]string) (int, error) {
+	return d.add("AddFlex", key, func(id int) interface{} {
+		return FlexStruct{Id: id, Key: key, Fields: fields}
+	})
+}
+
+// Get returns record id
+func (d *DB) Get(id int) (MyStruct, error) {
+	var s MyStruct
+	err := d.read("Get", func(v view) (err error) {
+		s, err = decodeRecord(v, id)
+		return newError("Get", d.path, id, err)
+	})
+	return s, err
+}
+
+// GetFlex returns flexible record id
+func (d *DB) GetFlex(id int) (FlexStruct, error) {
+	var record FlexStruct
+	err := d.read("GetFlex", func(v view) (err error) {
+		record, err = decodeFlex(v, id)
+		return newError("GetFlex", d.path, id, err)
+	})
+	return record, err
+}
+
+// Search returns every record matching ALL comma or space separated words in search
+func (d *DB) Search(search string) ([]MyStruct, error) {
+	var records []MyStruct
+	err := d.read("Search", func(v view) error {
+		a, err := analysisFor(d.path)
+		if err == nil {
+			records, err = searchRecords(v, a, search)
+		}
+		return newError("Search", d.path, 0, err)
+	})
+	return records, err
+}
+
+// SearchFlex returns every flexible record matching ALL comma or space separated words in search
+func (d *DB) SearchFlex(search string) ([]FlexStruct, error) {
+	var records []FlexStruct
+	err := d.read("SearchFlex", func(v view) error {
+		a, err := analysisFor(d.path)
+		if err == nil {
+			records, err = searchFlex(v, a, search)
+		}
+		return newError("SearchFlex", d.path, 0, err)
+	})
+	return records, err
+}
+
+// Modify replaces the key and data of record id
+func (d *DB) Modify(id int, key, data string) error {
+	return d.modify("Modify", id, key, MyStruct{Id: id, Key: key, Data: data})
+}
+
+// ModifyFlex replaces the key and fields of flexible record id
+func (d *DB) ModifyFlex(id int, key string, fields map[string]string) error {
+	return d.modify("ModifyFlex", id, key, FlexStruct{Id: id, Key: key, Fields: fields})
+}
+
+// Remove deletes record id
+func (d *DB) Remove(id int) error {
+	return d.write("Remove", func() error {
+		return d.erase("Remove", id)
+	})
+}
+
+// add appends the record built by build under the next free id
+func (d *DB) add(op, key string, build func(id int) interface{}) (int, error) {
+	var id int
+	err := d.write(op, func() (err error) {
+		id, err = d.insert(op, key, build)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
+
+// modify swaps the line holding record id with the encoding of v
+func (d *DB) modify(op string, id int, key string, v interface{}) error {
+	return d.write(op, func() error {
+		return d.replace(op, id, key, v)
+	})
+}
+
+// insert appends the record built by build under the next free id, the caller holds the
+// write lock and d.mu
+func (d *DB) insert(op, key string, build func(id int) interface{}) (int, error) {
+	v := d.view()
+	if err := checkKey(d.path, v, key, 0); err != nil {
+		return 0, newError(op, d.path, 0, err)
+	}
+	id := d.lastID + 1
+	response, err := d.tar.MyMarshal(build(id))
+	if err != nil {
+		return 0, newError(op, d.path, id, err)
+	}
+	err = d.tar.logged(d.path, "add", id, response, func() error {
+		if err := d.put(response); err != nil {
+			return err
+		}
+		if d.state.keydir() == nil {
+			d.lastID = id
+			d.count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, newError(op, d.path, id, err)
+	}
+	return id, nil
+}
+
+// replace swaps the line holding record id with the encoding of v, the caller holds the
+// write lock and d.mu
+func (d *DB) replace(op string, id int, key string, v interface{}) error {
+	view := d.view()
+	before, err := findLine(view, id)
+	if err != nil {
+		return newError(op, d.path, id, err)
+	}
+	if err := checkKey(d.path, view, key, id); err != nil {
+		return newError(op, d.path, id, err)
+	}
+	after, err := d.tar.MyMarshal(v)
+	if err != nil {
+		return newError(op, d.path, id, err)
+	}
+	err = d.tar.logged(d.path, "modify", id, after, func() error {
+		return d.store(after, replaceLine(before, strings.TrimSpace(string(after))))
+	})
+	return newError(op, d.path, id, err)
+}
+
+// erase removes record id, the caller holds the write lock and d.mu
+func (d *DB) erase(op string, id int) error {
+	line, err := findLine(d.view(), id)
+	if err != nil {
+		return newError(op, d.path, id, err)
+	}
+	err = d.tar.logged(d.path, "remove", id, nil, func() error {
+		return d.store(tombstone(id), removeLine(line))
+	})
+	return newError(op, d.path, id, err)
+}
+
+// read runs fn under the shared lock, fn scans a consistent view of the file
+func (d *DB) read(op string, fn func(v view) error) error {
+	unlock, err := d.tar.readLock(d.path)
+	if err != nil {
+		return newError(op, d.path, 0, err)
+	}
+	defer unlock()
+
+	d.mu.Lock()
+	if err := d.ready(op, false); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	v := d.view()
+	d.mu.Unlock()
+
+	return fn(v)
+}
+
+// write runs fn under the exclusive lock
+func (d *DB) write(op string, fn func() error) error {
+	unlock, err := d.tar.writeLock(d.path)
+	if err != nil {
+		return newError(op, d.path, 0, err)
+	}
+	defer unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.ready(op, true); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// ready checks the handle can serve op and refreshes the cache if the file changed, a
+// database replaced by an atomic rewrite is reopened first
+func (d *DB) ready(op string, write bool) error {
+	if d.file == nil {
+		return newError(op, d.path, 0, ErrClosed)
+	}
+	if write && d.opts.ReadOnly {
+		return newError(op, d.path, 0, ErrReadOnly)
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return newError(op, d.path, 0, err)
+	}
+	if current, err := os.Stat(d.path); err == nil && !os.SameFile(info, current) {
+		if err := d.reopen(); err != nil {
+			return newError(op, d.path, 0, err)
+		}
+		return nil
+	}
+	if info.Size() != d.size || !info.ModTime().Equal(d.modTime) {
+		if err := d.refresh(); err != nil {
+			return newError(op, d.path, 0, err)
+		}
+	}
+	return nil
+}
+
+// writable fails unless the handle is open for writing, for calls that take the lock themselves
+func (d *DB) writable(op string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.file == nil {
+		return newError(op, d.path, 0, ErrClosed)
+	}
+	if d.opts.ReadOnly {
+		return newError(op, d.path, 0, ErrReadOnly)
+	}
+	return nil
+}
+
+// reopen swaps the file held by the handle for the one currently stored at its path
+func (d *DB) reopen() error {
+	flag := os.O_RDWR
+	if d.opts.ReadOnly {
+		flag = os.O_RDONLY
+	}
+	file, err := os.OpenFile(d.path, flag, 0644)
+	if err != nil {
+		return err
+	}
+	if d.dirty && d.opts.Durability != SyncNone {
+		d.file.Sync()
+	}
+	d.file.Close()
+	d.file, d.dirty = file, false
+	return d.refresh()
+}
+
+// refresh recomputes the cached last id and record count from the file
+func (d *DB) refresh() error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	d.size, d.modTime = info.Size(), info.ModTime()
+	if kd := d.state.keydir(); kd != nil {
+		if err := kd.update(d.file); err != nil {
+			return err
+		}
+		d.count, d.lastID = kd.stats()
+		return nil
+	}
+	d.count = 0
+	err = d.scan(func(line string) error {
+		if len(strings.TrimSpace(line)) > 0 {
+			d.count++
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrDBEmpty) {
+		return err
+	}
+	d.lastID, err = lastID(view{each: d.scan})
+	return err
+}
+
+// store writes the new version of a record like storeVersion, through the file of the handle
+func (d *DB) store(version []byte, edit func(lines []string) ([]string, error)) error {
+	if d.state.keydir() == nil {
+		return d.rewrite(edit)
+	}
+	return d.put(version)
+}
+
+// put appends to the file held by the handle, through the key directory in append storage
+func (d *DB) put(line []byte) error {
+	if kd := d.state.keydir(); kd != nil {
+		size, err := kd.append(d.file, line)
+		if err != nil {
+			return err
+		}
+		d.size = size
+		d.count, d.lastID = kd.stats()
+		d.compactIfNeeded(kd)
+	} else {
+		if _, err := d.file.WriteAt(line, d.size); err != nil {
+			return err
+		}
+		d.size += int64(len(line))
+	}
+	d.dirty = true
+	d.stamp()
+	if d.opts.Durability == SyncOnWrite {
+		d.dirty = false
+		return d.file.Sync()
+	}
+	return nil
+}
+
+// saveHint brings the key directory up to date with the file of the handle and saves it
+func (d *DB) saveHint(kd *keydir) error {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	if err := kd.catchUp(d.file); err != nil {
+		return err
+	}
+	return kd.saveHint(SyncNone)
+}
+
+// rewrite atomically applies edit to the whole database and reopens it
+func (d *DB) rewrite(edit func(lines []string) ([]string, error)) error {
+	if err := rewriteDB(d.path, d.opts.Durability, edit); err != nil {
+		return err
+	}
+	return d.reopen()
+}
+
+// stamp records the current modification time after a write made through the handle
+func (d *DB) stamp() {
+	if info, err := d.file.Stat(); err == nil {
+		d.modTime = info.ModTime()
+	}
+}
+
+// view returns the view of the file held by the handle, the caller must hold d.mu
+func (d *DB) view() view {
+	return d.state.idIndex().view(d.file)
+}
+
+// lines returns the live lines of the file held by the handle, the caller must hold d.mu
+func (d *DB) lines() ([]string, error) {
+	var lines []string
+	err := d.view().each(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if errors.Is(err, ErrDBEmpty) {
+		err = nil
+	}
+	return lines, err
+}
+
+// scan walks the lines of the file held by the handle, the caller must hold d.mu
+func (d *DB) scan(fn func(line string) error) error {
+	return scanFile(d.file, d.size, fn)
+}
+
+// scanFile walks the first size bytes of file
+func scanFile(file *os.File, size int64, fn func(line string) error) error {
+	if size <= 1 {
+		return ErrDBEmpty
+	}
+	return scanLines(io.NewSectionReader(file, 0, size), fn)
+}
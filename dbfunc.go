@@ -3,14 +3,17 @@ package tardigrade
 // Version 0.3.0 - Sun Jan 18 09:38:18 PM GMT 2026
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 )
 
-// CreatedDBCopy creates a copy of the Database and store in UserHomeDir().
+// CreatedDBCopy creates a copy of the Database and store in UserHomeDir(). The copy of an
+// append storage database holds its live records only, in rewrite storage.
 func (tar *Tardigrade) CreatedDBCopy(db string) (msg string, status bool) {
+	defer tar.mustLock("CreatedDBCopy", db, false)()
 	status = true
 	dirname, err := os.UserHomeDir()
 	CheckError("CreatedDBCopy(0)", err)
@@ -21,7 +24,7 @@ func (tar *Tardigrade) CreatedDBCopy(db string) (msg string, status bool) {
 		msg = fmt.Sprintf("Failed: database %s missing!", src)
 		return msg, false
 	}
-	fin, err := os.Open(src)
+	fin, err := tar.openDB(src)
 	CheckError("CreatedDBCopy(1)", err)
 	defer fin.Close()
 
@@ -32,6 +35,20 @@ func (tar *Tardigrade) CreatedDBCopy(db string) (msg string, status bool) {
 	CheckError("CreatedDBCopy(2)", err)
 	defer tmp.Close()
 
+	if stateFor(src).keydir() != nil {
+		err := pathView(src).each(func(line string) error {
+			_, err := io.WriteString(tmp, line+"\n")
+			return err
+		})
+		if err != nil && !errors.Is(err, ErrDBEmpty) {
+			CheckError("CreatedDBCopy(4)", err)
+			msg = "Failed: permission error failed to create database!"
+			return msg, false
+		}
+		msg = fmt.Sprintf("Copy: %s", dst)
+		return msg, true
+	}
+
 buffering:
 	for {
 		n, err := fin.Read(buf)
@@ -59,6 +76,12 @@ buffering:
 
 // CreateDB - This function will create a database file if it does not exist and return true | false
 func (tar *Tardigrade) CreateDB(db string) (msg string, status bool) {
+	defer tar.mustLock("CreateDB", db, true)()
+	return tar.createDB(db)
+}
+
+// createDB creates db, the caller must hold its write lock
+func (tar *Tardigrade) createDB(db string) (msg string, status bool) {
 	status = true
 	fname := db
 	pwd, _ := filepath.Abs(fname)
@@ -79,12 +102,19 @@ func (tar *Tardigrade) CreateDB(db string) (msg string, status bool) {
 
 // DeleteDB - WARNING - this function delete the database file return true | false
 func (tar *Tardigrade) DeleteDB(db string) (msg string, status bool) {
+	defer tar.mustLock("DeleteDB", db, true)()
+	return tar.deleteDB(db)
+}
+
+// deleteDB removes db, the caller must hold its write lock
+func (tar *Tardigrade) deleteDB(db string) (msg string, status bool) {
 	fname := db
 	status = true
 	pwd, _ := filepath.Abs(fname)
 	if tar.fileExists(fname) {
 		delete := os.Remove(fname)
 		CheckError("DeleteDB(1)", delete)
+		removeSidecars(fname)
 		if tar.fileExists(fname) {
 			status = false
 			return fmt.Sprintf("Failed: %v", pwd), status
@@ -106,20 +136,44 @@ func (tar *Tardigrade) fileExists(filename string) bool {
 }
 
 // EmptyDB function - WARNING - this will destroy the database and all data stored in it!
+// Its settings (unique keys, indexes, full-text search, analyzers, alerts and storage mode)
+// are kept.
 func (tar *Tardigrade) EmptyDB(db string) (msg string, status bool) {
-	_, status = tar.DeleteDB(db)
-	if status {
-		_, status = tar.CreateDB(db)
-		if !status {
-			status = false
-			msg = "Failed: no permission to re-create!"
-			return msg, status
-		}
-	} else {
+	defer tar.mustLock("EmptyDB", db, true)()
+	if !tar.fileExists(db) {
 		status = false
 		msg = "Missing: could not find database!"
 		return msg, status
 	}
+	if err := tar.emptyDB(db); err != nil {
+		status = false
+		msg = "Failed: no permission to re-create!"
+		return msg, status
+	}
 	msg = "Empty: database now clean!"
-	return msg, status
+	return msg, true
+}
+
+// emptyDB drops the records of db and the indexes built from them, its log is checkpointed
+// so no entry written before is replayed over the empty file. With a WAL archive a base copy
+// of the empty database is taken so RecoverTo does not bring the records back either. The
+// caller holds the write lock.
+func (tar *Tardigrade) emptyDB(db string) error {
+	if err := replaceFile(db, nil, tar.Durability); err != nil {
+		return err
+	}
+	for _, path := range []string{hintPath(db), idxPath(db)} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	s := stateFor(db)
+	if err := s.checkpointWAL(tar.Durability); err != nil {
+		return err
+	}
+	if s.wal != nil && s.wal.archive != "" {
+		_, err := s.baseBackup()
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,73 @@
+package tardigrade
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestEmptyDBKeepsSettings(t *testing.T) {
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "empty.db")
+	tar.CreateDB(db)
+	if err := tar.SetUniqueKeys(db, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := tar.CreateIndex(db, "city"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tar.ConvertStorage(db, StorageAppend); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tar.AddFlexFieldE("a", map[string]string{"city": "Leeds"}, db); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg, ok := tar.EmptyDB(db); !ok {
+		t.Fatalf("EmptyDB: %s", msg)
+	}
+	if n := tar.CountSize(db); n != 0 {
+		t.Fatalf("CountSize = %d, want 0", n)
+	}
+	if rows, err := tar.FindFlexWhere("city", "=", "Leeds", db); !errors.Is(err, ErrDBEmpty) {
+		t.Fatalf("FindFlexWhere = %+v, %v, want ErrDBEmpty", rows, err)
+	}
+	indexes, err := tar.Indexes(db)
+	if err != nil || len(indexes) != 1 || indexes[0][0] != "city" {
+		t.Fatalf("Indexes = %v, %v", indexes, err)
+	}
+	if stateFor(db).keydir() == nil {
+		t.Fatal("storage mode lost")
+	}
+	if _, err := tar.AddFlexFieldE("b", nil, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tar.AddFlexFieldE("b", nil, db); !errors.Is(err, ErrDuplicateKey) {
+		t.Fatalf("second AddFlexFieldE = %v, want ErrDuplicateKey", err)
+	}
+}
+
+func TestEmptyDBCheckpointsWAL(t *testing.T) {
+	d := openWALDB(t, Options{})
+	if _, err := d.Add("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	crashEntry(t, d.Path(), "add", 2, `{"id":2,"key":"b","data":"2"}`)
+	forget(d.Path())
+
+	tar := &Tardigrade{}
+	if msg, ok := tar.EmptyDB(d.Path()); !ok {
+		t.Fatalf("EmptyDB: %s", msg)
+	}
+	d, err := Open(d.Path(), Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n, err := d.Count(); err != nil || n != 0 {
+		t.Fatalf("Count after reopening = %d, %v, want 0", n, err)
+	}
+}
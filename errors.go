@@ -0,0 +1,76 @@
+package tardigrade
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Sentinel errors returned by the error-returning API, test them with errors.Is
+var (
+	ErrNotFound      = errors.New("record not found")
+	ErrDBMissing     = errors.New("database missing")
+	ErrCorruptRecord = errors.New("corrupt record")
+	ErrInvalidFormat = errors.New("invalid format")
+	ErrClosed        = errors.New("database handle is closed")
+	ErrReadOnly      = errors.New("database handle is read-only")
+	ErrDuplicateKey  = errors.New("key already exists")
+	ErrInvalidQuery  = errors.New("invalid query")
+	ErrFieldType     = errors.New("field type mismatch")
+	ErrTestFailed    = errors.New("patch test failed")
+
+	// ErrDBEmpty is returned by lookups against an empty database, it also matches ErrNotFound
+	ErrDBEmpty = fmt.Errorf("%w: database is empty", ErrNotFound)
+)
+
+// Error describes a failed operation, use errors.As to inspect the database and record involved
+type Error struct {
+	Op  string // method that failed, e.g. "SelectByID"
+	DB  string // database path
+	ID  int    // record id, 0 when the operation is not tied to a record
+	Err error  // underlying error, usually one of the sentinel errors above
+}
+
+func (e *Error) Error() string {
+	if e.ID > 0 {
+		return fmt.Sprintf("tardigrade: %s %s record %d: %v", e.Op, e.DB, e.ID, e.Err)
+	}
+	return fmt.Sprintf("tardigrade: %s %s: %v", e.Op, e.DB, e.Err)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// newError wraps err with the operation context unless it is nil or already carries one
+func newError(op, db string, id int, err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return &Error{Op: op, DB: db, ID: id, Err: err}
+}
+
+// corrupt wraps a decoding failure so it matches both ErrCorruptRecord and the json error
+func corrupt(err error) error {
+	return fmt.Errorf("%w: %w", ErrCorruptRecord, err)
+}
+
+// legacyMessage converts an error from the E API into the sentinel strings returned by the
+// original methods, any other error is treated as fatal the same way CheckError always did.
+func legacyMessage(op, db string, id int, err error) string {
+	switch {
+	case errors.Is(err, ErrDBMissing):
+		return fmt.Sprintf("Database %s missing!", db)
+	case errors.Is(err, ErrDBEmpty):
+		return fmt.Sprintf("Database %s is empty!", db)
+	case errors.Is(err, ErrNotFound):
+		return fmt.Sprintf("Record %v is empty!", id)
+	case errors.Is(err, ErrDuplicateKey):
+		return fmt.Sprintf("Record %v key already exists!", id)
+	}
+	CheckError(op, err)
+	return ""
+}
@@ -0,0 +1,217 @@
+package tardigrade
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// defaultFacetSize is the number of values a facet returns when FacetRequest.Size is 0
+const defaultFacetSize = 10
+
+// FacetRequest asks for the most frequent values of Field among the matching records, Size of
+// them (10 when 0), and for the number of records whose numeric value falls in each of Ranges
+type FacetRequest struct {
+	Field  string       `json:"field"`
+	Size   int          `json:"size,omitempty"`
+	Ranges []FacetRange `json:"ranges,omitempty"`
+}
+
+// FacetRange is a numeric bucket holding the values from From up to but not including To, an
+// empty bound is open. Label names the bucket, "From-To" by default with "*" for an open bound.
+type FacetRange struct {
+	Label string `json:"label,omitempty"`
+	From  string `json:"from,omitempty"`
+	To    string `json:"to,omitempty"`
+}
+
+// Facet holds the counts of one FacetRequest. Values are ordered by count then value, Other
+// counts the records holding a value beyond the first Size and Missing those without the field.
+type Facet struct {
+	Field   string        `json:"field"`
+	Values  []FacetValue  `json:"values"`
+	Ranges  []FacetBucket `json:"ranges,omitempty"`
+	Other   int           `json:"other"`
+	Missing int           `json:"missing"`
+}
+
+// FacetValue is a field value and the number of matching records holding it
+type FacetValue struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// FacetBucket is a FacetRange and the number of matching records in it
+type FacetBucket struct {
+	FacetRange
+	Count int `json:"count"`
+}
+
+// Facets counts the values of the requested fields among the records of db matching the
+// filters of q, nil for every record
+// Usage: facets, err := tar.Facets("app.db", q, tardigrade.FacetRequest{Field: "os", Size: 5})
+func (tar *Tardigrade) Facets(db string, q *Query, facets ...FacetRequest) ([]Facet, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, newError("Facets", db, 0, err)
+	}
+	defer unlock()
+
+	result, err := queryFacets(pathView(db), q, facets)
+	return result, newError("Facets", db, 0, err)
+}
+
+// SelectFlexSearchFacets returns what SelectFlexSearchE returns together with the facets of
+// the matching records, read in one pass
+func (tar *Tardigrade) SelectFlexSearchFacets(search string, db string, facets ...FacetRequest) ([]FlexStruct, []Facet, error) {
+	if err := checkFacets(facets); err != nil {
+		return nil, nil, newError("SelectFlexSearchFacets", db, 0, err)
+	}
+	results, err := tar.SelectFlexSearchE(search, db)
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, countFacets(flexRows(results), facets), nil
+}
+
+// queryFacets counts facets over the records of v matching q
+func queryFacets(v view, q *Query, facets []FacetRequest) ([]Facet, error) {
+	if q == nil {
+		q = NewQuery()
+	}
+	if err := checkFacets(facets); err != nil {
+		return nil, err
+	}
+	rows, _, err := filterRows(v, q)
+	if err != nil {
+		return nil, err
+	}
+	return countFacets(rows, facets), nil
+}
+
+// checkFacets rejects facets without a field, negative sizes and non-numeric range bounds
+func checkFacets(facets []FacetRequest) error {
+	for _, f := range facets {
+		if f.Field == "" {
+			return fmt.Errorf("%w: facet without a field", ErrInvalidQuery)
+		}
+		if f.Size < 0 {
+			return fmt.Errorf("%w: negative size for facet %s", ErrInvalidQuery, f.Field)
+		}
+		for _, r := range f.Ranges {
+			for _, bound := range []string{r.From, r.To} {
+				if bound != "" && !isNumber(bound) {
+					return fmt.Errorf("%w: range bound %q of facet %s is not a number", ErrInvalidQuery, bound, f.Field)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// flexRows returns the fields of records the way queries see them
+func flexRows(records []FlexStruct) []map[string]string {
+	rows := make([]map[string]string, len(records))
+	for i, record := range records {
+		row := make(map[string]string, len(record.Fields)+2)
+		for name, value := range record.Fields {
+			row[name] = value
+		}
+		row["id"] = strconv.Itoa(record.Id)
+		row["key"] = record.Key
+		rows[i] = row
+	}
+	return rows
+}
+
+// countFacets counts every facet over rows
+func countFacets(rows []map[string]string, facets []FacetRequest) []Facet {
+	result := make([]Facet, len(facets))
+	for i, req := range facets {
+		f := Facet{Field: req.Field, Values: []FacetValue{}}
+		counts := make(map[string]int)
+		for _, row := range rows {
+			value, ok := fieldValue(row, req.Field)
+			if !ok {
+				f.Missing++
+				continue
+			}
+			counts[value]++
+		}
+		for value, n := range counts {
+			f.Values = append(f.Values, FacetValue{Value: value, Count: n})
+		}
+		sort.Slice(f.Values, func(a, b int) bool {
+			if f.Values[a].Count != f.Values[b].Count {
+				return f.Values[a].Count > f.Values[b].Count
+			}
+			return sortCompare(f.Values[a].Value, f.Values[b].Value) < 0
+		})
+		size := req.Size
+		if size == 0 {
+			size = defaultFacetSize
+		}
+		if len(f.Values) > size {
+			for _, v := range f.Values[size:] {
+				f.Other += v.Count
+			}
+			f.Values = f.Values[:size]
+		}
+		for _, r := range req.Ranges {
+			bucket := FacetBucket{FacetRange: r}
+			if bucket.Label == "" {
+				bucket.Label = openBound(r.From) + "-" + openBound(r.To)
+			}
+			for value, n := range counts {
+				if inRange(value, r) {
+					bucket.Count += n
+				}
+			}
+			f.Ranges = append(f.Ranges, bucket)
+		}
+		result[i] = f
+	}
+	return result
+}
+
+// openBound returns bound, or "*" when it is open
+func openBound(bound string) string {
+	if bound == "" {
+		return "*"
+	}
+	return bound
+}
+
+// inRange reports whether value is a number from r.From up to but not including r.To
+func inRange(value string, r FacetRange) bool {
+	if !isNumber(value) {
+		return false
+	}
+	value = strings.TrimSpace(value)
+	return (r.From == "" || compareValues(value, r.From) >= 0) && (r.To == "" || compareValues(value, r.To) < 0)
+}
+
+// Facets counts the values of the requested fields among the records matching q, see
+// Tardigrade.Facets
+func (d *DB) Facets(q *Query, facets ...FacetRequest) ([]Facet, error) {
+	var result []Facet
+	err := d.read("Facets", func(v view) (err error) {
+		result, err = queryFacets(v, q, facets)
+		return newError("Facets", d.path, 0, err)
+	})
+	return result, err
+}
+
+// SearchFlexFacets returns what SearchFlex returns together with the facets of the matching
+// records
+func (d *DB) SearchFlexFacets(search string, facets ...FacetRequest) ([]FlexStruct, []Facet, error) {
+	if err := checkFacets(facets); err != nil {
+		return nil, nil, newError("SearchFlexFacets", d.path, 0, err)
+	}
+	results, err := d.SearchFlex(search)
+	if err != nil {
+		return nil, nil, err
+	}
+	return results, countFacets(flexRows(results), facets), nil
+}
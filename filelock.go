@@ -0,0 +1,171 @@
+package tardigrade
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultLockTimeout is how long a call waits for another process to release a database
+// when no LockTimeout is configured
+const DefaultLockTimeout = 30 * time.Second
+
+// ErrLockTimeout is returned when the lock of a database could not be acquired in time
+var ErrLockTimeout = errors.New("lock timeout")
+
+// errWouldBlock is returned by flock when a non-blocking attempt finds the lock taken
+var errWouldBlock = errors.New("lock held")
+
+// LockInfo describes the cross-process lock of a database
+type LockInfo struct {
+	Held      bool      // some process currently holds the lock
+	Exclusive bool      // the current holder is a writer
+	PID       int       // process id of the last writer recorded in the lock file, 0 if none
+	Since     time.Time // when that writer acquired the lock
+	Stale     bool      // the recorded writer is no longer running, it died while holding the lock
+}
+
+// fileLock is an advisory lock held on the lock file of a database
+type fileLock struct {
+	file      *os.File
+	exclusive bool
+}
+
+// lockPath returns the lock file used to coordinate processes working on db
+func lockPath(db string) string {
+	return db + ".lock"
+}
+
+// acquireFileLock locks the lock file of db, shared for readers and exclusive for writers,
+// giving up with ErrLockTimeout after timeout. A reader of a database that does not exist
+// gets a no-op lock so lookups never create files.
+func acquireFileLock(db string, exclusive bool, timeout time.Duration) (*fileLock, error) {
+	flag := os.O_RDWR
+	if _, err := os.Stat(db); exclusive || err == nil {
+		flag |= os.O_CREATE
+	}
+	file, err := os.OpenFile(lockPath(db), flag, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return &fileLock{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if timeout <= 0 {
+		timeout = DefaultLockTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	wait := time.Millisecond
+	for {
+		err = flock(file, exclusive)
+		if err == nil {
+			break
+		}
+		if err != errWouldBlock || time.Now().After(deadline) {
+			file.Close()
+			if err == errWouldBlock {
+				info, _ := readLockInfo(db)
+				return nil, fmt.Errorf("%w after %v: %s", ErrLockTimeout, timeout, info)
+			}
+			return nil, err
+		}
+		time.Sleep(wait)
+		if wait < 50*time.Millisecond {
+			wait *= 2
+		}
+	}
+
+	l := &fileLock{file: file, exclusive: exclusive}
+	if exclusive {
+		file.Truncate(0)
+		file.WriteAt([]byte(fmt.Sprintf("%d %d\n", os.Getpid(), time.Now().UnixNano())), 0)
+	}
+	return l, nil
+}
+
+// release clears the holder record of an exclusive lock and unlocks the file
+func (l *fileLock) release() {
+	if l.file == nil {
+		return
+	}
+	if l.exclusive {
+		l.file.Truncate(0)
+	}
+	funlock(l.file)
+	l.file.Close()
+}
+
+// readLockInfo probes the lock file of db without waiting
+func readLockInfo(db string) (LockInfo, error) {
+	var info LockInfo
+	file, err := os.OpenFile(lockPath(db), os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	defer file.Close()
+
+	switch err := flock(file, true); err {
+	case nil:
+		funlock(file)
+	case errWouldBlock:
+		info.Held = true
+		if err := flock(file, false); err == errWouldBlock {
+			info.Exclusive = true
+		} else if err == nil {
+			funlock(file)
+		}
+	default:
+		return info, err
+	}
+
+	content, err := os.ReadFile(lockPath(db))
+	if err != nil {
+		return info, err
+	}
+	fields := strings.Fields(string(content))
+	if len(fields) == 2 {
+		info.PID, _ = strconv.Atoi(fields[0])
+		nanos, _ := strconv.ParseInt(fields[1], 10, 64)
+		info.Since = time.Unix(0, nanos)
+		info.Stale = info.PID > 0 && !processAlive(info.PID)
+	}
+	return info, nil
+}
+
+func (info LockInfo) String() string {
+	state := "free"
+	if info.Held && info.Exclusive {
+		state = "held by a writer"
+	} else if info.Held {
+		state = "held by readers"
+	}
+	if info.PID > 0 {
+		state += fmt.Sprintf(", last writer pid %d since %s", info.PID, info.Since.Format(time.RFC3339))
+	}
+	if info.Stale {
+		state += " (stale, process is gone)"
+	}
+	return state
+}
+
+// Locked reports whether another process or handle currently holds the lock of db
+func (tar *Tardigrade) Locked(db string) bool {
+	info, err := readLockInfo(db)
+	return err == nil && info.Held
+}
+
+// LockInfo returns the state of the cross-process lock of db, useful to debug hangs
+func (tar *Tardigrade) LockInfo(db string) (LockInfo, error) {
+	info, err := readLockInfo(db)
+	if err != nil {
+		return info, newError("LockInfo", db, 0, err)
+	}
+	return info, nil
+}
@@ -0,0 +1,20 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package tardigrade
+
+import "os"
+
+// flock is a no-op on platforms without flock, only the in-process lock applies there
+func flock(file *os.File, exclusive bool) error {
+	return nil
+}
+
+// funlock is a no-op on platforms without flock
+func funlock(file *os.File) error {
+	return nil
+}
+
+// processAlive cannot be probed portably, assume the process still runs
+func processAlive(pid int) bool {
+	return true
+}
@@ -0,0 +1,135 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package tardigrade
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestLockHelperProcess holds the lock of a database for TestFileLock* from another process
+// until its stdin is closed
+func TestLockHelperProcess(t *testing.T) {
+	db := os.Getenv("TARDIGRADE_LOCK_DB")
+	if db == "" {
+		t.Skip("helper process only")
+	}
+	l, err := acquireFileLock(db, os.Getenv("TARDIGRADE_LOCK_MODE") == "exclusive", time.Second)
+	if err != nil {
+		os.Exit(1)
+	}
+	os.Stdout.WriteString("locked\n")
+	io.Copy(io.Discard, os.Stdin)
+	l.release()
+	os.Exit(0)
+}
+
+// lockHelper starts a process holding the lock of db and returns it with the pipe whose
+// closing makes it release the lock
+func lockHelper(t *testing.T, db string, exclusive bool) (*exec.Cmd, io.WriteCloser) {
+	t.Helper()
+	mode := "shared"
+	if exclusive {
+		mode = "exclusive"
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelperProcess$")
+	cmd.Env = append(os.Environ(), "TARDIGRADE_LOCK_DB="+db, "TARDIGRADE_LOCK_MODE="+mode)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stdin.Close()
+		cmd.Wait()
+	})
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Fatalf("helper did not take the lock: %q, %v", line, err)
+	}
+	return cmd, stdin
+}
+
+func TestFileLockWriterBlocksOtherProcesses(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "locked.db")
+	tar := &Tardigrade{LockTimeout: 50 * time.Millisecond}
+	tar.CreateDB(db)
+	if _, err := tar.AddFieldE("a", "1", db); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, stdin := lockHelper(t, db, true)
+	info, err := tar.LockInfo(db)
+	if err != nil || !info.Held || !info.Exclusive || info.PID != cmd.Process.Pid || info.Stale {
+		t.Fatalf("LockInfo = %+v, %v, want held by the writer pid %d", info, err, cmd.Process.Pid)
+	}
+	if _, err := tar.AddFieldE("b", "2", db); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("AddFieldE under another writer = %v, want ErrLockTimeout", err)
+	}
+	if _, err := tar.SelectByIDE(1, "raw", db); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("SelectByIDE under another writer = %v, want ErrLockTimeout", err)
+	}
+
+	stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if tar.Locked(db) {
+		t.Fatal("lock still held after the writer released it")
+	}
+	if id, err := tar.AddFieldE("b", "2", db); err != nil || id != 2 {
+		t.Fatalf("AddFieldE after the release = %d, %v", id, err)
+	}
+}
+
+func TestFileLockReadersShare(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "shared.db")
+	tar := &Tardigrade{LockTimeout: 50 * time.Millisecond}
+	tar.CreateDB(db)
+	if _, err := tar.AddFieldE("a", "1", db); err != nil {
+		t.Fatal(err)
+	}
+
+	lockHelper(t, db, false)
+	if info, err := tar.LockInfo(db); err != nil || !info.Held || info.Exclusive {
+		t.Fatalf("LockInfo = %+v, %v, want held by readers", info, err)
+	}
+	if _, err := tar.SelectByIDE(1, "raw", db); err != nil {
+		t.Fatalf("SelectByIDE next to another reader = %v", err)
+	}
+	if _, err := tar.AddFieldE("b", "2", db); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("AddFieldE under another reader = %v, want ErrLockTimeout", err)
+	}
+}
+
+func TestFileLockStaleWriter(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "stale.db")
+	tar := &Tardigrade{LockTimeout: 50 * time.Millisecond}
+	tar.CreateDB(db)
+
+	// a writer that dies holding the lock leaves its record but not the lock behind
+	cmd, _ := lockHelper(t, db, true)
+	if err := cmd.Process.Kill(); err != nil {
+		t.Fatal(err)
+	}
+	cmd.Wait()
+	info, err := tar.LockInfo(db)
+	if err != nil || info.Held || info.PID != cmd.Process.Pid || !info.Stale {
+		t.Fatalf("LockInfo = %+v, %v, want a stale record of pid %d", info, err, cmd.Process.Pid)
+	}
+	if id, err := tar.AddFieldE("a", "1", db); err != nil || id != 1 {
+		t.Fatalf("AddFieldE after the writer died = %d, %v", id, err)
+	}
+}
@@ -4,12 +4,10 @@ package tardigrade
 // Version - 0.3.0
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"os"
 	"strconv"
-	"strings"
 )
 
 // FlexStruct supports variable number of fields
@@ -22,29 +20,25 @@ type FlexStruct struct {
 // AddFlexField adds a record with variable fields
 // Usage: tar.AddFlexField("user:2", map[string]string{"name": "ricardo", "status": "married", "city": "london"}, "mydb.db")
 func (tar *Tardigrade) AddFlexField(key string, fields map[string]string, db string) bool {
-	if !tar.fileExists(db) {
-		tar.CreateDB(db)
-		if !tar.fileExists(db) {
-			return false
-		}
-	}
-
-	id := tar.UniqueID(db) + 1
-	record := FlexStruct{
-		Id:     id,
-		Key:    key,
-		Fields: fields,
+	_, err := tar.AddFlexFieldE(key, fields, db)
+	if err != nil && (!tar.fileExists(db) || errors.Is(err, ErrDuplicateKey)) {
+		return false
 	}
-
-	response, err := tar.MyMarshal(record)
 	CheckError("AddFlexField", err)
+	return true
+}
 
-	file, err := os.OpenFile(db, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	CheckError("AddFlexField", err)
-	defer file.Close()
-	file.Write(response)
+// AddFlexFieldE adds a record with variable fields and returns the id assigned to it
+func (tar *Tardigrade) AddFlexFieldE(key string, fields map[string]string, db string) (int, error) {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return 0, newError("AddFlexField", db, 0, err)
+	}
+	defer unlock()
 
-	return true
+	return tar.insert("AddFlexField", db, key, func(id int) interface{} {
+		return FlexStruct{Id: id, Key: key, Fields: fields}
+	})
 }
 
 // AddFlexFieldVariadic adds a record with variadic string arguments
@@ -64,161 +58,195 @@ func (tar *Tardigrade) AddFlexFieldVariadic(key string, db string, keyValuePairs
 
 // SelectFlexByID retrieves a flexible record by ID
 func (tar *Tardigrade) SelectFlexByID(id int, format string, db string) string {
-	regx := fmt.Sprintf("\"id\":%v,", id)
-	src := db
-
-	if !tar.fileExists(src) {
-		return fmt.Sprintf("Database %s missing!", src)
-	}
-
-	fInfo, _ := os.Stat(src)
-	if fInfo.Size() <= 1 {
-		return fmt.Sprintf("Database %s is empty!", src)
-	}
-
-	file, err := os.Open(src)
-	CheckError("SelectFlexByID", err)
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, regx) {
-			var s FlexStruct
-			err = json.Unmarshal([]byte(line), &s)
-			CheckError("SelectFlexByID", err)
-
-			switch format {
-			case "json":
-				out, _ := tar.MyIndent(&s, "", "  ")
-				return string(out)
-			case "raw":
-				return line
-			case "key":
-				return s.Key
-			case "id":
-				return strconv.Itoa(s.Id)
-			case "fields":
-				out, _ := tar.MyMarshal(s.Fields)
-				return string(out)
-			default:
-				return "Invalid format! Use: raw, json, id, key, fields"
-			}
-		}
+	result, err := tar.SelectFlexByIDE(id, format, db)
+	if errors.Is(err, ErrInvalidFormat) {
+		return "Invalid format! Use: raw, json, id, key, fields"
 	}
-
-	return fmt.Sprintf("Record %v is empty!", id)
+	if err != nil {
+		return legacyMessage("SelectFlexByID", db, id, err)
+	}
+	return result
 }
 
-// SelectFlexSearch searches flexible records
-func (tar *Tardigrade) SelectFlexSearch(search, format string, db string) (string, []byte) {
-	search = strings.ToLower(search)
-	search = strings.ReplaceAll(search, " ", ",")
-	keywords := strings.Split(search, ",")
+// SelectFlexByIDE retrieves a flexible record by ID in one of the formats [ raw | json | id | key | fields ]
+func (tar *Tardigrade) SelectFlexByIDE(id int, format string, db string) (string, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return "", newError("SelectFlexByID", db, id, err)
+	}
+	defer unlock()
+
+	line, err := findLine(pathView(db), id)
+	if err != nil {
+		return "", newError("SelectFlexByID", db, id, err)
+	}
+	var s FlexStruct
+	if err := json.Unmarshal([]byte(line), &s); err != nil {
+		return "", newError("SelectFlexByID", db, id, corrupt(err))
+	}
+
+	switch format {
+	case "json":
+		out, _ := tar.MyIndent(&s, "", "  ")
+		return string(out), nil
+	case "raw":
+		return line, nil
+	case "key":
+		return s.Key, nil
+	case "id":
+		return strconv.Itoa(s.Id), nil
+	case "fields":
+		out, _ := tar.MyMarshal(s.Fields)
+		return string(out), nil
+	}
+	return "", newError("SelectFlexByID", db, id, fmt.Errorf("%w: %q", ErrInvalidFormat, format))
+}
 
-	if !tar.fileExists(db) {
-		return format, []byte(fmt.Sprintf("Database %s missing!", db))
+// selectFlex returns the decoded flexible record id
+func (tar *Tardigrade) selectFlex(op string, id int, db string) (FlexStruct, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return FlexStruct{}, newError(op, db, id, err)
 	}
+	defer unlock()
 
-	fInfo, _ := os.Stat(db)
-	if fInfo.Size() <= 1 {
-		return format, []byte(fmt.Sprintf("Database %s is empty!", db))
+	record, err := decodeFlex(pathView(db), id)
+	if err != nil {
+		return record, newError(op, db, id, err)
 	}
+	return record, nil
+}
 
-	var results []FlexStruct
-	file, err := os.Open(db)
-	CheckError("SelectFlexSearch", err)
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.ToLower(scanner.Text())
-		matchAll := true
-
-		for _, keyword := range keywords {
-			if !strings.Contains(line, keyword) {
-				matchAll = false
-				break
-			}
-		}
+// decodeFlex finds and decodes flexible record id
+func decodeFlex(v view, id int) (FlexStruct, error) {
+	var record FlexStruct
+	line, err := findLine(v, id)
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return record, corrupt(err)
+	}
+	return record, nil
+}
 
-		if matchAll {
-			var record FlexStruct
-			err = json.Unmarshal([]byte(scanner.Text()), &record)
-			CheckError("SelectFlexSearch", err)
-			results = append(results, record)
-		}
+// SelectFlexSearch searches flexible records
+func (tar *Tardigrade) SelectFlexSearch(search, format string, db string) (string, []byte) {
+	results, err := tar.SelectFlexSearchE(search, db)
+	if errors.Is(err, ErrDBMissing) || errors.Is(err, ErrDBEmpty) {
+		return format, []byte(legacyMessage("SelectFlexSearch", db, 0, err))
 	}
+	CheckError("SelectFlexSearch", err)
 
 	output, err := tar.MyMarshal(results)
 	CheckError("SelectFlexSearch", err)
 	return format, output
 }
 
+// SelectFlexSearchE returns every flexible record of db matching ALL comma or space separated words in search
+func (tar *Tardigrade) SelectFlexSearchE(search string, db string) ([]FlexStruct, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, newError("SelectFlexSearch", db, 0, err)
+	}
+	defer unlock()
+
+	a, err := analysisFor(db)
+	if err != nil {
+		return nil, newError("SelectFlexSearch", db, 0, err)
+	}
+	results, err := searchFlex(pathView(db), a, search)
+	if err != nil {
+		return nil, newError("SelectFlexSearch", db, 0, err)
+	}
+	return results, nil
+}
+
+// searchFlex returns every flexible record matching ALL words in search, see analysis.match
+func searchFlex(v view, a *analysis, search string) ([]FlexStruct, error) {
+	keywords := searchWords(search)
+
+	var results []FlexStruct
+	err := v.each(func(line string) error {
+		if !a.match(line, keywords) {
+			return nil
+		}
+		var record FlexStruct
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return corrupt(err)
+		}
+		results = append(results, record)
+		return nil
+	})
+	return results, err
+}
+
 // GetFlexField retrieves a specific field value from a record
 func (tar *Tardigrade) GetFlexField(id int, fieldName string, db string) string {
-	result := tar.SelectFlexByID(id, "raw", db)
-	if strings.Contains(result, "empty") || strings.Contains(result, "missing") {
-		return result
+	value, err := tar.GetFlexFieldE(id, fieldName, db)
+	if errors.Is(err, errFieldNotFound) {
+		return fmt.Sprintf("Field '%s' not found in record %d", fieldName, id)
 	}
+	if err != nil {
+		return legacyMessage("GetFlexField", db, id, err)
+	}
+	return value
+}
 
-	var record FlexStruct
-	err := json.Unmarshal([]byte(result), &record)
-	CheckError("GetFlexField", err)
+// errFieldNotFound marks a record that exists but lacks the requested field
+var errFieldNotFound = fmt.Errorf("%w: field", ErrNotFound)
 
+// GetFlexFieldE retrieves a specific field value from a record, a missing field matches ErrNotFound
+func (tar *Tardigrade) GetFlexFieldE(id int, fieldName string, db string) (string, error) {
+	record, err := tar.selectFlex("GetFlexField", id, db)
+	if err != nil {
+		return "", err
+	}
 	if value, exists := record.Fields[fieldName]; exists {
-		return value
+		return value, nil
 	}
-	return fmt.Sprintf("Field '%s' not found in record %d", fieldName, id)
+	return "", newError("GetFlexField", db, id, fmt.Errorf("%w %q", errFieldNotFound, fieldName))
 }
 
 // ModifyFlexField updates a flexible record
 func (tar *Tardigrade) ModifyFlexField(id int, key string, fields map[string]string, db string) (string, bool) {
-	before := tar.SelectFlexByID(id, "raw", db)
-	if strings.Contains(before, "Record") && strings.Contains(before, "empty") {
-		return before, false
-	}
-
-	record := FlexStruct{
-		Id:     id,
-		Key:    key,
-		Fields: fields,
+	after, err := tar.ModifyFlexFieldE(id, key, fields, db)
+	if err != nil {
+		return legacyMessage("ModifyFlexField", db, id, err), false
 	}
+	return after, true
+}
 
-	after, _ := tar.MyMarshal(&record)
-	afterStr := strings.TrimSpace(string(after))
-
-	input, err := os.ReadFile(db)
-	CheckError("ModifyFlexField", err)
-
-	lines := strings.Split(string(input), "\n")
-	for i, line := range lines {
-		if strings.Contains(line, before) {
-			lines[i] = afterStr
-		}
+// ModifyFlexFieldE replaces the key and fields of a flexible record and returns the new raw line
+func (tar *Tardigrade) ModifyFlexFieldE(id int, key string, fields map[string]string, db string) (string, error) {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return "", newError("ModifyFlexField", db, id, err)
 	}
+	defer unlock()
 
-	output := strings.Join(lines, "\n")
-	err = os.WriteFile(db, []byte(output), 0644)
-	CheckError("ModifyFlexField", err)
-
-	return tar.SelectFlexByID(id, "raw", db), true
+	return tar.replace("ModifyFlexField", db, id, key, &FlexStruct{Id: id, Key: key, Fields: fields})
 }
 
 // ListFlexFields returns all field names from a record
 func (tar *Tardigrade) ListFlexFields(id int, db string) []string {
-	result := tar.SelectFlexByID(id, "raw", db)
-	if strings.Contains(result, "empty") || strings.Contains(result, "missing") {
+	fields, err := tar.ListFlexFieldsE(id, db)
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrDBMissing) {
 		return []string{}
 	}
-
-	var record FlexStruct
-	err := json.Unmarshal([]byte(result), &record)
 	CheckError("ListFlexFields", err)
+	return fields
+}
 
+// ListFlexFieldsE returns all field names from a record
+func (tar *Tardigrade) ListFlexFieldsE(id int, db string) ([]string, error) {
+	record, err := tar.selectFlex("ListFlexFields", id, db)
+	if err != nil {
+		return nil, err
+	}
 	fields := make([]string, 0, len(record.Fields))
 	for key := range record.Fields {
 		fields = append(fields, key)
 	}
-	return fields
+	return fields, nil
 }
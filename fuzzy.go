@@ -0,0 +1,189 @@
+package tardigrade
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// FuzzyAuto lets SearchOptions.Fuzziness follow the length of each query word: no edits up to
+// 2 letters, 1 up to 5 and 2 beyond
+const FuzzyAuto = -1
+
+// autoEdits returns the edits FuzzyAuto allows for term
+func autoEdits(term string) int {
+	switch n := utf8.RuneCountInString(term); {
+	case n <= 2:
+		return 0
+	case n <= 5:
+		return 1
+	}
+	return 2
+}
+
+// edits returns the edits q allows between term and a word of the index
+func (q textQuery) edits(term string) int {
+	if q.fuzziness == FuzzyAuto {
+		return autoEdits(term)
+	}
+	if q.fuzziness < 0 {
+		return 0
+	}
+	return q.fuzziness
+}
+
+// matcher returns a function reporting whether a word of a record matches a query term
+func (q textQuery) matcher() func(word string) bool {
+	exact := make(map[string]bool, len(q.terms))
+	fuzzy := false
+	for _, term := range q.terms {
+		exact[term] = true
+		fuzzy = fuzzy || q.edits(term) > 0
+	}
+	if !fuzzy {
+		return func(word string) bool { return exact[word] }
+	}
+	seen := make(map[string]bool)
+	return func(word string) bool {
+		matched, ok := seen[word]
+		if !ok {
+			for _, term := range q.terms {
+				if max := q.edits(term); editDistance(term, word, max, q.transpositions) <= max {
+					matched = true
+					break
+				}
+			}
+			seen[word] = matched
+		}
+		return matched
+	}
+}
+
+// expand returns the words of the index matching the query terms, weighted 1 for an exact
+// match and 1/(1+edits) otherwise
+func (t *textIndex) expand(q textQuery) map[string]float64 {
+	weights := make(map[string]float64, len(q.terms))
+	for _, term := range q.terms {
+		max := q.edits(term)
+		if max == 0 {
+			weights[term] = 1
+			continue
+		}
+		for word := range t.postings {
+			d := editDistance(term, word, max, q.transpositions)
+			if w := 1 / float64(1+d); d <= max && w > weights[word] {
+				weights[word] = w
+			}
+		}
+	}
+	return weights
+}
+
+// corrections returns, for every query word none of whose terms is in the index, the closest
+// word of the index within FuzzyAuto edits (at least one), the most frequent on equal
+// distances. Words with no such correction or needing none get "", and nil means no word was
+// corrected.
+func (t *textIndex) corrections(words []string) []string {
+	out := make([]string, len(words))
+	corrected := false
+	for i, word := range words {
+		terms := t.a.queryTerms(word)
+		known := len(terms) == 0
+		for _, term := range terms {
+			known = known || len(t.postings[term]) > 0
+		}
+		if known {
+			continue
+		}
+		best, bestEdits, bestDocs := "", 0, 0
+		for _, term := range terms {
+			max := autoEdits(term)
+			if max == 0 {
+				max = 1
+			}
+			for candidate, docs := range t.postings {
+				d := editDistance(term, candidate, max, true)
+				if d > max {
+					continue
+				}
+				if best == "" || d < bestEdits || d == bestEdits && (len(docs) > bestDocs || len(docs) == bestDocs && candidate < best) {
+					best, bestEdits, bestDocs = candidate, d, len(docs)
+				}
+			}
+		}
+		if best != "" {
+			out[i] = best
+			corrected = true
+		}
+	}
+	if !corrected {
+		return nil
+	}
+	return out
+}
+
+// correctQuery returns query with each of its words replaced by its correction, if any
+func correctQuery(query string, words []Token, corrections []string) string {
+	var b strings.Builder
+	pos := 0
+	for i, w := range words {
+		if i >= len(corrections) || corrections[i] == "" {
+			continue
+		}
+		b.WriteString(query[pos:w.Start])
+		b.WriteString(corrections[i])
+		pos = w.End
+	}
+	b.WriteString(query[pos:])
+	return b.String()
+}
+
+// editDistance returns the Levenshtein distance between a and b, counting the transposition
+// of two adjacent letters as one edit when transpositions is set (optimal string alignment),
+// or max+1 as soon as it is known to exceed max
+func editDistance(a, b string, max int, transpositions bool) int {
+	if a == b {
+		return 0
+	}
+	s, t := []rune(a), []rune(b)
+	if len(s)-len(t) > max || len(t)-len(s) > max {
+		return max + 1
+	}
+	prev2 := make([]int, len(t)+1)
+	prev := make([]int, len(t)+1)
+	cur := make([]int, len(t)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(s); i++ {
+		cur[0] = i
+		low := cur[0]
+		for j := 1; j <= len(t); j++ {
+			cost := 1
+			if s[i-1] == t[j-1] {
+				cost = 0
+			}
+			d := prev[j-1] + cost
+			if prev[j]+1 < d {
+				d = prev[j] + 1
+			}
+			if cur[j-1]+1 < d {
+				d = cur[j-1] + 1
+			}
+			if transpositions && i > 1 && j > 1 && s[i-1] == t[j-2] && s[i-2] == t[j-1] && prev2[j-2]+1 < d {
+				d = prev2[j-2] + 1
+			}
+			cur[j] = d
+			if d < low {
+				low = d
+			}
+		}
+		if low > max {
+			return max + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	if prev[len(t)] > max {
+		return max + 1
+	}
+	return prev[len(t)]
+}
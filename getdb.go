@@ -1,11 +1,22 @@
 package tardigrade
 
+import "time"
+
 // Updated - Sun Jan 18 09:38:18 PM GMT 2026
 const Release = "0.3.0"
 const Updated = "Sun Jan 18 09:38:18 PM GMT 2026"
 
 // Tardigrade is the main structure
-type Tardigrade struct{}
+type Tardigrade struct {
+	// LockTimeout bounds how long a call waits for another process to release a database,
+	// zero means DefaultLockTimeout
+	LockTimeout time.Duration
+	// Durability selects when writes are forced to stable storage, zero means SyncOnClose
+	Durability Durability
+	// OnAlertError is called when an alert matching a write cannot be checked or delivered,
+	// nil logs the failure. The write itself has succeeded.
+	OnAlertError func(a Alert, err error)
+}
 
 // GetVersion function returns the current release version
 func (tar *Tardigrade) GetVersion() (release string) {
@@ -0,0 +1,544 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// indexSep separates the values of a composite index entry
+const indexSep = "\x1f"
+
+// Condition compares the flex field Field of a record with Value. Op is one of =, !=, <, <=,
+// >, >= and prefix, values that both parse as numbers are compared numerically. A value that
+// is not a number never satisfies <, <=, > or >= against a number.
+type Condition struct {
+	Field string
+	Op    string
+	Value string
+}
+
+// CreateIndex indexes the flex fields of db so FindFlexWhere does not scan the file. A single
+// field serves conditions on that field, a composite index ("os", "mode") serves queries with
+// conditions on all of its fields. The definition is stored in <db>.meta and the index is kept
+// up to date by every write.
+func (tar *Tardigrade) CreateIndex(db string, fields ...string) error {
+	if err := checkIndex(fields); err != nil {
+		return newError("CreateIndex", db, 0, err)
+	}
+	return newError("CreateIndex", db, 0, tar.changeIndexes(db, func(indexes [][]string) [][]string {
+		for _, def := range indexes {
+			if indexName(def) == indexName(fields) {
+				return indexes
+			}
+		}
+		return append(indexes, append([]string(nil), fields...))
+	}))
+}
+
+// DropIndex removes the index on fields from db
+func (tar *Tardigrade) DropIndex(db string, fields ...string) error {
+	return newError("DropIndex", db, 0, tar.changeIndexes(db, func(indexes [][]string) [][]string {
+		kept := indexes[:0]
+		for _, def := range indexes {
+			if indexName(def) != indexName(fields) {
+				kept = append(kept, def)
+			}
+		}
+		return kept
+	}))
+}
+
+// Indexes returns the fields of every index of db
+func (tar *Tardigrade) Indexes(db string) ([][]string, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, newError("Indexes", db, 0, err)
+	}
+	defer unlock()
+
+	meta, err := loadMeta(db)
+	if err != nil {
+		return nil, newError("Indexes", db, 0, err)
+	}
+	return meta.Indexes, nil
+}
+
+// FindFlexWhere returns the flexible records whose field compares to value with op, in id
+// order. It uses an index on field when there is one and scans the file otherwise.
+// Usage: records, err := tar.FindFlexWhere("cost", ">=", "100", "app.db")
+func (tar *Tardigrade) FindFlexWhere(field, op, value string, db string) ([]FlexStruct, error) {
+	return tar.findFlex("FindFlexWhere", []Condition{{Field: field, Op: op, Value: value}}, db)
+}
+
+// FindFlexWhereAll returns the flexible records matching every condition, in id order
+func (tar *Tardigrade) FindFlexWhereAll(conds []Condition, db string) ([]FlexStruct, error) {
+	return tar.findFlex("FindFlexWhereAll", conds, db)
+}
+
+// findFlex runs findFlex under the shared lock
+func (tar *Tardigrade) findFlex(op string, conds []Condition, db string) ([]FlexStruct, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, newError(op, db, 0, err)
+	}
+	defer unlock()
+
+	records, err := findFlex(pathView(db), conds)
+	return records, newError(op, db, 0, err)
+}
+
+// changeIndexes replaces the index definitions of db with edit(definitions) and brings the
+// stored index up to date
+func (tar *Tardigrade) changeIndexes(db string, edit func(indexes [][]string) [][]string) error {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if _, err := statDB(db); err != nil {
+		return err
+	}
+	meta, err := loadMeta(db)
+	if err != nil {
+		return err
+	}
+	before := indexNames(meta.Indexes)
+	meta.Indexes = edit(meta.Indexes)
+	if sameNames(before, indexNames(meta.Indexes)) {
+		return nil
+	}
+	if err := saveMeta(db, meta); err != nil {
+		return err
+	}
+	file, err := os.Open(db)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	kd := stateFor(db).idIndex()
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	if err := kd.catchUp(file); err != nil {
+		return err
+	}
+	return kd.saveHint(SyncOnWrite)
+}
+
+// checkIndex rejects an index without fields or with a field name it cannot store
+func checkIndex(fields []string) error {
+	if len(fields) == 0 {
+		return errors.New("index needs at least one field")
+	}
+	for _, field := range fields {
+		if field == "" || strings.ContainsAny(field, ","+indexSep) || strings.Contains(field, "[*]") {
+			return fmt.Errorf("invalid index field %q", field)
+		}
+	}
+	return nil
+}
+
+// indexName returns the name an index on fields is stored under
+func indexName(fields []string) string {
+	return strings.Join(fields, ",")
+}
+
+// indexNames returns the names of indexes
+func indexNames(indexes [][]string) []string {
+	names := make([]string, len(indexes))
+	for i, def := range indexes {
+		names[i] = indexName(def)
+	}
+	return names
+}
+
+// sameNames reports whether a and b hold the same names in the same order
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// findFlex returns the flexible records of v matching every condition, through a field index
+// when v has one covering them
+func findFlex(v view, conds []Condition) ([]FlexStruct, error) {
+	if err := checkConditions(conds); err != nil {
+		return nil, err
+	}
+	var results []FlexStruct
+	add := func(line string) error {
+		if len(strings.TrimSpace(line)) == 0 {
+			return nil
+		}
+		var record FlexStruct
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return corrupt(err)
+		}
+		if matchFlex(record.Fields, conds) {
+			results = append(results, record)
+		}
+		return nil
+	}
+	if v.where != nil {
+		lines, index, err := v.where(conds)
+		if err != nil {
+			return nil, err
+		}
+		if index != "" {
+			for _, line := range lines {
+				if err := add(line); err != nil {
+					return nil, err
+				}
+			}
+			return results, nil
+		}
+	}
+	return results, v.each(add)
+}
+
+// checkConditions rejects conditions without a field or with an unknown operator
+func checkConditions(conds []Condition) error {
+	for _, c := range conds {
+		if c.Field == "" {
+			return fmt.Errorf("%w: condition without a field", ErrInvalidQuery)
+		}
+		switch c.Op {
+		case "=", "!=", "<", "<=", ">", ">=", "prefix":
+		default:
+			return fmt.Errorf("%w: unknown operator %q", ErrInvalidQuery, c.Op)
+		}
+	}
+	return nil
+}
+
+// matchFlex reports whether fields satisfy every condition, a missing field satisfies none. A
+// path with wildcards such as "tags[*]" satisfies a condition when one of its values does.
+func matchFlex(fields map[string]string, conds []Condition) bool {
+	for _, c := range conds {
+		matched := false
+		for _, value := range fieldValues(fields, c.Field) {
+			if matchValue(value, c.Op, c.Value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchValue reports whether value compares to want with op. Text is not ordered against a
+// number, so "n/a" is neither above nor below 100.
+func matchValue(value, op, want string) bool {
+	switch op {
+	case "<", "<=", ">", ">=":
+		if isNumber(want) && !isNumber(value) {
+			return false
+		}
+	}
+	switch op {
+	case "prefix":
+		return strings.HasPrefix(value, want)
+	case "=":
+		return compareValues(value, want) == 0
+	case "!=":
+		return compareValues(value, want) != 0
+	case "<":
+		return compareValues(value, want) < 0
+	case "<=":
+		return compareValues(value, want) <= 0
+	case ">":
+		return compareValues(value, want) > 0
+	case ">=":
+		return compareValues(value, want) >= 0
+	}
+	return false
+}
+
+// compareValues orders two values numerically when both parse as numbers, lexically otherwise
+func compareValues(a, b string) int {
+	x, errA := strconv.ParseFloat(strings.TrimSpace(a), 64)
+	y, errB := strconv.ParseFloat(strings.TrimSpace(b), 64)
+	if errA != nil || errB != nil {
+		return strings.Compare(a, b)
+	}
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// isNumber reports whether value parses as a number
+func isNumber(value string) bool {
+	_, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return err == nil
+}
+
+// loadIndexes reads the field indexes and the full-text setting of the database again when its settings file changed,
+// a different set of indexes means indexing the file again. The caller holds kd.mu.
+func (kd *keydir) loadIndexes() error {
+	info, err := os.Stat(metaPath(kd.path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if info == nil && kd.meta == nil {
+		return nil
+	}
+	if info != nil && kd.meta != nil && os.SameFile(info, kd.meta) && info.ModTime().Equal(kd.meta.ModTime()) {
+		return nil
+	}
+	meta, err := loadMeta(kd.path)
+	if err != nil {
+		return err
+	}
+	kd.meta = info
+	kd.fullText = meta.FullText
+	if !kd.fullText {
+		kd.text = nil
+	}
+	if sameNames(indexNames(meta.Indexes), kd.indexNames()) {
+		return nil
+	}
+	kd.indexes = meta.Indexes
+	kd.info = nil // index the file again, from a hint carrying the same indexes if there is one
+	return nil
+}
+
+// indexNames returns the names of the field indexes of the directory
+func (kd *keydir) indexNames() []string {
+	if len(kd.indexes) == 0 {
+		return nil
+	}
+	return indexNames(kd.indexes)
+}
+
+// indexedFields returns the values of the indexed flex fields of the version body
+func (kd *keydir) indexedFields(body []byte) map[string]string {
+	if len(kd.indexes) == 0 {
+		return nil
+	}
+	var record struct {
+		Fields map[string]json.RawMessage `json:"fields"`
+	}
+	if json.Unmarshal(body, &record) != nil || len(record.Fields) == 0 {
+		return nil
+	}
+	var values map[string]string
+	for _, def := range kd.indexes {
+		for _, field := range def {
+			value, ok := rawFieldValue(record.Fields, field)
+			if !ok {
+				continue
+			}
+			if values == nil {
+				values = make(map[string]string)
+			}
+			values[field] = value
+		}
+	}
+	return values
+}
+
+// fieldText returns a flex field value as text, strings unquoted and anything else as written
+func fieldText(raw json.RawMessage) string {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return s
+	}
+	return strings.TrimSpace(string(raw))
+}
+
+// indexValue returns the entry of a record with values in the index on fields, false when
+// the record lacks one of them
+func indexValue(fields []string, values map[string]string) (string, bool) {
+	parts := make([]string, len(fields))
+	for i, field := range fields {
+		value, ok := values[field]
+		if !ok {
+			return "", false
+		}
+		parts[i] = value
+	}
+	return strings.Join(parts, indexSep), true
+}
+
+// linkFields adds record id to the field indexes, the caller holds kd.mu
+func (kd *keydir) linkFields(id int, e keydirEntry) {
+	for _, def := range kd.indexes {
+		value, ok := indexValue(def, e.Fields)
+		if !ok {
+			continue
+		}
+		name := indexName(def)
+		if kd.postings[name] == nil {
+			kd.postings[name] = make(map[string][]int)
+		}
+		if linkID(kd.postings[name], value, id) {
+			delete(kd.terms, name)
+		}
+	}
+}
+
+// unlinkFields removes record id from the field indexes, the caller holds kd.mu
+func (kd *keydir) unlinkFields(id int, e keydirEntry) {
+	for _, def := range kd.indexes {
+		if value, ok := indexValue(def, e.Fields); ok {
+			if unlinkID(kd.postings[indexName(def)], value, id) {
+				delete(kd.terms, indexName(def))
+			}
+		}
+	}
+}
+
+// where reads the versions the best field index selects for conds, see view.where
+func (kd *keydir) where(file io.ReaderAt, conds []Condition) ([]string, string, error) {
+	kd.mu.Lock()
+	ids, index := kd.candidates(conds)
+	entries := make([]keydirEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = kd.entries[id]
+	}
+	live := len(kd.entries)
+	kd.mu.Unlock()
+
+	if index == "" {
+		return nil, "", nil
+	}
+	if live == 0 {
+		return nil, index, ErrDBEmpty
+	}
+	lines := make([]string, len(entries))
+	for i, e := range entries {
+		line, err := readVersion(file, e)
+		if err != nil {
+			return nil, index, err
+		}
+		lines[i] = string(line)
+	}
+	return lines, index, nil
+}
+
+// candidates returns the ids the field index with the most fields, all of them constrained
+// by conds, selects and the name of that index. The caller holds kd.mu.
+func (kd *keydir) candidates(conds []Condition) ([]int, string) {
+	byField := make(map[string][]Condition)
+	for _, c := range conds {
+		byField[c.Field] = append(byField[c.Field], c)
+	}
+	var best []string
+	for _, def := range kd.indexes {
+		covered := len(def) > len(best)
+		for _, field := range def {
+			covered = covered && len(byField[field]) > 0
+		}
+		if covered {
+			best = def
+		}
+	}
+	if best == nil {
+		return nil, ""
+	}
+	postings := kd.postings[indexName(best)]
+
+	// equality on text values is a single lookup, anything else walks the distinct values
+	exact := make([]string, len(best))
+	for i, field := range best {
+		for _, c := range byField[field] {
+			if c.Op == "=" && !isNumber(c.Value) {
+				exact[i] = c.Value
+				break
+			}
+		}
+	}
+	if value, ok := indexValue(best, textValues(best, exact)); ok {
+		return append([]int(nil), postings[value]...), indexName(best)
+	}
+	var ids []int
+	for value, matched := range postings {
+		parts := strings.Split(value, indexSep)
+		ok := len(parts) == len(best)
+		for i := 0; ok && i < len(best); i++ {
+			ok = matchFlex(map[string]string{best[i]: parts[i]}, byField[best[i]])
+		}
+		if ok {
+			ids = append(ids, matched...)
+		}
+	}
+	sort.Ints(ids)
+	return ids, indexName(best)
+}
+
+// textValues maps fields to the non-empty exact values, see candidates
+func textValues(fields, exact []string) map[string]string {
+	values := make(map[string]string)
+	for i, field := range fields {
+		if exact[i] != "" {
+			values[field] = exact[i]
+		}
+	}
+	return values
+}
+
+// CreateIndex indexes the flex fields of the database, see Tardigrade.CreateIndex
+func (d *DB) CreateIndex(fields ...string) error {
+	if err := d.writable("CreateIndex"); err != nil {
+		return err
+	}
+	return d.tar.CreateIndex(d.path, fields...)
+}
+
+// DropIndex removes the index on fields from the database
+func (d *DB) DropIndex(fields ...string) error {
+	if err := d.writable("DropIndex"); err != nil {
+		return err
+	}
+	return d.tar.DropIndex(d.path, fields...)
+}
+
+// FindFlexWhere returns the flexible records whose field compares to value with op, see
+// Tardigrade.FindFlexWhere
+func (d *DB) FindFlexWhere(field, op, value string) ([]FlexStruct, error) {
+	return d.findFlex("FindFlexWhere", []Condition{{Field: field, Op: op, Value: value}})
+}
+
+// FindFlexWhereAll returns the flexible records matching every condition, in id order
+func (d *DB) FindFlexWhereAll(conds []Condition) ([]FlexStruct, error) {
+	return d.findFlex("FindFlexWhereAll", conds)
+}
+
+// findFlex runs findFlex against the database
+func (d *DB) findFlex(op string, conds []Condition) ([]FlexStruct, error) {
+	var records []FlexStruct
+	err := d.read(op, func(v view) (err error) {
+		records, err = findFlex(v, conds)
+		return newError(op, d.path, 0, err)
+	})
+	return records, err
+}
+
+// FindFlexWhere returns the flexible records whose field compares to value with op as seen by
+// the transaction, scanning its working copy
+func (tx *Tx) FindFlexWhere(field, op, value string) ([]FlexStruct, error) {
+	if err := tx.check("FindFlexWhere"); err != nil {
+		return nil, err
+	}
+	records, err := findFlex(tx.view(), []Condition{{Field: field, Op: op, Value: value}})
+	return records, newError("FindFlexWhere", tx.db.path, 0, err)
+}
@@ -0,0 +1,38 @@
+package tardigrade
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRangeSkipsText(t *testing.T) {
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "range.db")
+	tar.CreateDB(db)
+	for _, cost := range []string{"50", "n/a", "150", "abc"} {
+		if _, err := tar.AddFlexFieldE("item", map[string]string{"cost": cost}, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(when string) {
+		t.Helper()
+		for op, want := range map[string]string{">": "150", ">=": "150", "<": "50", "<=": "50"} {
+			records, err := tar.FindFlexWhere("cost", op, "100", db)
+			if err != nil || len(records) != 1 || records[0].Fields["cost"] != want {
+				t.Fatalf("%s: FindFlexWhere cost %s 100 = %+v, %v, want only %s", when, op, records, err, want)
+			}
+		}
+		rows, err := tar.Query(NewQuery().Where("cost", ">", "100"), db)
+		if err != nil || len(rows) != 1 || rows[0]["cost"] != "150" {
+			t.Fatalf("%s: Query cost > 100 = %+v, %v", when, rows, err)
+		}
+		if records, err := tar.FindFlexWhere("cost", ">", "m", db); err != nil || len(records) != 1 || records[0].Fields["cost"] != "n/a" {
+			t.Fatalf("%s: FindFlexWhere cost > m = %+v, %v, want text compared as text", when, records, err)
+		}
+	}
+	check("scan")
+	if err := tar.CreateIndex(db, "cost"); err != nil {
+		t.Fatal(err)
+	}
+	check("index")
+}
@@ -0,0 +1,805 @@
+package tardigrade
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// StorageMode selects how modifications and removals are written to a database
+type StorageMode int
+
+const (
+	// StorageRewrite rewrites the whole file on every modification and removal, the file only
+	// ever holds the live records
+	StorageRewrite StorageMode = iota
+	// StorageAppend appends new versions and tombstones instead and finds records through an
+	// in-memory key directory saved to <db>.hint
+	StorageAppend
+)
+
+// hintEvery is the minimum number of versions written before the hint file is saved again
+const hintEvery = 1000
+
+// hintVersion is the layout of the sidecar files written by saveHint, older ones are rebuilt
+const hintVersion = 1
+
+// keydirEntry locates the latest version of a record in the database file
+type keydirEntry struct {
+	Offset int64             `json:"offset"`
+	Length int               `json:"length"` // without the line break
+	Key    string            `json:"key"`
+	Fields map[string]string `json:"fields,omitempty"` // values of the indexed flex fields
+}
+
+// keydir maps every live id of a database to the offset of its latest version. It is loaded
+// from a sidecar file, the hint file of append storage or the id index of rewrite storage,
+// then kept up to date by indexing whatever was written after the bytes it already covers.
+type keydir struct {
+	path       string
+	hint       string // sidecar file the directory is saved to
+	appendOnly bool   // append storage, each walks the live records instead of the file
+
+	mu      sync.Mutex // guards the fields below
+	info    os.FileInfo
+	size    int64 // bytes of the database indexed so far
+	entries map[int]keydirEntry
+	keys    map[string][]int // ids of the live records stored under each key, ascending
+	indexes [][]string       // flex field indexes defined in <db>.meta
+	meta    os.FileInfo      // settings file the indexes were read from
+	// fullText keeps text, the inverted index built on the first SearchText
+	fullText bool
+	text     *textIndex
+	// postings maps every field index to the ids of the live records holding each value
+	postings map[string]map[string][]int
+	// terms holds the sorted values of the key index ("key") and of single field indexes, built
+	// by Suggest and dropped when one of their values appears or disappears
+	terms   map[string][]string
+	lastID  int // highest id ever written, removed ids are never handed out again
+	tailID  int // id of the last record in the file, the last id of rewrite storage
+	dead    int // superseded versions, tombstones and unreadable lines
+	unsaved int // versions indexed since the hint file was saved
+}
+
+// hintHeader is the first line of a hint file, every other line is a hintEntry
+type hintHeader struct {
+	Version int   `json:"version"`
+	Size    int64 `json:"size"`
+	LastID  int   `json:"lastID"`
+	TailID  int   `json:"tailID"`
+	Dead    int   `json:"dead"`
+	// Indexes names the field indexes the entries carry values for
+	Indexes []string `json:"indexes,omitempty"`
+}
+
+// hintEntry is the location of one live record in a hint file
+type hintEntry struct {
+	Id int `json:"id"`
+	keydirEntry
+}
+
+// hintPath returns the hint file kept next to db, a cache of its key directory
+func hintPath(db string) string {
+	return db + ".hint"
+}
+
+// idxPath returns the id index kept next to a rewrite storage database
+func idxPath(db string) string {
+	return db + ".idx"
+}
+
+// tombstone returns the version marking record id as removed
+func tombstone(id int) []byte {
+	return []byte(fmt.Sprintf("{\"id\":%d,\"deleted\":true}\n", id))
+}
+
+// batchPrefix starts the marker written before the versions of a single append holding
+// several, older readers take it for the tombstone of the unused id 0
+var batchPrefix = []byte(`{"id":0,"deleted":true,"batch":`)
+
+// batchMarker returns the marker announcing the n versions that follow it
+func batchMarker(n int) []byte {
+	return []byte(fmt.Sprintf("%s%d}\n", batchPrefix, n))
+}
+
+// batchSize returns the number of versions announced by a batch marker, 0 for other lines
+func batchSize(line []byte) int {
+	if !bytes.HasPrefix(line, batchPrefix) {
+		return 0
+	}
+	n, err := strconv.Atoi(string(bytes.TrimRight(line[len(batchPrefix):], "}\r\n")))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// keydir returns the key directory of the database, nil unless its settings name append
+// storage
+func (s *dbState) keydir() *keydir {
+	meta, err := s.meta()
+	s.kdMu.Lock()
+	defer s.kdMu.Unlock()
+	if err != nil || meta.Storage != StorageAppend {
+		s.kd = nil
+	} else if s.kd == nil {
+		s.kd = &keydir{path: s.path, hint: hintPath(s.path), appendOnly: true}
+	}
+	return s.kd
+}
+
+// idIndex returns the directory locating records by id: the key directory in append storage
+// and the id index, saved to <db>.idx, otherwise
+func (s *dbState) idIndex() *keydir {
+	if kd := s.keydir(); kd != nil {
+		return kd
+	}
+	s.kdMu.Lock()
+	defer s.kdMu.Unlock()
+	if s.idx == nil {
+		s.idx = &keydir{path: s.path, hint: idxPath(s.path)}
+	}
+	return s.idx
+}
+
+// ConvertStorage switches db to another storage mode, which is recorded in <db>.meta.
+// Converting to StorageAppend keeps the file as it is and writes its hint file, converting
+// back to StorageRewrite rewrites the file with the live records only and removes the hint
+// file.
+func (tar *Tardigrade) ConvertStorage(db string, mode StorageMode) error {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return newError("ConvertStorage", db, 0, err)
+	}
+	defer unlock()
+	return newError("ConvertStorage", db, 0, tar.convertStorage(db, mode))
+}
+
+// convertStorage switches db to mode, the caller holds its write lock
+func (tar *Tardigrade) convertStorage(db string, mode StorageMode) error {
+	s := stateFor(db)
+	kd := s.keydir()
+	if (kd != nil) == (mode == StorageAppend) {
+		return nil
+	}
+	if _, err := statDB(db); err != nil {
+		return err
+	}
+	file, err := os.Open(db)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	meta, err := loadMeta(db)
+	if err != nil {
+		return err
+	}
+	meta.Storage = mode
+	if mode == StorageAppend {
+		// the file is valid append storage as it is, the hint is only a cache of it
+		if err := saveMeta(db, meta); err != nil {
+			return err
+		}
+		kd = s.keydir()
+		kd.mu.Lock()
+		defer kd.mu.Unlock()
+		if err := kd.catchUp(file); err != nil {
+			return err
+		}
+		if err := kd.saveHint(SyncOnWrite); err != nil {
+			return err
+		}
+		return removeIndex(db)
+	}
+	var lines []string
+	err = kd.view(file).each(func(line string) error {
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil && !errors.Is(err, ErrDBEmpty) {
+		return err
+	}
+	// the live records are valid in both modes, so the settings only change once they are written
+	if err := replaceDB(db, nil, joinLines(lines), tar.Durability); err != nil {
+		return err
+	}
+	if err := saveMeta(db, meta); err != nil {
+		return err
+	}
+	return os.Remove(hintPath(s.path))
+}
+
+// view returns a view of file answering get and last from the directory, every call first
+// indexes what was written since the previous one. In append storage each walks the live
+// records, otherwise every line of the file.
+func (kd *keydir) view(file *os.File) view {
+	return view{
+		each: func(fn func(line string) error) error {
+			if !kd.appendOnly {
+				info, err := file.Stat()
+				if err != nil {
+					return err
+				}
+				return scanFile(file, info.Size(), fn)
+			}
+			if err := kd.update(file); err != nil {
+				return err
+			}
+			return kd.each(file, fn)
+		},
+		get: func(id int) (string, error) {
+			if err := kd.update(file); err != nil {
+				return "", err
+			}
+			line, err := kd.get(file, id)
+			if errors.Is(err, ErrCorruptRecord) {
+				// the file may have been rewritten in place without the directory noticing
+				if err := kd.rescan(file); err != nil {
+					return "", err
+				}
+				line, err = kd.get(file, id)
+			}
+			return line, err
+		},
+		keys: func(key string) ([]int, error) {
+			if err := kd.update(file); err != nil {
+				return nil, err
+			}
+			return kd.lookupKey(key), nil
+		},
+		last: func() (int, error) {
+			if err := kd.update(file); err != nil {
+				return 0, err
+			}
+			kd.mu.Lock()
+			defer kd.mu.Unlock()
+			if kd.appendOnly {
+				return kd.lastID, nil
+			}
+			return kd.tailID, nil
+		},
+		where: func(conds []Condition) ([]string, string, error) {
+			if err := kd.update(file); err != nil {
+				return nil, "", err
+			}
+			return kd.where(file, conds)
+		},
+		text: func(a *analysis, q textQuery) (textPage, bool, error) {
+			if err := kd.update(file); err != nil {
+				return textPage{}, false, err
+			}
+			return kd.rank(file, a, q)
+		},
+		suggest: func(field, prefix string) ([]Suggestion, bool, error) {
+			if err := kd.update(file); err != nil {
+				return nil, false, err
+			}
+			kd.mu.Lock()
+			defer kd.mu.Unlock()
+			s, ok := kd.suggest(field, prefix)
+			return s, ok, nil
+		},
+	}
+}
+
+// update brings the directory up to date with file
+func (kd *keydir) update(file *os.File) error {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	return kd.catchUp(file)
+}
+
+// stats returns the number of live records and the highest id ever written
+func (kd *keydir) stats() (count, lastID int) {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	return len(kd.entries), kd.lastID
+}
+
+// liveSize returns the size the database would have with its live records only
+func (kd *keydir) liveSize() int64 {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	var size int64
+	for _, e := range kd.entries {
+		size += int64(e.Length) + 1
+	}
+	return size
+}
+
+// catchUp indexes the part of file written since the last call. A file that was replaced,
+// shrank or was modified without still holding what was indexed is indexed again from its hint
+// file or from scratch, a key directory rebuilt from scratch is saved right away. The caller
+// holds kd.mu.
+func (kd *keydir) catchUp(file *os.File) error {
+	if err := kd.loadIndexes(); err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	stale := kd.info == nil || !os.SameFile(kd.info, info) || info.Size() < kd.size
+	if !stale && !info.ModTime().Equal(kd.info.ModTime()) {
+		// appends leave the indexed part alone, a rewrite in place keeps the inode only
+		stale = !kd.matches(file, kd.size)
+	}
+	rebuilt := false
+	if stale {
+		if !kd.loadHint(file, info.Size()) {
+			kd.reset()
+			rebuilt = kd.appendOnly
+		}
+	}
+	kd.info = info
+	if err := kd.scan(file, info.Size()); err != nil {
+		return err
+	}
+	if rebuilt || kd.unsaved >= hintEvery && kd.unsaved*10 >= len(kd.entries) {
+		// the sidecar is only a cache, a read-only directory just means rebuilding next time
+		kd.saveHint(SyncNone)
+	}
+	return nil
+}
+
+// rescan indexes file again from scratch and replaces its sidecar file
+func (kd *keydir) rescan(file *os.File) error {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	kd.reset()
+	kd.info = info
+	if err := kd.scan(file, info.Size()); err != nil {
+		return err
+	}
+	kd.saveHint(SyncNone)
+	return nil
+}
+
+// reset empties the directory
+func (kd *keydir) reset() {
+	kd.entries = make(map[int]keydirEntry)
+	kd.keys = make(map[string][]int)
+	kd.postings = make(map[string]map[string][]int)
+	kd.terms = nil
+	kd.text = nil
+	kd.size, kd.lastID, kd.tailID, kd.dead, kd.unsaved = 0, 0, 0, 0, 0
+}
+
+// scan indexes the versions stored between kd.size and size. A last line without its line
+// break is a torn write, it is left out until a writer cuts it off, and so is a batch whose
+// versions did not all make it to disk.
+func (kd *keydir) scan(file io.ReaderAt, size int64) error {
+	if size <= kd.size {
+		return nil
+	}
+	r := bufio.NewReaderSize(io.NewSectionReader(file, kd.size, size-kd.size), 64*1024)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		group := [][]byte{line}
+		for n := batchSize(line); len(group) <= n; {
+			line, err := r.ReadBytes('\n')
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			group = append(group, line)
+		}
+		for _, line := range group {
+			kd.index(kd.size, line)
+			kd.size += int64(len(line))
+		}
+	}
+}
+
+// index records the version stored at offset
+func (kd *keydir) index(offset int64, line []byte) {
+	body := bytes.TrimRight(line, "\r\n")
+	if len(bytes.TrimSpace(body)) == 0 {
+		return
+	}
+	kd.unsaved++
+	var head recordHead
+	if err := json.Unmarshal(body, &head); err != nil {
+		kd.dead++
+		return
+	}
+	if head.Id > kd.lastID {
+		kd.lastID = head.Id
+	}
+	if old, exists := kd.entries[head.Id]; exists {
+		kd.dead++
+		kd.unlink(head.Id, old)
+	}
+	if head.Deleted {
+		delete(kd.entries, head.Id)
+		kd.dead++
+		return
+	}
+	e := keydirEntry{Offset: offset, Length: len(body), Key: head.Key, Fields: kd.indexedFields(body)}
+	kd.entries[head.Id] = e
+	kd.link(head.Id, e)
+	if kd.text != nil {
+		kd.text.add(head.Id, body)
+	}
+	kd.tailID = head.Id
+}
+
+// link adds record id to the key index and the field indexes
+func (kd *keydir) link(id int, e keydirEntry) {
+	if linkID(kd.keys, e.Key, id) {
+		delete(kd.terms, "key")
+	}
+	kd.linkFields(id, e)
+}
+
+// unlink removes the version e of record id from the key index and the field indexes
+func (kd *keydir) unlink(id int, e keydirEntry) {
+	if unlinkID(kd.keys, e.Key, id) {
+		delete(kd.terms, "key")
+	}
+	kd.unlinkFields(id, e)
+	if kd.text != nil {
+		kd.text.remove(id)
+	}
+}
+
+// linkID adds id to the ascending ids stored under key in m and reports whether key is new
+func linkID(m map[string][]int, key string, id int) bool {
+	ids := m[key]
+	i := sort.SearchInts(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return false
+	}
+	ids = append(ids, 0)
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	m[key] = ids
+	return len(ids) == 1
+}
+
+// unlinkID removes id from the ids stored under key in m and reports whether key is gone
+func unlinkID(m map[string][]int, key string, id int) bool {
+	ids := m[key]
+	i := sort.SearchInts(ids, id)
+	if i == len(ids) || ids[i] != id {
+		return false
+	}
+	if len(ids) == 1 {
+		delete(m, key)
+		return true
+	}
+	m[key] = append(ids[:i], ids[i+1:]...)
+	return false
+}
+
+// rebuildKeys recomputes the key index and the field indexes from the entries
+func (kd *keydir) rebuildKeys() {
+	kd.keys = make(map[string][]int)
+	kd.postings = make(map[string]map[string][]int)
+	kd.terms = nil
+	ids := make([]int, 0, len(kd.entries))
+	for id := range kd.entries {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		kd.link(id, kd.entries[id])
+	}
+}
+
+// lookupKey returns the ids of the live records stored under key, ascending
+func (kd *keydir) lookupKey(key string) []int {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	return append([]int(nil), kd.keys[key]...)
+}
+
+// get reads the latest version of record id
+func (kd *keydir) get(file io.ReaderAt, id int) (string, error) {
+	kd.mu.Lock()
+	e, ok := kd.entries[id]
+	live := len(kd.entries)
+	kd.mu.Unlock()
+	if !ok {
+		if live == 0 {
+			return "", ErrDBEmpty
+		}
+		return "", ErrNotFound
+	}
+	line, err := readVersion(file, e)
+	if err != nil {
+		return "", err
+	}
+	var head recordHead
+	if err := json.Unmarshal(line, &head); err != nil {
+		return "", corrupt(err)
+	}
+	if head.Id != id {
+		return "", corrupt(fmt.Errorf("record %d expected at offset %d, found %d", id, e.Offset, head.Id))
+	}
+	return string(line), nil
+}
+
+// each calls fn with the latest version of every live record in id order, which is the
+// order the same records have in a rewritten database
+func (kd *keydir) each(file io.ReaderAt, fn func(line string) error) error {
+	kd.mu.Lock()
+	ids := make([]int, 0, len(kd.entries))
+	for id := range kd.entries {
+		ids = append(ids, id)
+	}
+	entries := make([]keydirEntry, 0, len(ids))
+	sort.Ints(ids)
+	for _, id := range ids {
+		entries = append(entries, kd.entries[id])
+	}
+	kd.mu.Unlock()
+
+	if len(entries) == 0 {
+		return ErrDBEmpty
+	}
+	for _, e := range entries {
+		line, err := readVersion(file, e)
+		if err != nil {
+			return err
+		}
+		if err := fn(string(line)); err != nil {
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// readVersion reads the line located by e
+func readVersion(file io.ReaderAt, e keydirEntry) ([]byte, error) {
+	line := make([]byte, e.Length)
+	if _, err := file.ReadAt(line, e.Offset); err != nil {
+		return nil, err
+	}
+	return line, nil
+}
+
+// append writes versions at the end of file, cutting off a torn line left by a crash first,
+// and indexes them. Several versions are preceded by a batch marker so they become visible
+// all together or not at all. It returns the new size of the file, the caller holds the
+// write lock.
+func (kd *keydir) append(file *os.File, versions []byte) (int64, error) {
+	if n := bytes.Count(versions, []byte{'\n'}); n > 1 {
+		versions = append(batchMarker(n), versions...)
+	}
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	if err := kd.catchUp(file); err != nil {
+		return 0, err
+	}
+	if kd.info.Size() > kd.size {
+		if err := file.Truncate(kd.size); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := file.WriteAt(versions, kd.size); err != nil {
+		return 0, err
+	}
+	if err := kd.catchUp(file); err != nil {
+		return 0, err
+	}
+	return kd.size, nil
+}
+
+// loadHint fills the directory from its sidecar file when it matches file and reports whether
+// it did. The caller holds kd.mu.
+func (kd *keydir) loadHint(file io.ReaderAt, size int64) bool {
+	kd.reset()
+	hint, err := os.Open(kd.hint)
+	if err != nil {
+		return false
+	}
+	defer hint.Close()
+
+	var header *hintHeader
+	err = scanLines(hint, func(line string) error {
+		if header == nil {
+			header = new(hintHeader)
+			return json.Unmarshal([]byte(line), header)
+		}
+		var e hintEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			return err
+		}
+		kd.entries[e.Id] = e.keydirEntry
+		return nil
+	})
+	if err != nil || header == nil || header.Version != hintVersion || !sameNames(header.Indexes, kd.indexNames()) || header.Size > size || !kd.matches(file, header.Size) {
+		kd.reset()
+		return false
+	}
+	kd.rebuildKeys()
+	kd.size, kd.lastID, kd.tailID, kd.dead = header.Size, header.LastID, header.TailID, header.Dead
+	return true
+}
+
+// matches checks that the loaded hint describes file: the covered part ends with a line
+// break and the last version it points to holds the expected id
+func (kd *keydir) matches(file io.ReaderAt, size int64) bool {
+	if size == 0 {
+		return len(kd.entries) == 0
+	}
+	end := make([]byte, 1)
+	if _, err := file.ReadAt(end, size-1); err != nil || end[0] != '\n' {
+		return false
+	}
+	lastID, last := 0, keydirEntry{Offset: -1}
+	for id, e := range kd.entries {
+		if e.Offset+int64(e.Length) >= size {
+			return false
+		}
+		if e.Offset > last.Offset {
+			lastID, last = id, e
+		}
+	}
+	if last.Offset < 0 {
+		return true
+	}
+	line, err := readVersion(file, last)
+	if err != nil {
+		return false
+	}
+	var head recordHead
+	return json.Unmarshal(line, &head) == nil && head.Id == lastID
+}
+
+// saveHint writes the directory to its sidecar file so the next process only has to index
+// what was written after it. The caller holds kd.mu.
+func (kd *keydir) saveHint(durability Durability) error {
+	var buf bytes.Buffer
+	header, err := json.Marshal(hintHeader{Version: hintVersion, Size: kd.size, LastID: kd.lastID, TailID: kd.tailID, Dead: kd.dead, Indexes: kd.indexNames()})
+	if err != nil {
+		return err
+	}
+	buf.Write(header)
+	buf.WriteByte('\n')
+	ids := make([]int, 0, len(kd.entries))
+	for id := range kd.entries {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		line, err := json.Marshal(hintEntry{Id: id, keydirEntry: kd.entries[id]})
+		if err != nil {
+			return err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	if err := replaceFile(kd.hint, buf.Bytes(), durability); err != nil {
+		return err
+	}
+	kd.unsaved = 0
+	return nil
+}
+
+// moved follows an atomic rewrite of the database, from old stored in the file described by
+// before to content, without indexing every line again: a line found unchanged keeps its
+// entry and postings and only gets its new offset, the other lines are indexed as new
+// versions. It reports whether the directory, saved again, now describes content.
+func (kd *keydir) moved(before os.FileInfo, old, content []byte) bool {
+	kd.mu.Lock()
+	defer kd.mu.Unlock()
+	if err := kd.loadIndexes(); err != nil || kd.appendOnly || kd.info == nil || !os.SameFile(kd.info, before) || kd.size > int64(len(old)) {
+		return false
+	}
+	// lines appended since the last lookup, a rewrite storage insert only appends
+	if err := kd.scan(bytes.NewReader(old), int64(len(old))); err != nil || kd.size != int64(len(old)) {
+		return false
+	}
+	info, err := os.Stat(kd.path)
+	if err != nil {
+		return false
+	}
+
+	byOffset := make(map[int64]int, len(kd.entries))
+	for id, e := range kd.entries {
+		byOffset[e.Offset] = id
+	}
+	known := make(map[string]int, len(kd.entries))
+	var offset int64
+	for _, line := range bytes.SplitAfter(old, []byte{'\n'}) {
+		if id, ok := byOffset[offset]; ok {
+			known[string(bytes.TrimRight(line, "\r\n"))] = id
+		}
+		offset += int64(len(line))
+	}
+
+	gone := kd.entries
+	kd.entries = make(map[int]keydirEntry, len(gone))
+	var fresh [][]byte
+	var at []int64
+	offset = 0
+	for _, line := range bytes.SplitAfter(content, []byte{'\n'}) {
+		if id, ok := known[string(bytes.TrimRight(line, "\r\n"))]; ok {
+			if e, ok := gone[id]; ok {
+				e.Offset = offset
+				kd.entries[id] = e
+				delete(gone, id)
+				offset += int64(len(line))
+				continue
+			}
+		}
+		fresh, at = append(fresh, line), append(at, offset)
+		offset += int64(len(line))
+	}
+	for id, e := range gone {
+		kd.unlink(id, e)
+	}
+	kd.dead = 0
+	for i, line := range fresh {
+		kd.index(at[i], line)
+	}
+	kd.tailID = 0
+	last := int64(-1)
+	for id, e := range kd.entries {
+		if e.Offset > last {
+			kd.tailID, last = id, e.Offset
+		}
+	}
+	kd.info, kd.size = info, int64(len(content))
+	return kd.saveHint(SyncNone) == nil
+}
+
+// removeIndex drops the id index of db after its lines moved, the next lookup rebuilds it
+func removeIndex(db string) error {
+	if err := os.Remove(idxPath(db)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// liveLines keeps the latest version of every record of an append storage database, in id
+// order, and drops the removed ones
+func liveLines(lines []string) []string {
+	latest := make(map[int]string)
+	for _, line := range lines {
+		var head recordHead
+		if json.Unmarshal([]byte(line), &head) != nil {
+			continue
+		}
+		if head.Deleted {
+			delete(latest, head.Id)
+		} else {
+			latest[head.Id] = line
+		}
+	}
+	ids := make([]int, 0, len(latest))
+	for id := range latest {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	live := make([]string, 0, len(ids))
+	for _, id := range ids {
+		live = append(live, latest[id])
+	}
+	return live
+}
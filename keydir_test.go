@@ -0,0 +1,116 @@
+package tardigrade
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// appendDB creates an append storage database holding a, b (modified) and c with b removed
+func appendDB(t *testing.T) (*Tardigrade, string) {
+	t.Helper()
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "append.db")
+	tar.CreateDB(db)
+	if err := tar.ConvertStorage(db, StorageAppend); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := tar.AddFieldE(key, key+"1", db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := tar.ModifyFieldE(1, "a", "a2", db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tar.RemoveFieldE(2, db); err != nil {
+		t.Fatal(err)
+	}
+	return tar, db
+}
+
+// forget drops the in-process state of db so the next call reads it like a new process
+func forget(db string) {
+	path, _ := filepath.Abs(db)
+	states.Lock()
+	delete(states.m, path)
+	states.Unlock()
+}
+
+func checkAppendDB(t *testing.T, tar *Tardigrade, db string) {
+	t.Helper()
+	rows, err := tar.SelectSearchE("", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0].Data != "a2" || rows[1].Key != "c" {
+		t.Fatalf("live records = %+v", rows)
+	}
+	if n := tar.CountSize(db); n != 2 {
+		t.Fatalf("CountSize = %d, want 2", n)
+	}
+	if _, err := tar.SelectByIDE(2, "raw", db); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("SelectByIDE(2) = %v, want ErrNotFound", err)
+	}
+	id, err := tar.AddFieldE("d", "d1", db)
+	if err != nil || id != 4 {
+		t.Fatalf("AddFieldE = %d, %v, want id 4", id, err)
+	}
+}
+
+func TestAppendStorage(t *testing.T) {
+	tar, db := appendDB(t)
+	checkAppendDB(t, tar, db)
+
+	forget(db)
+	if got := tar.SelectByID(1, "raw", db); got != `{"id":1,"key":"a","data":"a2"}` {
+		t.Fatalf("reopened SelectByID(1) = %s", got)
+	}
+}
+
+func TestAppendStorageWithoutHint(t *testing.T) {
+	tar, db := appendDB(t)
+	forget(db)
+	if err := os.Remove(hintPath(db)); err != nil {
+		t.Fatal(err)
+	}
+	checkAppendDB(t, tar, db)
+	if _, err := os.Stat(hintPath(db)); err != nil {
+		t.Fatalf("hint not rebuilt: %v", err)
+	}
+}
+
+func TestConvertStorageBack(t *testing.T) {
+	tar, db := appendDB(t)
+	if err := tar.ConvertStorage(db, StorageRewrite); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(hintPath(db)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("hint left behind: %v", err)
+	}
+	content, err := os.ReadFile(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"id\":1,\"key\":\"a\",\"data\":\"a2\"}\n{\"id\":3,\"key\":\"c\",\"data\":\"c1\"}\n"
+	if string(content) != want {
+		t.Fatalf("rewritten file = %q, want %q", content, want)
+	}
+}
+
+func TestCompactAppend(t *testing.T) {
+	tar, db := appendDB(t)
+	stats, err := tar.Compact(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.RecordsAfter != 2 || stats.Reclaimed <= 0 {
+		t.Fatalf("Compact = %+v", stats)
+	}
+	checkAppendDB(t, tar, db)
+	forget(db)
+	if n := tar.CountSize(db); n != 3 {
+		t.Fatalf("CountSize after reopen = %d, want 3", n)
+	}
+}
@@ -0,0 +1,271 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// GetByKey returns the record stored under key, the one with the lowest id when several share it
+func (tar *Tardigrade) GetByKey(key string, db string) (MyStruct, error) {
+	var s MyStruct
+	err := tar.getByKey("GetByKey", key, db, &s)
+	return s, err
+}
+
+// GetFlexByKey returns the flexible record stored under key, the one with the lowest id when
+// several share it
+func (tar *Tardigrade) GetFlexByKey(key string, db string) (FlexStruct, error) {
+	var record FlexStruct
+	err := tar.getByKey("GetFlexByKey", key, db, &record)
+	return record, err
+}
+
+// UpsertByKey replaces the data of the record stored under key keeping its id, or adds a new
+// record when there is none, and returns the id
+func (tar *Tardigrade) UpsertByKey(key, data string, db string) (int, error) {
+	return tar.upsert("UpsertByKey", key, db, func(id int) interface{} {
+		return MyStruct{Id: id, Key: key, Data: data}
+	})
+}
+
+// UpsertFlexByKey replaces the fields of the flexible record stored under key keeping its id,
+// or adds a new record when there is none, and returns the id
+func (tar *Tardigrade) UpsertFlexByKey(key string, fields map[string]string, db string) (int, error) {
+	return tar.upsert("UpsertFlexByKey", key, db, func(id int) interface{} {
+		return FlexStruct{Id: id, Key: key, Fields: fields}
+	})
+}
+
+// RemoveByKey deletes every record stored under key with a single write and returns how many
+// were removed, on failure none is
+func (tar *Tardigrade) RemoveByKey(key string, db string) (int, error) {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return 0, newError("RemoveByKey", db, 0, err)
+	}
+	defer unlock()
+
+	ids, err := keyIDs(pathView(db), key)
+	if err != nil {
+		return 0, newError("RemoveByKey", db, 0, err)
+	}
+	if err := tar.eraseAll("RemoveByKey", db, ids); err != nil {
+		return 0, err
+	}
+	return len(ids), nil
+}
+
+// SetUniqueKeys turns the unique key constraint of db on or off. While it is on adding or
+// modifying a record under a key another record holds fails with ErrDuplicateKey. Turning it
+// on fails the same way when db already holds a duplicate.
+func (tar *Tardigrade) SetUniqueKeys(db string, unique bool) error {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return newError("SetUniqueKeys", db, 0, err)
+	}
+	defer unlock()
+
+	if _, err := statDB(db); err != nil {
+		return newError("SetUniqueKeys", db, 0, err)
+	}
+	meta, err := loadMeta(db)
+	if err != nil {
+		return newError("SetUniqueKeys", db, 0, err)
+	}
+	if meta.UniqueKeys == unique {
+		return nil
+	}
+	if unique {
+		if err := checkDuplicates(pathView(db)); err != nil {
+			return newError("SetUniqueKeys", db, 0, err)
+		}
+	}
+	meta.UniqueKeys = unique
+	return newError("SetUniqueKeys", db, 0, saveMeta(db, meta))
+}
+
+// getByKey decodes the record stored under key into out under the shared lock
+func (tar *Tardigrade) getByKey(op, key, db string, out interface{}) error {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return newError(op, db, 0, err)
+	}
+	defer unlock()
+
+	return newError(op, db, 0, decodeKey(pathView(db), key, out))
+}
+
+// upsert replaces the record stored under key with the one built by build, or inserts it
+func (tar *Tardigrade) upsert(op, key, db string, build func(id int) interface{}) (int, error) {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return 0, newError(op, db, 0, err)
+	}
+	defer unlock()
+
+	ids, err := findKey(pathView(db), key)
+	if err != nil && !errors.Is(err, ErrDBMissing) && !errors.Is(err, ErrDBEmpty) {
+		return 0, newError(op, db, 0, err)
+	}
+	if len(ids) == 0 {
+		return tar.insert(op, db, key, build)
+	}
+	if _, err := tar.replace(op, db, ids[0], key, build(ids[0])); err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// keyIDs returns the ids stored under key, ErrNotFound when there are none
+func keyIDs(v view, key string) ([]int, error) {
+	ids, err := findKey(v, key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("%w: key %q", ErrNotFound, key)
+	}
+	return ids, nil
+}
+
+// decodeKey decodes the record with the lowest id stored under key into out
+func decodeKey(v view, key string, out interface{}) error {
+	ids, err := keyIDs(v, key)
+	if err != nil {
+		return err
+	}
+	line, err := findLine(v, ids[0])
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(line), out); err != nil {
+		return corrupt(err)
+	}
+	return nil
+}
+
+// checkKey fails with ErrDuplicateKey when db enforces unique keys and a record other than
+// self is stored under key, self is 0 for a record not added yet
+func checkKey(db string, v view, key string, self int) error {
+	meta, err := loadMeta(db)
+	if err != nil || !meta.UniqueKeys {
+		return err
+	}
+	return uniqueKey(v, key, self)
+}
+
+// uniqueKey fails with ErrDuplicateKey when a record other than self is stored under key
+func uniqueKey(v view, key string, self int) error {
+	ids, err := findKey(v, key)
+	if errors.Is(err, ErrDBMissing) || errors.Is(err, ErrDBEmpty) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if id != self {
+			return fmt.Errorf("%w: %q", ErrDuplicateKey, key)
+		}
+	}
+	return nil
+}
+
+// checkDuplicates fails with ErrDuplicateKey when two live records share a key
+func checkDuplicates(v view) error {
+	seen := make(map[string]int)
+	err := v.each(func(l string) error {
+		var head recordHead
+		if json.Unmarshal([]byte(l), &head) != nil || head.Deleted {
+			return nil
+		}
+		if id, ok := seen[head.Key]; ok && id != head.Id {
+			return fmt.Errorf("%w: %q", ErrDuplicateKey, head.Key)
+		}
+		seen[head.Key] = head.Id
+		return nil
+	})
+	if errors.Is(err, ErrDBEmpty) {
+		return nil
+	}
+	return err
+}
+
+// GetByKey returns the record stored under key, see Tardigrade.GetByKey
+func (d *DB) GetByKey(key string) (MyStruct, error) {
+	var s MyStruct
+	err := d.read("GetByKey", func(v view) error {
+		return newError("GetByKey", d.path, 0, decodeKey(v, key, &s))
+	})
+	return s, err
+}
+
+// GetFlexByKey returns the flexible record stored under key, see Tardigrade.GetFlexByKey
+func (d *DB) GetFlexByKey(key string) (FlexStruct, error) {
+	var record FlexStruct
+	err := d.read("GetFlexByKey", func(v view) error {
+		return newError("GetFlexByKey", d.path, 0, decodeKey(v, key, &record))
+	})
+	return record, err
+}
+
+// UpsertByKey replaces or adds the record stored under key and returns its id
+func (d *DB) UpsertByKey(key, data string) (int, error) {
+	return d.upsert("UpsertByKey", key, func(id int) interface{} {
+		return MyStruct{Id: id, Key: key, Data: data}
+	})
+}
+
+// UpsertFlexByKey replaces or adds the flexible record stored under key and returns its id
+func (d *DB) UpsertFlexByKey(key string, fields map[string]string) (int, error) {
+	return d.upsert("UpsertFlexByKey", key, func(id int) interface{} {
+		return FlexStruct{Id: id, Key: key, Fields: fields}
+	})
+}
+
+// RemoveByKey deletes every record stored under key and returns how many were removed
+func (d *DB) RemoveByKey(key string) (int, error) {
+	removed := 0
+	err := d.write("RemoveByKey", func() error {
+		v := d.view()
+		ids, err := keyIDs(v, key)
+		if err != nil {
+			return newError("RemoveByKey", d.path, 0, err)
+		}
+		drop, err := prepareRemoval(v, ids)
+		if err != nil {
+			return newError("RemoveByKey", d.path, 0, err)
+		}
+		err = d.tar.loggedTx(d.path, drop.entries, func() error {
+			return d.store(drop.tombstones, removeLines(drop.lines))
+		})
+		if err != nil {
+			return newError("RemoveByKey", d.path, 0, err)
+		}
+		removed = len(ids)
+		return nil
+	})
+	return removed, err
+}
+
+// upsert replaces the record stored under key with the one built by build, or inserts it
+func (d *DB) upsert(op, key string, build func(id int) interface{}) (int, error) {
+	var id int
+	err := d.write(op, func() error {
+		ids, err := findKey(d.view(), key)
+		if err != nil && !errors.Is(err, ErrDBEmpty) {
+			return newError(op, d.path, 0, err)
+		}
+		if len(ids) == 0 {
+			id, err = d.insert(op, key, build)
+			return err
+		}
+		id = ids[0]
+		return d.replace(op, id, key, build(id))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, nil
+}
@@ -0,0 +1,45 @@
+package tardigrade
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveByKey(t *testing.T) {
+	for _, mode := range []StorageMode{StorageRewrite, StorageAppend} {
+		d, err := Open(filepath.Join(t.TempDir(), "keys.db"), Options{Create: true, WAL: true, Storage: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range []string{"a", "b", "a", "c", "a"} {
+			if _, err := d.Add(key, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		tar := &Tardigrade{}
+		n, err := tar.RemoveByKey("a", d.Path())
+		if err != nil || n != 3 {
+			t.Fatalf("mode %d: RemoveByKey = %d, %v, want 3", mode, n, err)
+		}
+		rows, err := d.Search("")
+		if err != nil || len(rows) != 2 || rows[0].Key != "b" || rows[1].Key != "c" {
+			t.Fatalf("mode %d: left %+v, %v", mode, rows, err)
+		}
+		entries, err := readWAL(walPath(d.Path()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		last := entries[len(entries)-1]
+		if last.Op != "commit" || len(committed(entries[len(entries)-4:])) != 3 {
+			t.Fatalf("mode %d: removals not logged as one transaction: %+v", mode, entries)
+		}
+
+		if n, err := d.RemoveByKey("b"); err != nil || n != 1 {
+			t.Fatalf("mode %d: DB.RemoveByKey = %d, %v, want 1", mode, n, err)
+		}
+		if n, err := d.Count(); err != nil || n != 1 {
+			t.Fatalf("mode %d: Count = %d, %v, want 1", mode, n, err)
+		}
+		d.Close()
+	}
+}
@@ -0,0 +1,506 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// SearchExpr is a parsed search expression, see ParseSearch
+type SearchExpr struct {
+	root matchNode
+}
+
+// ParseSearch parses a search expression. Words and "quoted phrases" match the analyzed words
+// of a record's key, data and flex field values, field:word and field:"a phrase" only those of
+// one field ("key", "data" or a flex field). Terms side by side or joined by AND must all
+// match, OR needs either side, a leading - or NOT negates and parentheses group. AND binds
+// tighter than OR.
+// Usage: expr, err := tardigrade.ParseSearch(`name:"ricardo w" AND (os:linux OR os:bsd) -status:archived`)
+func ParseSearch(query string) (*SearchExpr, error) {
+	p := &matchParser{tokens: lexSearch(query)}
+	if len(p.tokens) == 0 {
+		return &SearchExpr{root: andNode(nil)}, nil
+	}
+	root, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, p.fail("unexpected %q", p.peek().text)
+	}
+	return &SearchExpr{root: root}, nil
+}
+
+// String returns the expression fully parenthesized
+func (e *SearchExpr) String() string {
+	return e.root.String()
+}
+
+// SelectMatchE returns every record of db matching the search expression query, in id order
+// Usage: records, err := tar.SelectMatchE(`key:"user 42" OR data:admin`, "users.db")
+func (tar *Tardigrade) SelectMatchE(query string, db string) ([]MyStruct, error) {
+	var records []MyStruct
+	err := tar.selectMatch("SelectMatch", query, db, func(line string) error {
+		var s MyStruct
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			return corrupt(err)
+		}
+		records = append(records, s)
+		return nil
+	})
+	return records, err
+}
+
+// SelectFlexMatchE returns every flexible record of db matching the search expression query,
+// in id order
+// Usage: records, err := tar.SelectFlexMatchE(`(os:linux OR os:bsd) -status:archived`, "hosts.db")
+func (tar *Tardigrade) SelectFlexMatchE(query string, db string) ([]FlexStruct, error) {
+	var records []FlexStruct
+	err := tar.selectMatch("SelectFlexMatch", query, db, func(line string) error {
+		var record FlexStruct
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return corrupt(err)
+		}
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// selectMatch calls fn with every line of db matching query under the shared lock
+func (tar *Tardigrade) selectMatch(op, query, db string, fn func(line string) error) error {
+	expr, err := ParseSearch(query)
+	if err != nil {
+		return newError(op, db, 0, err)
+	}
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return newError(op, db, 0, err)
+	}
+	defer unlock()
+
+	a, err := analysisFor(db)
+	if err != nil {
+		return newError(op, db, 0, err)
+	}
+	return newError(op, db, 0, matchLines(pathView(db), a, expr, fn))
+}
+
+// Match returns every record matching the search expression query, see ParseSearch
+func (d *DB) Match(query string) ([]MyStruct, error) {
+	var records []MyStruct
+	err := d.match("Match", query, func(line string) error {
+		var s MyStruct
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			return corrupt(err)
+		}
+		records = append(records, s)
+		return nil
+	})
+	return records, err
+}
+
+// MatchFlex returns every flexible record matching the search expression query
+func (d *DB) MatchFlex(query string) ([]FlexStruct, error) {
+	var records []FlexStruct
+	err := d.match("MatchFlex", query, func(line string) error {
+		var record FlexStruct
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return corrupt(err)
+		}
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// match calls fn with every line of the database matching query
+func (d *DB) match(op, query string, fn func(line string) error) error {
+	expr, err := ParseSearch(query)
+	if err != nil {
+		return newError(op, d.path, 0, err)
+	}
+	return d.read(op, func(v view) error {
+		a, err := analysisFor(d.path)
+		if err == nil {
+			err = matchLines(v, a, expr, fn)
+		}
+		return newError(op, d.path, 0, err)
+	})
+}
+
+// Match returns every record matching the search expression query as seen by the transaction
+func (tx *Tx) Match(query string) ([]MyStruct, error) {
+	var records []MyStruct
+	err := tx.match("Match", query, func(line string) error {
+		var s MyStruct
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			return corrupt(err)
+		}
+		records = append(records, s)
+		return nil
+	})
+	return records, err
+}
+
+// MatchFlex returns every flexible record matching the search expression query as seen by the
+// transaction
+func (tx *Tx) MatchFlex(query string) ([]FlexStruct, error) {
+	var records []FlexStruct
+	err := tx.match("MatchFlex", query, func(line string) error {
+		var record FlexStruct
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			return corrupt(err)
+		}
+		records = append(records, record)
+		return nil
+	})
+	return records, err
+}
+
+// match calls fn with every line of the working copy matching query
+func (tx *Tx) match(op, query string, fn func(line string) error) error {
+	if err := tx.check(op); err != nil {
+		return err
+	}
+	expr, err := ParseSearch(query)
+	if err != nil {
+		return newError(op, tx.db.path, 0, err)
+	}
+	a, err := analysisFor(tx.db.path)
+	if err == nil {
+		err = matchLines(tx.view(), a, expr, fn)
+	}
+	return newError(op, tx.db.path, 0, err)
+}
+
+// matchLines calls fn with every line of v whose decoded record matches expr
+func matchLines(v view, a *analysis, expr *SearchExpr, fn func(line string) error) error {
+	return v.each(func(line string) error {
+		if len(strings.TrimSpace(line)) == 0 {
+			return nil
+		}
+		if !expr.root.match(newMatchRecord(a, []byte(line))) {
+			return nil
+		}
+		return fn(line)
+	})
+}
+
+// matchRecord is a decoded record being matched, analyzing each field at most once
+type matchRecord struct {
+	a     *analysis
+	texts []textField
+	words map[string][]map[string]bool // field and text -> terms at each word position
+}
+
+// newMatchRecord returns the record stored in body ready to be matched
+func newMatchRecord(a *analysis, body []byte) *matchRecord {
+	return &matchRecord{a: a, texts: recordTexts(body), words: make(map[string][]map[string]bool)}
+}
+
+// positions returns the terms of field grouped by the word they came from, in text order
+func (r *matchRecord) positions(f textField) []map[string]bool {
+	key := f.name + "\x00" + f.text
+	if words, ok := r.words[key]; ok {
+		return words
+	}
+	var words []map[string]bool
+	last := -1
+	for _, tok := range r.a.analyzer(f.name).Analyze(f.text, false) {
+		if tok.Start != last || len(words) == 0 {
+			words = append(words, make(map[string]bool))
+			last = tok.Start
+		}
+		words[len(words)-1][tok.Term] = true
+	}
+	r.words[key] = words
+	return words
+}
+
+// fields returns the texts a term on field applies to, every one for an empty field and the
+// values at the path for a path such as "address.city" or "tags[*]"
+func (r *matchRecord) fields(field string) []textField {
+	if field == "" {
+		return r.texts
+	}
+	var out []textField
+	for _, f := range r.texts {
+		if f.name == field {
+			out = append(out, f)
+		}
+	}
+	if len(out) > 0 || !strings.ContainsAny(field, ".[") {
+		return out
+	}
+	texts := make(map[string]string, len(r.texts))
+	for _, f := range r.texts {
+		texts[f.name] = f.text
+	}
+	for _, value := range fieldValues(texts, field) {
+		out = append(out, textField{name: field, text: value})
+	}
+	return out
+}
+
+// matchNode is a node of a parsed search expression
+type matchNode interface {
+	match(r *matchRecord) bool
+	String() string
+}
+
+type (
+	andNode  []matchNode
+	orNode   []matchNode
+	notNode  struct{ node matchNode }
+	termNode struct {
+		field  string // empty for every field
+		text   string
+		phrase bool
+	}
+)
+
+func (n andNode) match(r *matchRecord) bool {
+	for _, c := range n {
+		if !c.match(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (n andNode) String() string {
+	return joinNodes(n, " AND ")
+}
+
+func (n orNode) match(r *matchRecord) bool {
+	for _, c := range n {
+		if c.match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n orNode) String() string {
+	return joinNodes(n, " OR ")
+}
+
+func (n notNode) match(r *matchRecord) bool {
+	return !n.node.match(r)
+}
+
+func (n notNode) String() string {
+	return "-" + n.node.String()
+}
+
+// match reports whether the analyzed words of the term follow each other in one of the fields
+// it applies to. A term without words, such as a stop word, matches every record.
+func (n termNode) match(r *matchRecord) bool {
+	for _, f := range r.fields(n.field) {
+		var want []string
+		for _, tok := range r.a.analyzer(f.name).Analyze(n.text, true) {
+			want = append(want, tok.Term)
+		}
+		if len(want) == 0 {
+			return true
+		}
+		words := r.positions(f)
+		for i := 0; i+len(want) <= len(words); i++ {
+			found := true
+			for k, term := range want {
+				found = found && words[i+k][term]
+			}
+			if found {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (n termNode) String() string {
+	text := n.text
+	if n.phrase || strings.ContainsAny(text, " ()\":") {
+		text = fmt.Sprintf("%q", text)
+	}
+	if n.field != "" {
+		return n.field + ":" + text
+	}
+	return text
+}
+
+// joinNodes parenthesizes nodes joined by sep
+func joinNodes(nodes []matchNode, sep string) string {
+	parts := make([]string, len(nodes))
+	for i, n := range nodes {
+		parts[i] = n.String()
+	}
+	return "(" + strings.Join(parts, sep) + ")"
+}
+
+// searchToken is a lexical element of a search expression
+type searchToken struct {
+	kind byte // '(' ')' '-' ':' '"' for a phrase, 'w' for a word
+	text string
+	pos  int
+}
+
+// lexSearch splits a search expression into tokens
+func lexSearch(query string) []searchToken {
+	var toks []searchToken
+	runes := []rune(query)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r) || r == ',':
+			i++
+		case r == '(' || r == ')' || r == ':':
+			toks = append(toks, searchToken{kind: byte(r), text: string(r), pos: i})
+			i++
+		case r == '-' && (i == 0 || unicode.IsSpace(runes[i-1]) || runes[i-1] == '('):
+			toks = append(toks, searchToken{kind: '-', text: "-", pos: i})
+			i++
+		case r == '"':
+			j := i + 1
+			for j < len(runes) && runes[j] != '"' {
+				j++
+			}
+			toks = append(toks, searchToken{kind: '"', text: string(runes[i+1 : j]), pos: i})
+			i = j + 1
+		default:
+			j := i
+			for j < len(runes) && !unicode.IsSpace(runes[j]) && !strings.ContainsRune("(),:\"", runes[j]) {
+				j++
+			}
+			toks = append(toks, searchToken{kind: 'w', text: string(runes[i:j]), pos: i})
+			i = j
+		}
+	}
+	return toks
+}
+
+// matchParser is a recursive descent parser over the tokens of a search expression
+type matchParser struct {
+	tokens []searchToken
+	next   int
+}
+
+func (p *matchParser) done() bool {
+	return p.next >= len(p.tokens)
+}
+
+func (p *matchParser) peek() searchToken {
+	return p.tokens[p.next]
+}
+
+// keyword reports whether the next token is the operator word
+func (p *matchParser) keyword(word string) bool {
+	return !p.done() && p.peek().kind == 'w' && p.peek().text == word
+}
+
+func (p *matchParser) fail(format string, args ...interface{}) error {
+	pos := -1
+	if !p.done() {
+		pos = p.peek().pos
+	}
+	if pos < 0 {
+		return fmt.Errorf("%w: %s at end of query", ErrInvalidQuery, fmt.Sprintf(format, args...))
+	}
+	return fmt.Errorf("%w: %s at position %d", ErrInvalidQuery, fmt.Sprintf(format, args...), pos)
+}
+
+// or parses and ( OR and )*
+func (p *matchParser) or() (matchNode, error) {
+	first, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	nodes := orNode{first}
+	for p.keyword("OR") {
+		p.next++
+		n, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	if len(nodes) == 1 {
+		return first, nil
+	}
+	return nodes, nil
+}
+
+// and parses unary ( [AND] unary )*
+func (p *matchParser) and() (matchNode, error) {
+	var nodes andNode
+	for !p.done() && p.peek().kind != ')' && !p.keyword("OR") {
+		if p.keyword("AND") {
+			if len(nodes) == 0 {
+				return nil, p.fail("AND without a left side")
+			}
+			p.next++
+		}
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, n)
+	}
+	switch len(nodes) {
+	case 0:
+		return nil, p.fail("missing term")
+	case 1:
+		return nodes[0], nil
+	}
+	return nodes, nil
+}
+
+// unary parses ( - | NOT ) unary | ( or ) | term
+func (p *matchParser) unary() (matchNode, error) {
+	if p.done() {
+		return nil, p.fail("missing term")
+	}
+	switch t := p.peek(); {
+	case t.kind == '-' || p.keyword("NOT"):
+		p.next++
+		n, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: n}, nil
+	case t.kind == '(':
+		p.next++
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.done() || p.peek().kind != ')' {
+			return nil, p.fail("missing )")
+		}
+		p.next++
+		return n, nil
+	}
+	return p.term()
+}
+
+// term parses [ field : ] ( word | "phrase" )
+func (p *matchParser) term() (matchNode, error) {
+	t := p.peek()
+	if t.kind != 'w' && t.kind != '"' {
+		return nil, p.fail("unexpected %q", t.text)
+	}
+	p.next++
+	if t.kind == 'w' && !p.done() && p.peek().kind == ':' {
+		p.next++
+		if p.done() || (p.peek().kind != 'w' && p.peek().kind != '"') {
+			return nil, p.fail("missing value for field %s", t.text)
+		}
+		v := p.peek()
+		p.next++
+		return termNode{field: t.text, text: v.text, phrase: v.kind == '"'}, nil
+	}
+	return termNode{text: t.text, phrase: t.kind == '"'}, nil
+}
@@ -0,0 +1,64 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// dbMeta holds the settings of a database that outlive the process, stored in <db>.meta
+type dbMeta struct {
+	UniqueKeys bool       `json:"uniqueKeys,omitempty"`
+	Indexes    [][]string `json:"indexes,omitempty"` // flex fields of every field index
+	FullText   bool       `json:"fullText,omitempty"`
+	// Analyzer and FieldAnalyzers name the analyzers of the database and of single fields
+	Analyzer       string            `json:"analyzer,omitempty"`
+	FieldAnalyzers map[string]string `json:"fieldAnalyzers,omitempty"`
+	Alerts         []AlertRule       `json:"alerts,omitempty"`
+	// Storage is the storage mode the file is written in
+	Storage StorageMode `json:"storage,omitempty"`
+}
+
+// metaPath returns the settings file kept next to db
+func metaPath(db string) string {
+	return db + ".meta"
+}
+
+// loadMeta reads the settings of db, a database without a settings file has the defaults
+func loadMeta(db string) (dbMeta, error) {
+	var meta dbMeta
+	content, err := os.ReadFile(metaPath(db))
+	if errors.Is(err, os.ErrNotExist) {
+		return meta, nil
+	}
+	if err != nil {
+		return meta, err
+	}
+	if err := json.Unmarshal(content, &meta); err != nil {
+		return meta, corrupt(err)
+	}
+	return meta, nil
+}
+
+// saveMeta stores the settings of db, the caller holds its write lock
+func saveMeta(db string, meta dbMeta) error {
+	content, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	defer stateFor(db).dropMeta()
+	return replaceFile(metaPath(db), append(content, '\n'), SyncOnWrite)
+}
+
+// removeSidecars deletes the files kept next to a database that was deleted, its log
+// included. Segments and base copies in a WAL archive are left for point-in-time recovery.
+// The caller holds the write lock.
+func removeSidecars(db string) {
+	s := stateFor(db)
+	paths := []string{hintPath(db), idxPath(db), metaPath(db), walPath(db)}
+	for _, path := range paths {
+		os.Remove(path)
+	}
+	s.wal = nil
+	s.dropMeta()
+}
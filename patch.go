@@ -0,0 +1,395 @@
+package tardigrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// errInvalidPatch marks a merge patch or JSON Patch that is malformed or cannot be applied
+var errInvalidPatch = fmt.Errorf("%w: patch", ErrInvalidQuery)
+
+// PatchOp is one operation of a JSON Patch (RFC 6902): add, remove, replace, move, copy or
+// test. Path and From are JSON Pointers (RFC 6901) into the fields of the record, such as
+// "/address/city" or "/tags/-". A nil Value is the JSON null.
+type PatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	From  string      `json:"from,omitempty"`
+	Value interface{} `json:"value"`
+
+	noValue bool // decoded without a value member
+}
+
+// UnmarshalJSON decodes an operation keeping integers exact and a null value apart from a
+// missing one
+func (op *PatchOp) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Op    string          `json:"op"`
+		Path  string          `json:"path"`
+		From  string          `json:"from"`
+		Value json.RawMessage `json:"value"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	*op = PatchOp{Op: raw.Op, Path: raw.Path, From: raw.From, noValue: raw.Value == nil}
+	if raw.Value == nil {
+		return nil
+	}
+	return decodeText(string(raw.Value), &op.Value)
+}
+
+// PatchFlex applies a JSON Merge Patch (RFC 7396) to the fields of flexible record id under
+// the write lock and returns the resulting record: members of patch replace or merge into the
+// fields and null members remove them
+// Usage: record, err := tar.PatchFlex(1, []byte(`{"status":"done","retries":null}`), "jobs.db")
+func (tar *Tardigrade) PatchFlex(id int, patch []byte, db string) (FlexRecord, error) {
+	doc, err := mergeDoc(patch)
+	if err != nil {
+		return FlexRecord{}, newError("PatchFlex", db, id, err)
+	}
+	record, _, err := tar.changeFlex("PatchFlex", id, db, func(record *FlexRecord) error {
+		record.Fields = mergePatch(record.Fields, doc).(map[string]interface{})
+		return nil
+	})
+	return record, err
+}
+
+// ApplyJSONPatch applies the operations of a JSON Patch (RFC 6902) in order to the fields of
+// flexible record id under the write lock and returns the resulting record. Nothing is written
+// when an operation fails; a failing test fails with ErrTestFailed.
+// Usage: record, err := tar.ApplyJSONPatch(1, []tardigrade.PatchOp{{Op: "test", Path: "/version", Value: 3}, {Op: "replace", Path: "/version", Value: 4}}, "jobs.db")
+func (tar *Tardigrade) ApplyJSONPatch(id int, ops []PatchOp, db string) (FlexRecord, error) {
+	record, _, err := tar.changeFlex("ApplyJSONPatch", id, db, func(record *FlexRecord) error {
+		return applyPatch(record, ops)
+	})
+	return record, err
+}
+
+// changeFlex decodes flexible record id, lets change modify it and stores the result, all
+// under the write lock, returning the record and its new raw line
+func (tar *Tardigrade) changeFlex(op string, id int, db string, change func(record *FlexRecord) error) (FlexRecord, string, error) {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return FlexRecord{}, "", newError(op, db, id, err)
+	}
+	defer unlock()
+
+	record, err := decodeFlexRecord(pathView(db), id)
+	if err != nil {
+		return FlexRecord{}, "", newError(op, db, id, err)
+	}
+	if err := change(&record); err != nil {
+		return FlexRecord{}, "", newError(op, db, id, err)
+	}
+	line, err := tar.replace(op, db, id, record.Key, &record)
+	if err != nil {
+		return FlexRecord{}, "", err
+	}
+	return record, line, nil
+}
+
+// mergeDoc decodes a merge patch, which must be an object
+func mergeDoc(patch []byte) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(patch))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil || doc == nil {
+		return nil, fmt.Errorf("%w: merge patch must be a JSON object", errInvalidPatch)
+	}
+	decodedValue(doc)
+	return doc, nil
+}
+
+// mergePatch returns target with patch merged in as RFC 7396 describes
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{}, len(p))
+	}
+	for name, value := range p {
+		if value == nil {
+			delete(t, name)
+			continue
+		}
+		t[name] = mergePatch(t[name], value)
+	}
+	return t
+}
+
+// applyPatch runs ops against the fields of record, the whole document at pointer ""
+func applyPatch(record *FlexRecord, ops []PatchOp) error {
+	var doc interface{} = record.Fields
+	for i, op := range ops {
+		next, err := applyOp(doc, op)
+		if err != nil {
+			return fmt.Errorf("operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+		doc = next
+	}
+	fields, ok := doc.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("%w: the fields must stay an object", errInvalidPatch)
+	}
+	record.Fields = fields
+	return nil
+}
+
+// applyOp returns doc after one operation
+func applyOp(doc interface{}, op PatchOp) (interface{}, error) {
+	path, err := parsePointer(op.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch op.Op {
+	case "add", "replace", "test":
+		if op.noValue {
+			return nil, fmt.Errorf("%w: %s needs a value", errInvalidPatch, op.Op)
+		}
+		value, err := typedValue(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		switch op.Op {
+		case "add":
+			return addPointer(doc, path, value)
+		case "replace":
+			if len(path) == 0 {
+				return value, nil
+			}
+			if doc, err = removePointer(doc, path); err != nil {
+				return nil, err
+			}
+			return addPointer(doc, path, value)
+		}
+		current, err := getPointer(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		a, _ := json.Marshal(current)
+		b, _ := json.Marshal(value)
+		if !bytes.Equal(a, b) {
+			return nil, fmt.Errorf("%w: %s is %s, not %s", ErrTestFailed, op.Path, a, b)
+		}
+		return doc, nil
+	case "remove":
+		return removePointer(doc, path)
+	case "move", "copy":
+		from, err := parsePointer(op.From)
+		if err != nil {
+			return nil, err
+		}
+		value, err := getPointer(doc, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "copy" {
+			return addPointer(doc, path, copyValue(value))
+		}
+		if strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, fmt.Errorf("%w: cannot move %s into itself", errInvalidPatch, op.From)
+		}
+		if doc, err = removePointer(doc, from); err != nil {
+			return nil, err
+		}
+		return addPointer(doc, path, value)
+	}
+	return nil, fmt.Errorf("%w: unknown operation %q", errInvalidPatch, op.Op)
+}
+
+// parsePointer splits a JSON Pointer into its unescaped reference tokens
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("%w: pointer %q must start with /", errInvalidPatch, pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// getPointer returns the value at path inside doc
+func getPointer(doc interface{}, path []string) (interface{}, error) {
+	for i, token := range path {
+		switch v := doc.(type) {
+		case map[string]interface{}:
+			member, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("%w %q", errFieldNotFound, pointerString(path[:i+1]))
+			}
+			doc = member
+		case []interface{}:
+			n, err := listIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = v[n]
+		default:
+			return nil, fmt.Errorf("%w %q", errFieldNotFound, pointerString(path[:i+1]))
+		}
+	}
+	return doc, nil
+}
+
+// addPointer returns doc with value added at path: set on an object, inserted into a list
+func addPointer(doc interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			n, err := listIndex(token, len(p), true)
+			if err != nil {
+				return nil, err
+			}
+			p = append(p, nil)
+			copy(p[n+1:], p[n:])
+			p[n] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("%w %q", errFieldNotFound, pointerString(path[:len(path)-1]))
+	})
+}
+
+// removePointer returns doc without the value at path
+func removePointer(doc interface{}, path []string) (interface{}, error) {
+	if len(path) == 0 {
+		return nil, fmt.Errorf("%w: cannot remove the whole document", errInvalidPatch)
+	}
+	return updateParent(doc, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[token]; ok {
+				delete(p, token)
+				return p, nil
+			}
+		case []interface{}:
+			n, err := listIndex(token, len(p), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(p[:n], p[n+1:]...), nil
+		}
+		return nil, fmt.Errorf("%w %q", errFieldNotFound, pointerString(path))
+	})
+}
+
+// updateParent returns doc with the container holding the last token of path replaced by
+// what change makes of it
+func updateParent(doc interface{}, path []string, change func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return change(doc, path[0])
+	}
+	child, err := getPointer(doc, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = updateParent(child, path[1:], change); err != nil {
+		return nil, err
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		v[path[0]] = child
+	case []interface{}:
+		n, _ := listIndex(path[0], len(v), false)
+		v[n] = child
+	}
+	return doc, nil
+}
+
+// listIndex parses a reference token into an index of a list of length n, allowing n itself
+// or "-" for the end when adding
+func listIndex(token string, n int, adding bool) (int, error) {
+	if token == "-" && adding {
+		return n, nil
+	}
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || token != strconv.Itoa(i) {
+		return 0, fmt.Errorf("%w: bad list index %q", errInvalidPatch, token)
+	}
+	if i > n || i == n && !adding {
+		return 0, fmt.Errorf("%w: index %d of a list of %d", errFieldNotFound, i, n)
+	}
+	return i, nil
+}
+
+// pointerString writes tokens back as a JSON Pointer
+func pointerString(tokens []string) string {
+	var b strings.Builder
+	for _, token := range tokens {
+		b.WriteString("/" + strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1"))
+	}
+	return b.String()
+}
+
+// copyValue returns a deep copy of a typed value
+func copyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(v))
+		for name, member := range v {
+			out[name] = copyValue(member)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, elem := range v {
+			out[i] = copyValue(elem)
+		}
+		return out
+	}
+	return value
+}
+
+// PatchFlex applies a JSON Merge Patch to flexible record id, see Tardigrade.PatchFlex
+func (d *DB) PatchFlex(id int, patch []byte) (FlexRecord, error) {
+	doc, err := mergeDoc(patch)
+	if err != nil {
+		return FlexRecord{}, newError("PatchFlex", d.path, id, err)
+	}
+	return d.changeFlex("PatchFlex", id, func(record *FlexRecord) error {
+		record.Fields = mergePatch(record.Fields, doc).(map[string]interface{})
+		return nil
+	})
+}
+
+// ApplyJSONPatch applies a JSON Patch to flexible record id, see Tardigrade.ApplyJSONPatch
+func (d *DB) ApplyJSONPatch(id int, ops []PatchOp) (FlexRecord, error) {
+	return d.changeFlex("ApplyJSONPatch", id, func(record *FlexRecord) error {
+		return applyPatch(record, ops)
+	})
+}
+
+// changeFlex decodes flexible record id, lets change modify it and stores the result, all
+// under the write lock
+func (d *DB) changeFlex(op string, id int, change func(record *FlexRecord) error) (FlexRecord, error) {
+	var record FlexRecord
+	err := d.write(op, func() (err error) {
+		if record, err = decodeFlexRecord(d.view(), id); err != nil {
+			return newError(op, d.path, id, err)
+		}
+		if err := change(&record); err != nil {
+			return newError(op, d.path, id, err)
+		}
+		return d.replace(op, id, record.Key, record)
+	})
+	if err != nil {
+		return FlexRecord{}, err
+	}
+	return record, nil
+}
@@ -0,0 +1,48 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestJSONPatchNull(t *testing.T) {
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "patch.db")
+	tar.CreateDB(db)
+	id, err := tar.AddFlexTyped("job", map[string]interface{}{"retries": 2, "owner": "ann"}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ops []PatchOp
+	doc := `[{"op":"replace","path":"/owner","value":null},{"op":"test","path":"/owner","value":null},` +
+		`{"op":"add","path":"/cfg","value":{"port":8080,"proxy":null}}]`
+	if err := json.Unmarshal([]byte(doc), &ops); err != nil {
+		t.Fatal(err)
+	}
+	record, err := tar.ApplyJSONPatch(id, ops, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := record.Fields["owner"]; !ok || value != nil {
+		t.Fatalf("owner = %#v, %v, want null", value, ok)
+	}
+	if port, err := record.Path("cfg.port"); err != nil || port != int64(8080) {
+		t.Fatalf("cfg.port = %#v, %v, want int64 8080", port, err)
+	}
+	if got := tar.SelectByID(id, "raw", db); got != `{"id":1,"key":"job","fields":{"cfg":{"port":8080,"proxy":null},"owner":null,"retries":2}}` {
+		t.Fatalf("stored line %s", got)
+	}
+
+	if err := json.Unmarshal([]byte(`[{"op":"add","path":"/x"}]`), &ops); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tar.ApplyJSONPatch(id, ops, db); !errors.Is(err, ErrInvalidQuery) {
+		t.Fatalf("add without a value = %v, want ErrInvalidQuery", err)
+	}
+	if _, err := tar.ApplyJSONPatch(id, []PatchOp{{Op: "add", Path: "/x"}}, db); err != nil {
+		t.Fatalf("add of a nil Value = %v, want null stored", err)
+	}
+}
@@ -0,0 +1,413 @@
+package tardigrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// errInvalidPath marks a field path that does not parse
+var errInvalidPath = fmt.Errorf("%w: path", ErrInvalidQuery)
+
+// pathStep is a member name, a list index or, with any set, every element of a list
+type pathStep struct {
+	name  string
+	index int
+	list  bool
+	any   bool
+}
+
+// GetFlexPath returns the value at path inside the fields of flexible record id, such as
+// "address.city" or "tags[0]", typed as FlexRecord values are
+// Usage: city, err := tar.GetFlexPath(1, "address.city", "config.db")
+func (tar *Tardigrade) GetFlexPath(id int, path string, db string) (interface{}, error) {
+	steps, err := parsePath(path, false)
+	if err != nil {
+		return nil, newError("GetFlexPath", db, id, err)
+	}
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return nil, err
+	}
+	value, err := record.path(path, steps)
+	return value, newError("GetFlexPath", db, id, err)
+}
+
+// SetFlexPath stores value (see AddFlexTyped) at path inside the fields of flexible record id,
+// creating the objects leading to it, and returns the new raw line. A list index may be the
+// length of the list to append.
+// Usage: line, err := tar.SetFlexPath(1, "net.proxy.port", 8080, "config.db")
+func (tar *Tardigrade) SetFlexPath(id int, path string, value interface{}, db string) (string, error) {
+	return tar.changePath("SetFlexPath", id, path, db, func(fields map[string]interface{}, steps []pathStep) error {
+		typed, err := typedValue(value)
+		if err != nil {
+			return err
+		}
+		return setPath(fields, steps, typed)
+	})
+}
+
+// DeleteFlexPath removes the member or list element at path from flexible record id and
+// returns the new raw line
+func (tar *Tardigrade) DeleteFlexPath(id int, path string, db string) (string, error) {
+	return tar.changePath("DeleteFlexPath", id, path, db, deletePath)
+}
+
+// ListFlexPaths returns the dotted paths of every leaf value of flexible record id in order,
+// such as "address.city" and "tags[0]", where ListFlexFields returns the top-level names
+func (tar *Tardigrade) ListFlexPaths(id int, db string) ([]string, error) {
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return nil, err
+	}
+	return record.Paths(), nil
+}
+
+// changePath applies change to the typed fields of record id under the write lock
+func (tar *Tardigrade) changePath(op string, id int, path string, db string, change func(map[string]interface{}, []pathStep) error) (string, error) {
+	steps, err := parsePath(path, false)
+	if err != nil {
+		return "", newError(op, db, id, err)
+	}
+	_, line, err := tar.changeFlex(op, id, db, func(record *FlexRecord) error {
+		return change(record.Fields, steps)
+	})
+	return line, err
+}
+
+// Path returns the value at path, see Tardigrade.GetFlexPath
+func (r FlexRecord) Path(path string) (interface{}, error) {
+	steps, err := parsePath(path, false)
+	if err != nil {
+		return nil, err
+	}
+	return r.path(path, steps)
+}
+
+// path returns the single value at the parsed path
+func (r FlexRecord) path(path string, steps []pathStep) (interface{}, error) {
+	if value, ok := r.Fields[path]; ok {
+		return value, nil
+	}
+	values := walkPath(map[string]interface{}(r.Fields), steps)
+	if len(values) == 0 {
+		return nil, fmt.Errorf("%w %q", errFieldNotFound, path)
+	}
+	return values[0], nil
+}
+
+// Paths returns the dotted paths of every leaf value in order, see Tardigrade.ListFlexPaths
+func (r FlexRecord) Paths() []string {
+	var paths []string
+	var walk func(prefix string, value interface{})
+	walk = func(prefix string, value interface{}) {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			if len(v) == 0 && prefix != "" {
+				paths = append(paths, prefix)
+			}
+			for name, member := range v {
+				if prefix != "" {
+					name = prefix + "." + name
+				}
+				walk(name, member)
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				paths = append(paths, prefix)
+			}
+			for i, elem := range v {
+				walk(prefix+"["+strconv.Itoa(i)+"]", elem)
+			}
+		default:
+			paths = append(paths, prefix)
+		}
+	}
+	walk("", map[string]interface{}(r.Fields))
+	sort.Strings(paths)
+	return paths
+}
+
+// parsePath splits a path such as "a.b[0].c" into steps, allowing "[*]" when wildcards is set
+func parsePath(path string, wildcards bool) ([]pathStep, error) {
+	var steps []pathStep
+	i := 0
+	for i < len(path) {
+		switch {
+		case path[i] == '[':
+			end := strings.IndexByte(path[i:], ']')
+			if end < 0 || len(steps) == 0 {
+				return nil, fmt.Errorf("%w %q: bad index at %d", errInvalidPath, path, i)
+			}
+			inner := path[i+1 : i+end]
+			step := pathStep{list: true}
+			if inner == "*" && wildcards {
+				step.any = true
+			} else if n, err := strconv.Atoi(inner); err == nil && n >= 0 {
+				step.index = n
+			} else {
+				return nil, fmt.Errorf("%w %q: bad index %q", errInvalidPath, path, inner)
+			}
+			steps = append(steps, step)
+			i += end + 1
+		default:
+			if len(steps) > 0 {
+				if path[i] != '.' {
+					return nil, fmt.Errorf("%w %q: expected . at %d", errInvalidPath, path, i)
+				}
+				i++
+			}
+			end := strings.IndexAny(path[i:], ".[")
+			if end < 0 {
+				end = len(path) - i
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("%w %q: empty name at %d", errInvalidPath, path, i)
+			}
+			steps = append(steps, pathStep{name: path[i : i+end]})
+			i += end
+		}
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("%w: empty path", errInvalidPath)
+	}
+	return steps, nil
+}
+
+// walkPath returns the values at steps below value, several when a step is a wildcard. A
+// string holding JSON text is decoded when the path goes on below it.
+func walkPath(value interface{}, steps []pathStep) []interface{} {
+	if len(steps) == 0 {
+		return []interface{}{value}
+	}
+	if s, ok := value.(string); ok {
+		var decoded interface{}
+		if decodeText(s, &decoded) != nil {
+			return nil
+		}
+		value = decoded
+	}
+	step := steps[0]
+	switch v := value.(type) {
+	case map[string]interface{}:
+		if member, ok := v[step.name]; ok && !step.list {
+			return walkPath(member, steps[1:])
+		}
+	case []interface{}:
+		if step.any {
+			var values []interface{}
+			for _, elem := range v {
+				values = append(values, walkPath(elem, steps[1:])...)
+			}
+			return values
+		}
+		if step.list && step.index < len(v) {
+			return walkPath(v[step.index], steps[1:])
+		}
+	}
+	return nil
+}
+
+// setPath stores value at steps inside fields, creating missing objects on the way
+func setPath(fields map[string]interface{}, steps []pathStep, value interface{}) error {
+	var parent interface{} = fields
+	for i, step := range steps {
+		last := i == len(steps)-1
+		var next interface{}
+		if !last {
+			if steps[i+1].list {
+				next = []interface{}{}
+			} else {
+				next = map[string]interface{}{}
+			}
+		}
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if step.list {
+				return fmt.Errorf("%w: %s is an object, not a list", ErrFieldType, pathString(steps[:i]))
+			}
+			if last {
+				p[step.name] = value
+				return nil
+			}
+			if member, ok := p[step.name]; ok {
+				next = member
+			}
+			p[step.name] = next
+		case []interface{}:
+			if !step.list {
+				return fmt.Errorf("%w: %s is a list, not an object", ErrFieldType, pathString(steps[:i]))
+			}
+			if step.index > len(p) {
+				return fmt.Errorf("%w: index %d of %s", errFieldNotFound, step.index, pathString(steps[:i]))
+			}
+			if step.index == len(p) {
+				p = append(p, next)
+				if err := setPath(fields, steps[:i], p); err != nil {
+					return err
+				}
+			}
+			if last {
+				p[step.index] = value
+				return nil
+			}
+			if p[step.index] == nil {
+				p[step.index] = next
+			}
+			next = p[step.index]
+		default:
+			return fmt.Errorf("%w: %s holds %T, not an object or list", ErrFieldType, pathString(steps[:i]), parent)
+		}
+		parent = next
+	}
+	return nil
+}
+
+// deletePath removes the member or list element at steps from fields
+func deletePath(fields map[string]interface{}, steps []pathStep) error {
+	parents := walkPath(map[string]interface{}(fields), steps[:len(steps)-1])
+	if len(parents) == 1 {
+		step := steps[len(steps)-1]
+		switch p := parents[0].(type) {
+		case map[string]interface{}:
+			if _, ok := p[step.name]; ok && !step.list {
+				delete(p, step.name)
+				return nil
+			}
+		case []interface{}:
+			if step.list && step.index < len(p) {
+				p = append(p[:step.index], p[step.index+1:]...)
+				return setPath(fields, steps[:len(steps)-1], p)
+			}
+		}
+	}
+	return fmt.Errorf("%w %q", errFieldNotFound, pathString(steps))
+}
+
+// pathString writes steps back as a path
+func pathString(steps []pathStep) string {
+	var b strings.Builder
+	for i, step := range steps {
+		switch {
+		case step.any:
+			b.WriteString("[*]")
+		case step.list:
+			b.WriteString("[" + strconv.Itoa(step.index) + "]")
+		default:
+			if i > 0 {
+				b.WriteByte('.')
+			}
+			b.WriteString(step.name)
+		}
+	}
+	return b.String()
+}
+
+// valueText returns a typed value as text the way fieldText does
+func valueText(value interface{}) string {
+	if s, ok := value.(string); ok {
+		return s
+	}
+	b, _ := json.Marshal(value)
+	return string(b)
+}
+
+// fieldValues returns the values of field among fields held as text, several when it is a
+// path with wildcards. A field named like the whole path wins over the path.
+func fieldValues(fields map[string]string, field string) []string {
+	if value, ok := fields[field]; ok {
+		return []string{value}
+	}
+	if !strings.ContainsAny(field, ".[") {
+		return nil
+	}
+	steps, err := parsePath(field, true)
+	if err != nil {
+		return nil
+	}
+	text, ok := fields[steps[0].name]
+	if !ok || steps[0].list {
+		return nil
+	}
+	var values []string
+	for _, value := range walkPath(text, steps[1:]) {
+		values = append(values, valueText(value))
+	}
+	return values
+}
+
+// fieldValue returns the first value of field among fields held as text, see fieldValues
+func fieldValue(fields map[string]string, field string) (string, bool) {
+	values := fieldValues(fields, field)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
+
+// rawFieldValue returns the value of field or of the path field among stored fields as text
+func rawFieldValue(fields map[string]json.RawMessage, field string) (string, bool) {
+	if raw, ok := fields[field]; ok {
+		return fieldText(raw), true
+	}
+	steps, err := parsePath(field, false)
+	if err != nil || len(steps) < 2 {
+		return "", false
+	}
+	raw, ok := fields[steps[0].name]
+	if !ok {
+		return "", false
+	}
+	var decoded interface{}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	if d.Decode(&decoded) != nil {
+		return "", false
+	}
+	values := walkPath(decodedValue(decoded), steps[1:])
+	if len(values) != 1 {
+		return "", false
+	}
+	return valueText(values[0]), true
+}
+
+// GetFlexPath returns the value at path inside flexible record id, see Tardigrade.GetFlexPath
+func (d *DB) GetFlexPath(id int, path string) (interface{}, error) {
+	record, err := d.GetFlexRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	value, err := record.Path(path)
+	return value, newError("GetFlexPath", d.path, id, err)
+}
+
+// SetFlexPath stores value at path inside flexible record id, see Tardigrade.SetFlexPath
+func (d *DB) SetFlexPath(id int, path string, value interface{}) error {
+	return d.changePath("SetFlexPath", id, path, func(fields map[string]interface{}, steps []pathStep) error {
+		typed, err := typedValue(value)
+		if err != nil {
+			return err
+		}
+		return setPath(fields, steps, typed)
+	})
+}
+
+// DeleteFlexPath removes the value at path from flexible record id
+func (d *DB) DeleteFlexPath(id int, path string) error {
+	return d.changePath("DeleteFlexPath", id, path, deletePath)
+}
+
+// changePath applies change to the typed fields of record id under the write lock
+func (d *DB) changePath(op string, id int, path string, change func(map[string]interface{}, []pathStep) error) error {
+	steps, err := parsePath(path, false)
+	if err != nil {
+		return newError(op, d.path, id, err)
+	}
+	_, err = d.changeFlex(op, id, func(record *FlexRecord) error {
+		return change(record.Fields, steps)
+	})
+	return err
+}
@@ -0,0 +1,279 @@
+package tardigrade
+
+// porter holds a word being stemmed: b[:k+1] is the current word and j marks the end of the
+// stem when a suffix has been matched by ends
+type porter struct {
+	b    []byte
+	k, j int
+}
+
+// porterStem returns the stem of a lower-case English word following M.F. Porter's 1980
+// algorithm, words with anything but ASCII letters are returned unchanged
+func porterStem(word string) string {
+	if len(word) <= 2 {
+		return word
+	}
+	for i := 0; i < len(word); i++ {
+		if word[i] < 'a' || word[i] > 'z' {
+			return word
+		}
+	}
+	p := &porter{b: []byte(word), k: len(word) - 1}
+	p.step1ab()
+	if p.k > 0 {
+		p.step1c()
+		p.step2()
+		p.step3()
+		p.step4()
+		p.step5()
+	}
+	return string(p.b[:p.k+1])
+}
+
+// cons reports whether b[i] is a consonant
+func (p *porter) cons(i int) bool {
+	switch p.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !p.cons(i-1)
+	}
+	return true
+}
+
+// m counts the vowel-consonant sequences of b[:j+1]
+func (p *porter) m() int {
+	n, i := 0, 0
+	for {
+		if i > p.j {
+			return n
+		}
+		if !p.cons(i) {
+			break
+		}
+		i++
+	}
+	i++
+	for {
+		for {
+			if i > p.j {
+				return n
+			}
+			if p.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+		n++
+		for {
+			if i > p.j {
+				return n
+			}
+			if !p.cons(i) {
+				break
+			}
+			i++
+		}
+		i++
+	}
+}
+
+// vowelInStem reports whether b[:j+1] holds a vowel
+func (p *porter) vowelInStem() bool {
+	for i := 0; i <= p.j; i++ {
+		if !p.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleC reports whether b[i-1:i+1] is a double consonant
+func (p *porter) doubleC(i int) bool {
+	return i >= 1 && p.b[i] == p.b[i-1] && p.cons(i)
+}
+
+// cvc reports whether b[i-2:i+1] is consonant, vowel, consonant with the last one not w, x or y
+func (p *porter) cvc(i int) bool {
+	if i < 2 || !p.cons(i) || p.cons(i-1) || !p.cons(i-2) {
+		return false
+	}
+	switch p.b[i] {
+	case 'w', 'x', 'y':
+		return false
+	}
+	return true
+}
+
+// ends reports whether the word ends with s, setting j to the end of the stem before it
+func (p *porter) ends(s string) bool {
+	n := len(s)
+	if n > p.k+1 || string(p.b[p.k-n+1:p.k+1]) != s {
+		return false
+	}
+	p.j = p.k - n
+	return true
+}
+
+// setTo replaces the suffix after j with s
+func (p *porter) setTo(s string) {
+	p.b = append(p.b[:p.j+1], s...)
+	p.k = p.j + len(s)
+}
+
+// r replaces the suffix after j with s when the stem has a vowel-consonant sequence
+func (p *porter) r(s string) {
+	if p.m() > 0 {
+		p.setTo(s)
+	}
+}
+
+// step1ab removes plurals and -ed or -ing
+func (p *porter) step1ab() {
+	if p.b[p.k] == 's' {
+		switch {
+		case p.ends("sses"):
+			p.k -= 2
+		case p.ends("ies"):
+			p.setTo("i")
+		case p.b[p.k-1] != 's':
+			p.k--
+		}
+	}
+	if p.ends("eed") {
+		if p.m() > 0 {
+			p.k--
+		}
+	} else if (p.ends("ed") || p.ends("ing")) && p.vowelInStem() {
+		p.k = p.j
+		switch {
+		case p.ends("at"):
+			p.setTo("ate")
+		case p.ends("bl"):
+			p.setTo("ble")
+		case p.ends("iz"):
+			p.setTo("ize")
+		case p.doubleC(p.k):
+			p.k--
+			switch p.b[p.k] {
+			case 'l', 's', 'z':
+				p.k++
+			}
+		default:
+			p.j = p.k
+			if p.m() == 1 && p.cvc(p.k) {
+				p.setTo("e")
+			}
+		}
+	}
+}
+
+// step1c turns a terminal y into i when there is another vowel in the stem
+func (p *porter) step1c() {
+	if p.ends("y") && p.vowelInStem() {
+		p.b[p.k] = 'i'
+	}
+}
+
+// replaceFirst applies the first rule whose suffix ends the word, pairs are suffix and
+// replacement
+func (p *porter) replaceFirst(rules ...string) {
+	for i := 0; i+1 < len(rules); i += 2 {
+		if p.ends(rules[i]) {
+			p.r(rules[i+1])
+			return
+		}
+	}
+}
+
+// step2 maps double suffixes to single ones, -ization to -ize and so on
+func (p *porter) step2() {
+	if p.k < 1 {
+		return
+	}
+	switch p.b[p.k-1] {
+	case 'a':
+		p.replaceFirst("ational", "ate", "tional", "tion")
+	case 'c':
+		p.replaceFirst("enci", "ence", "anci", "ance")
+	case 'e':
+		p.replaceFirst("izer", "ize")
+	case 'l':
+		p.replaceFirst("bli", "ble", "alli", "al", "entli", "ent", "eli", "e", "ousli", "ous")
+	case 'o':
+		p.replaceFirst("ization", "ize", "ation", "ate", "ator", "ate")
+	case 's':
+		p.replaceFirst("alism", "al", "iveness", "ive", "fulness", "ful", "ousness", "ous")
+	case 't':
+		p.replaceFirst("aliti", "al", "iviti", "ive", "biliti", "ble")
+	case 'g':
+		p.replaceFirst("logi", "log")
+	}
+}
+
+// step3 handles -ic-, -full, -ness and so on
+func (p *porter) step3() {
+	switch p.b[p.k] {
+	case 'e':
+		p.replaceFirst("icate", "ic", "ative", "", "alize", "al")
+	case 'i':
+		p.replaceFirst("iciti", "ic")
+	case 'l':
+		p.replaceFirst("ical", "ic", "ful", "")
+	case 's':
+		p.replaceFirst("ness", "")
+	}
+}
+
+// step4 removes -ant, -ence and the like when the stem has more than one vowel-consonant
+// sequence
+func (p *porter) step4() {
+	if p.k < 1 {
+		return
+	}
+	matched := false
+	switch p.b[p.k-1] {
+	case 'a':
+		matched = p.ends("al")
+	case 'c':
+		matched = p.ends("ance") || p.ends("ence")
+	case 'e':
+		matched = p.ends("er")
+	case 'i':
+		matched = p.ends("ic")
+	case 'l':
+		matched = p.ends("able") || p.ends("ible")
+	case 'n':
+		matched = p.ends("ant") || p.ends("ement") || p.ends("ment") || p.ends("ent")
+	case 'o':
+		matched = p.ends("ion") && p.j >= 0 && (p.b[p.j] == 's' || p.b[p.j] == 't') || p.ends("ou")
+	case 's':
+		matched = p.ends("ism")
+	case 't':
+		matched = p.ends("ate") || p.ends("iti")
+	case 'u':
+		matched = p.ends("ous")
+	case 'v':
+		matched = p.ends("ive")
+	case 'z':
+		matched = p.ends("ize")
+	}
+	if matched && p.m() > 1 {
+		p.k = p.j
+	}
+}
+
+// step5 removes a final -e and turns -ll into -l when the stem is long enough
+func (p *porter) step5() {
+	p.j = p.k
+	if p.b[p.k] == 'e' {
+		a := p.m()
+		if a > 1 || a == 1 && !p.cvc(p.k-1) {
+			p.k--
+		}
+	}
+	if p.b[p.k] == 'l' && p.doubleC(p.k) && p.m() > 1 {
+		p.k--
+	}
+}
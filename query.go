@@ -0,0 +1,480 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query selects, orders and projects the records of a database, built with NewQuery or read
+// from a JSON query document with ParseQuery. Fields are "id", "key", "data" and the flex
+// fields of a record, a flex field named like one of the first three is hidden by it.
+// Usage: q := tardigrade.NewQuery().Where("os", "=", "linux").OrderBy("cost", tardigrade.Desc).Select("key", "cost").Limit(10)
+type Query struct {
+	where  []Filter
+	orders []Order
+	fields []string
+	limit  int
+	offset int
+}
+
+// Filter is a condition on a field, or a group of filters that must all (And) or any (Or)
+// hold. Op is one of the Condition operators.
+type Filter struct {
+	Field string   `json:"field,omitempty"`
+	Op    string   `json:"op,omitempty"`
+	Value string   `json:"value,omitempty"`
+	And   []Filter `json:"and,omitempty"`
+	Or    []Filter `json:"or,omitempty"`
+}
+
+// SortOrder is the direction of an Order
+type SortOrder string
+
+// Sort directions
+const (
+	Asc  SortOrder = "asc"
+	Desc SortOrder = "desc"
+)
+
+// Order sorts query results on a field. Values are compared as numbers when they parse as
+// numbers, as times when they parse as dates, as text otherwise, and missing values come last.
+type Order struct {
+	Field string    `json:"field"`
+	Order SortOrder `json:"order,omitempty"`
+}
+
+// QueryPlan tells how a query was run: through the field index named Index or by scanning
+// every record, how many records were read and how many matched
+type QueryPlan struct {
+	Index    string `json:"index,omitempty"`
+	Scan     bool   `json:"scan"`
+	Examined int    `json:"examined"`
+	Matched  int    `json:"matched"`
+}
+
+// queryDoc is the JSON form of a Query
+type queryDoc struct {
+	Where   *Filter  `json:"where,omitempty"`
+	OrderBy []Order  `json:"orderBy,omitempty"`
+	Select  []string `json:"select,omitempty"`
+	Limit   int      `json:"limit,omitempty"`
+	Offset  int      `json:"offset,omitempty"`
+}
+
+// NewQuery returns a query selecting every record in id order
+func NewQuery() *Query {
+	return &Query{}
+}
+
+// ParseQuery reads a JSON query document such as
+// {"where":{"and":[{"field":"os","op":"=","value":"linux"},{"or":[...]}]},"orderBy":[{"field":"cost","order":"desc"}],"select":["key","cost"],"limit":10,"offset":0}
+func ParseQuery(doc []byte) (*Query, error) {
+	q := &Query{}
+	if err := json.Unmarshal(doc, q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Cond returns the filter comparing field with value using op
+func Cond(field, op, value string) Filter {
+	return Filter{Field: field, Op: op, Value: value}
+}
+
+// And returns the filter holding when every one of filters holds
+func And(filters ...Filter) Filter {
+	return Filter{And: filters}
+}
+
+// Or returns the filter holding when any of filters holds
+func Or(filters ...Filter) Filter {
+	return Filter{Or: filters}
+}
+
+// Where narrows the query to records whose field compares to value with op
+func (q *Query) Where(field, op, value string) *Query {
+	return q.Filter(Cond(field, op, value))
+}
+
+// Filter narrows the query to records matching f, see And and Or
+func (q *Query) Filter(f Filter) *Query {
+	q.where = append(q.where, f)
+	return q
+}
+
+// OrderBy sorts the results on field, later calls break ties of earlier ones. Records without
+// an order are returned in id order.
+func (q *Query) OrderBy(field string, order SortOrder) *Query {
+	q.orders = append(q.orders, Order{Field: field, Order: order})
+	return q
+}
+
+// Select limits the fields of every result to fields
+func (q *Query) Select(fields ...string) *Query {
+	q.fields = append(q.fields, fields...)
+	return q
+}
+
+// Limit returns at most n results, 0 returns all of them
+func (q *Query) Limit(n int) *Query {
+	q.limit = n
+	return q
+}
+
+// Offset skips the first n results
+func (q *Query) Offset(n int) *Query {
+	q.offset = n
+	return q
+}
+
+// MarshalJSON writes the query as a JSON query document, see ParseQuery
+func (q *Query) MarshalJSON() ([]byte, error) {
+	doc := queryDoc{OrderBy: q.orders, Select: q.fields, Limit: q.limit, Offset: q.offset}
+	switch len(q.where) {
+	case 0:
+	case 1:
+		doc.Where = &q.where[0]
+	default:
+		where := And(q.where...)
+		doc.Where = &where
+	}
+	return json.Marshal(doc)
+}
+
+// UnmarshalJSON reads a JSON query document, see ParseQuery
+func (q *Query) UnmarshalJSON(data []byte) error {
+	var doc queryDoc
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	*q = Query{orders: doc.OrderBy, fields: doc.Select, limit: doc.Limit, offset: doc.Offset}
+	if doc.Where != nil {
+		q.where = []Filter{*doc.Where}
+	}
+	return q.check()
+}
+
+// Query runs q against db and returns the selected fields of every result. The field index
+// covering the most conditions that must all hold is used when there is one.
+// Usage: rows, err := tar.Query(tardigrade.NewQuery().Where("billing", "=", "monthly"), "app.db")
+func (tar *Tardigrade) Query(q *Query, db string) ([]map[string]string, error) {
+	rows, _, err := tar.runQuery("Query", q, db)
+	return rows, err
+}
+
+// Explain runs q against db and reports whether an index or a scan served it
+func (tar *Tardigrade) Explain(q *Query, db string) (QueryPlan, error) {
+	_, plan, err := tar.runQuery("Explain", q, db)
+	return plan, err
+}
+
+// runQuery runs runQuery under the shared lock
+func (tar *Tardigrade) runQuery(op string, q *Query, db string) ([]map[string]string, QueryPlan, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, QueryPlan{}, newError(op, db, 0, err)
+	}
+	defer unlock()
+
+	rows, plan, err := runQuery(pathView(db), q)
+	return rows, plan, newError(op, db, 0, err)
+}
+
+// runQuery selects, sorts, pages and projects the records of v
+func runQuery(v view, q *Query) ([]map[string]string, QueryPlan, error) {
+	rows, plan, err := filterRows(v, q)
+	if err != nil {
+		return nil, plan, err
+	}
+	sortRows(rows, q.orders)
+	if q.offset >= len(rows) {
+		return nil, plan, nil
+	}
+	rows = rows[q.offset:]
+	if q.limit > 0 && q.limit < len(rows) {
+		rows = rows[:q.limit]
+	}
+	if len(q.fields) > 0 {
+		for i, row := range rows {
+			rows[i] = project(row, q.fields)
+		}
+	}
+	return rows, plan, nil
+}
+
+// filterRows returns the fields of every record of v matching the filters of q, in id order
+func filterRows(v view, q *Query) ([]map[string]string, QueryPlan, error) {
+	var plan QueryPlan
+	if err := q.check(); err != nil {
+		return nil, plan, err
+	}
+	var rows []map[string]string
+	add := func(line string) error {
+		if len(strings.TrimSpace(line)) == 0 {
+			return nil
+		}
+		row, err := queryRow(line)
+		if err != nil {
+			return err
+		}
+		plan.Examined++
+		if matchFilters(row, q.where) {
+			rows = append(rows, row)
+		}
+		return nil
+	}
+	if conds := indexConditions(q.where); len(conds) > 0 && v.where != nil {
+		lines, index, err := v.where(conds)
+		if err != nil {
+			return nil, plan, err
+		}
+		if index != "" {
+			plan.Index = index
+			for _, line := range lines {
+				if err := add(line); err != nil {
+					return nil, plan, err
+				}
+			}
+		}
+	}
+	if plan.Index == "" {
+		plan.Scan = true
+		if err := v.each(add); err != nil {
+			return nil, plan, err
+		}
+	}
+	plan.Matched = len(rows)
+	return rows, plan, nil
+}
+
+// check rejects malformed filters, orders and paging
+func (q *Query) check() error {
+	for _, f := range q.where {
+		if err := f.check(); err != nil {
+			return err
+		}
+	}
+	for _, o := range q.orders {
+		if o.Field == "" {
+			return fmt.Errorf("%w: order without a field", ErrInvalidQuery)
+		}
+		if o.Order != "" && o.Order != Asc && o.Order != Desc {
+			return fmt.Errorf("%w: unknown sort order %q", ErrInvalidQuery, o.Order)
+		}
+	}
+	if q.limit < 0 || q.offset < 0 {
+		return fmt.Errorf("%w: negative limit or offset", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// check rejects a filter that is not exactly one of a condition, an And group or an Or group
+func (f Filter) check() error {
+	kinds := 0
+	if f.Field != "" || f.Op != "" {
+		kinds++
+		if err := checkConditions([]Condition{{Field: f.Field, Op: f.Op, Value: f.Value}}); err != nil {
+			return err
+		}
+	}
+	for _, group := range [][]Filter{f.And, f.Or} {
+		if group == nil {
+			continue
+		}
+		kinds++
+		for _, sub := range group {
+			if err := sub.check(); err != nil {
+				return err
+			}
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("%w: filter needs exactly one of a condition, \"and\" or \"or\"", ErrInvalidQuery)
+	}
+	return nil
+}
+
+// match reports whether the fields of row satisfy f
+func (f Filter) match(row map[string]string) bool {
+	switch {
+	case f.And != nil:
+		return matchFilters(row, f.And)
+	case f.Or != nil:
+		for _, sub := range f.Or {
+			if sub.match(row) {
+				return true
+			}
+		}
+		return false
+	}
+	return matchFlex(row, []Condition{{Field: f.Field, Op: f.Op, Value: f.Value}})
+}
+
+// matchFilters reports whether row satisfies every filter
+func matchFilters(row map[string]string, filters []Filter) bool {
+	for _, f := range filters {
+		if !f.match(row) {
+			return false
+		}
+	}
+	return true
+}
+
+// indexConditions returns the conditions on flex fields that every result must satisfy, the
+// ones a field index can serve
+func indexConditions(filters []Filter) []Condition {
+	var conds []Condition
+	for _, f := range filters {
+		switch {
+		case f.And != nil:
+			conds = append(conds, indexConditions(f.And)...)
+		case f.Or != nil:
+		case f.Field != "id" && f.Field != "key" && f.Field != "data":
+			conds = append(conds, Condition{Field: f.Field, Op: f.Op, Value: f.Value})
+		}
+	}
+	return conds
+}
+
+// queryRow returns the fields of the record stored in line
+func queryRow(line string) (map[string]string, error) {
+	var record struct {
+		Id     int                        `json:"id"`
+		Key    string                     `json:"key"`
+		Data   *string                    `json:"data"`
+		Fields map[string]json.RawMessage `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return nil, corrupt(err)
+	}
+	row := make(map[string]string, len(record.Fields)+3)
+	for name, raw := range record.Fields {
+		row[name] = fieldText(raw)
+	}
+	row["id"] = strconv.Itoa(record.Id)
+	row["key"] = record.Key
+	if record.Data != nil {
+		row["data"] = *record.Data
+	}
+	return row, nil
+}
+
+// project returns the fields of row named in fields
+func project(row map[string]string, fields []string) map[string]string {
+	out := make(map[string]string, len(fields))
+	for _, field := range fields {
+		if value, ok := fieldValue(row, field); ok {
+			out[field] = value
+		}
+	}
+	return out
+}
+
+// sortRows orders rows by orders, keeping id order among equal rows
+func sortRows(rows []map[string]string, orders []Order) {
+	if len(orders) == 0 {
+		return
+	}
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, o := range orders {
+			a, okA := fieldValue(rows[i], o.Field)
+			b, okB := fieldValue(rows[j], o.Field)
+			if okA != okB {
+				return okA // missing values last in either direction
+			}
+			c := sortCompare(a, b)
+			if c == 0 {
+				continue
+			}
+			if o.Order == Desc {
+				return c > 0
+			}
+			return c < 0
+		}
+		return false
+	})
+}
+
+// dateLayouts are the date formats OrderBy recognizes
+var dateLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+	time.RFC1123Z,
+	time.RFC1123,
+	time.UnixDate,
+}
+
+// sortCompare orders numbers before dates before text, each compared by its own kind
+func sortCompare(a, b string) int {
+	numA, numB := isNumber(a), isNumber(b)
+	switch {
+	case numA && numB:
+		return compareValues(a, b)
+	case numA:
+		return -1
+	case numB:
+		return 1
+	}
+	s, okA := parseDate(a)
+	t, okB := parseDate(b)
+	switch {
+	case okA && okB && s.Before(t):
+		return -1
+	case okA && okB && t.Before(s):
+		return 1
+	case okA && okB:
+		return 0
+	case okA:
+		return -1
+	case okB:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// parseDate parses value in one of dateLayouts
+func parseDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// Query runs q against the database, see Tardigrade.Query
+func (d *DB) Query(q *Query) ([]map[string]string, error) {
+	rows, _, err := d.runQuery("Query", q)
+	return rows, err
+}
+
+// Explain runs q against the database and reports whether an index or a scan served it
+func (d *DB) Explain(q *Query) (QueryPlan, error) {
+	_, plan, err := d.runQuery("Explain", q)
+	return plan, err
+}
+
+// runQuery runs runQuery against the database
+func (d *DB) runQuery(op string, q *Query) (rows []map[string]string, plan QueryPlan, err error) {
+	err = d.read(op, func(v view) error {
+		rows, plan, err = runQuery(v, q)
+		return newError(op, d.path, 0, err)
+	})
+	return rows, plan, err
+}
+
+// Query runs q against the working copy of the transaction, always by scanning it
+func (tx *Tx) Query(q *Query) ([]map[string]string, error) {
+	if err := tx.check("Query"); err != nil {
+		return nil, err
+	}
+	rows, _, err := runQuery(tx.view(), q)
+	return rows, newError("Query", tx.db.path, 0, err)
+}
@@ -0,0 +1,179 @@
+package tardigrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// errInvalidPattern marks a regular expression that does not compile
+var errInvalidPattern = fmt.Errorf("%w: pattern", ErrInvalidQuery)
+
+// SelectRegex returns the records of db whose field matches the regular expression pattern,
+// one per line in format [ raw | json | id | key | value ], value being the matched field.
+// field is "key", "data" or a flex field, "" matches any of them.
+// Usage: format, out := tar.SelectRegex(`^ERROR .*timeout`, "data", "raw", "app.log.db")
+func (tar *Tardigrade) SelectRegex(pattern, field, format string, db string) (string, []byte) {
+	var out bytes.Buffer
+	err := tar.SelectRegexE(pattern, field, format, &out, db)
+	switch {
+	case errors.Is(err, errInvalidPattern):
+		return format, []byte("Invalid pattern provided!")
+	case errors.Is(err, ErrInvalidFormat):
+		return format, []byte("Invalid format provided!")
+	case errors.Is(err, ErrDBMissing) || errors.Is(err, ErrDBEmpty):
+		return format, []byte(legacyMessage("SelectRegex", db, 0, err))
+	}
+	CheckError("SelectRegex", err)
+	return format, out.Bytes()
+}
+
+// SelectWildcard is SelectRegex with a wildcard pattern such as "app:*" or "*-prod", see Wildcard
+func (tar *Tardigrade) SelectWildcard(pattern, field, format string, db string) (string, []byte) {
+	return tar.SelectRegex(Wildcard(pattern), field, format, db)
+}
+
+// SelectRegexE writes the records of db whose field matches pattern to w as they are read, one
+// per line in format, see SelectRegex
+func (tar *Tardigrade) SelectRegexE(pattern, field, format string, w io.Writer, db string) error {
+	if err := checkFormat(format); err != nil {
+		return newError("SelectRegex", db, 0, err)
+	}
+	return tar.selectRegex("SelectRegex", pattern, field, db, func(line string, value string) error {
+		out, err := formatLine(line, format, value)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, out+"\n")
+		return err
+	})
+}
+
+// SelectRegexFunc calls fn with the stored line of every record of db whose field matches
+// pattern, in id order, without holding the matches in memory. An error returned by fn stops
+// the scan and is returned. fn runs under the shared lock and must not write to db.
+func (tar *Tardigrade) SelectRegexFunc(pattern, field string, db string, fn func(line string) error) error {
+	return tar.selectRegex("SelectRegexFunc", pattern, field, db, func(line string, _ string) error {
+		return fn(line)
+	})
+}
+
+// Wildcard returns the regular expression matching the whole of a value against a wildcard
+// pattern, where * stands for any run of characters, ? for one and everything else for itself
+func Wildcard(pattern string) string {
+	var b strings.Builder
+	b.WriteString(`^(?s:`)
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		default:
+			b.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	b.WriteString(`)$`)
+	return b.String()
+}
+
+// selectRegex compiles pattern and runs eachRegex under the shared lock
+func (tar *Tardigrade) selectRegex(op, pattern, field, db string, fn func(line, value string) error) error {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return newError(op, db, 0, err)
+	}
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return newError(op, db, 0, err)
+	}
+	defer unlock()
+
+	return newError(op, db, 0, eachRegex(pathView(db), re, field, fn))
+}
+
+// compilePattern compiles a regular expression, failing with errInvalidPattern
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidPattern, err)
+	}
+	return re, nil
+}
+
+// eachRegex calls fn with every line of v whose field matches re and the matching value
+func eachRegex(v view, re *regexp.Regexp, field string, fn func(line, value string) error) error {
+	return v.each(func(line string) error {
+		if len(strings.TrimSpace(line)) == 0 {
+			return nil
+		}
+		row, err := queryRow(line)
+		if err != nil {
+			return err
+		}
+		if field != "" {
+			if value, ok := fieldValue(row, field); ok && re.MatchString(value) {
+				return fn(line, value)
+			}
+			return nil
+		}
+		for _, f := range recordTexts([]byte(line)) {
+			if re.MatchString(f.text) {
+				return fn(line, f.text)
+			}
+		}
+		return nil
+	})
+}
+
+// checkFormat rejects formats other than raw, json, id, key and value
+func checkFormat(format string) error {
+	switch format {
+	case "raw", "json", "id", "key", "value":
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidFormat, format)
+}
+
+// formatLine renders a stored record of either kind in format, value standing for the field
+// the record was selected on
+func formatLine(line, format, value string) (string, error) {
+	if err := checkFormat(format); err != nil {
+		return "", err
+	}
+	switch format {
+	case "raw":
+		return line, nil
+	case "value":
+		return value, nil
+	case "json":
+		var out bytes.Buffer
+		if err := json.Indent(&out, []byte(line), "", "  "); err != nil {
+			return "", corrupt(err)
+		}
+		return out.String(), nil
+	}
+	row, err := queryRow(line)
+	if err != nil {
+		return "", err
+	}
+	return row[format], nil
+}
+
+// EachRegex calls fn with the stored line of every record whose field matches pattern, see
+// Tardigrade.SelectRegexFunc
+func (d *DB) EachRegex(pattern, field string, fn func(line string) error) error {
+	re, err := compilePattern(pattern)
+	if err != nil {
+		return newError("EachRegex", d.path, 0, err)
+	}
+	return d.read("EachRegex", func(v view) error {
+		return newError("EachRegex", d.path, 0, eachRegex(v, re, field, func(line, _ string) error {
+			return fn(line)
+		}))
+	})
+}
@@ -0,0 +1,153 @@
+package tardigrade
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// dbState is shared by every path-based call and every DB handle working on the same
+// database file within the process. Readers hold mu shared and writers hold it exclusively
+// so concurrent calls from many goroutines behave as if they ran one after the other.
+type dbState struct {
+	path string
+	mu   sync.RWMutex
+	wal  *walState // cached tail of the write-ahead log, guarded by mu held exclusively
+
+	kdMu sync.Mutex
+	kd   *keydir // key directory of append storage, see keydir
+	idx  *keydir // id index of rewrite storage, see idIndex
+
+	compactMu sync.Mutex // held by the compaction of the database running in this process
+
+	metaMu   sync.Mutex
+	metaInfo os.FileInfo // settings file the cached settings were read from, nil without one
+	metaOK   bool
+	settings dbMeta
+	rules    *alertRules // parsed alerts of settings, built on the first write that needs them
+
+	alerts map[string]AlertHandler // handlers registered in this process, guarded by mu held exclusively
+
+	alertMu sync.Mutex
+	queued  []queuedAlert // alerts matched by writes, delivered once the write lock is released
+}
+
+var states = struct {
+	sync.Mutex
+	m map[string]*dbState
+}{m: make(map[string]*dbState)}
+
+// stateFor returns the shared state of db, keyed by its absolute path
+func stateFor(db string) *dbState {
+	path, err := filepath.Abs(db)
+	if err != nil {
+		path = filepath.Clean(db)
+	}
+	states.Lock()
+	defer states.Unlock()
+	s, ok := states.m[path]
+	if !ok {
+		s = &dbState{path: path}
+		states.m[path] = s
+	}
+	return s
+}
+
+// meta returns the settings of the database, read again only when <db>.meta changed. The
+// result is shared and must not be modified.
+func (s *dbState) meta() (dbMeta, error) {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.cachedMeta()
+}
+
+// cachedMeta is meta for a caller holding metaMu, reading the settings again drops
+// everything derived from them
+func (s *dbState) cachedMeta() (dbMeta, error) {
+	info, err := os.Stat(metaPath(s.path))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return dbMeta{}, err
+	}
+	if s.metaOK && sameInfo(info, s.metaInfo) {
+		return s.settings, nil
+	}
+	meta, err := loadMeta(s.path)
+	if err != nil {
+		return meta, err
+	}
+	s.metaInfo, s.settings, s.metaOK, s.rules = info, meta, true, nil
+	return meta, nil
+}
+
+// dropMeta forgets the cached settings after they were saved
+func (s *dbState) dropMeta() {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	s.metaInfo, s.settings, s.metaOK, s.rules = nil, dbMeta{}, false, nil
+}
+
+// sameInfo reports whether a and b, either nil for a missing file, describe the same
+// unchanged file
+func sameInfo(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime()) && a.Size() == b.Size()
+}
+
+// lockDB takes the in-process lock of db followed by its cross-process file lock, shared
+// unless exclusive is set, and returns the function releasing both
+func lockDB(db string, exclusive bool, timeout time.Duration) (func(), error) {
+	s := stateFor(db)
+	lock, unlock := s.mu.RLock, s.mu.RUnlock
+	if exclusive {
+		lock, unlock = s.mu.Lock, s.mu.Unlock
+	}
+	lock()
+	fl, err := acquireFileLock(s.path, exclusive, timeout)
+	if err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		fl.release()
+		unlock()
+	}, nil
+}
+
+// readLock takes the shared lock of db
+func (tar *Tardigrade) readLock(db string) (func(), error) {
+	return lockDB(db, false, tar.LockTimeout)
+}
+
+// writeLock takes the exclusive lock of db, then replays the log entries a crashed writer
+// left behind so the write does not go on top of them. Releasing it delivers the alerts
+// matched meanwhile.
+func (tar *Tardigrade) writeLock(db string) (func(), error) {
+	unlock, err := lockDB(db, true, tar.LockTimeout)
+	if err != nil {
+		return nil, err
+	}
+	s := stateFor(db)
+	if err := s.syncWAL(tar.Durability); err != nil {
+		unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		deliverAlerts(s)
+	}, nil
+}
+
+// mustLock locks db for the original methods, failing to lock is fatal like any other CheckError
+func (tar *Tardigrade) mustLock(op string, db string, exclusive bool) func() {
+	lock := tar.readLock
+	if exclusive {
+		lock = tar.writeLock
+	}
+	unlock, err := lock(db)
+	CheckError(op, newError(op, db, 0, err))
+	return unlock
+}
@@ -0,0 +1,564 @@
+package tardigrade
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Durability selects when written data is forced to stable storage
+type Durability int
+
+const (
+	// SyncOnClose flushes appends when the file is closed, after every path-based call and on
+	// DB.Close for handles. Rewrites are flushed before they replace the database.
+	SyncOnClose Durability = iota
+	// SyncNone never flushes, rewrites are still atomic but may be lost on power failure
+	SyncNone
+	// SyncOnWrite flushes every append and every rewrite, including the directory entry
+	SyncOnWrite
+)
+
+// recordHead holds the fields shared by every record layout stored in a database
+type recordHead struct {
+	Id      int    `json:"id"`
+	Key     string `json:"key"`
+	Deleted bool   `json:"deleted,omitempty"` // tombstone written by append storage
+}
+
+// view is what a call sees of a database: each walks the live lines in order, get, keys and
+// last answer from the directory of the database and are nil when there is none
+type view struct {
+	each func(fn func(line string) error) error
+	get  func(id int) (string, error)
+	keys func(key string) ([]int, error)
+	last func() (int, error)
+	// where returns the lines a field index selects for conds, an empty index name when no
+	// index covers them
+	where func(conds []Condition) (lines []string, index string, err error)
+	// text ranks the records against q from the full-text index, false when it is off
+	text func(a *analysis, q textQuery) (page textPage, ok bool, err error)
+	// suggest returns the values of field starting with prefix from a sorted dictionary, false
+	// when there is none for field
+	suggest func(field, prefix string) (s []Suggestion, ok bool, err error)
+}
+
+// errStop is returned by scan callbacks that found what they were looking for
+var errStop = errors.New("stop scan")
+
+// statDB returns the size of db or ErrDBMissing when the file does not exist
+func statDB(db string) (int64, error) {
+	info, err := os.Stat(db)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, ErrDBMissing
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// scanLines calls fn for every line read from r, fn can stop the scan early by returning errStop
+func scanLines(r io.Reader, fn func(line string) error) error {
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		if err := fn(sc.Text()); err != nil {
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// scanDB calls scanLines over the content of db
+func scanDB(db string, fn func(line string) error) error {
+	size, err := statDB(db)
+	if err != nil {
+		return err
+	}
+	if size <= 1 {
+		return ErrDBEmpty
+	}
+	file, err := os.Open(db)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return scanLines(file, fn)
+}
+
+// pathView returns a view reading db from disk on every call
+func pathView(db string) view {
+	kd := stateFor(db).idIndex()
+	open := func(fn func(v view) error) error {
+		if _, err := statDB(db); err != nil {
+			return err
+		}
+		file, err := os.Open(db)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return fn(kd.view(file))
+	}
+	return view{
+		each: func(fn func(line string) error) error {
+			return open(func(v view) error { return v.each(fn) })
+		},
+		get: func(id int) (line string, err error) {
+			err = open(func(v view) error {
+				line, err = v.get(id)
+				return err
+			})
+			return line, err
+		},
+		keys: func(key string) (ids []int, err error) {
+			err = open(func(v view) error {
+				ids, err = v.keys(key)
+				return err
+			})
+			return ids, err
+		},
+		last: func() (id int, err error) {
+			err = open(func(v view) error {
+				id, err = v.last()
+				return err
+			})
+			return id, err
+		},
+		where: func(conds []Condition) (lines []string, index string, err error) {
+			err = open(func(v view) error {
+				lines, index, err = v.where(conds)
+				return err
+			})
+			return lines, index, err
+		},
+		text: func(a *analysis, q textQuery) (page textPage, ok bool, err error) {
+			err = open(func(v view) error {
+				page, ok, err = v.text(a, q)
+				return err
+			})
+			return page, ok, err
+		},
+		suggest: func(field, prefix string) (s []Suggestion, ok bool, err error) {
+			err = open(func(v view) error {
+				s, ok, err = v.suggest(field, prefix)
+				return err
+			})
+			return s, ok, err
+		},
+	}
+}
+
+// findLine returns the last line holding record id, comparing the decoded id of each line
+// when the view has no directory to ask
+func findLine(v view, id int) (string, error) {
+	if v.get != nil {
+		return v.get(id)
+	}
+	line := ""
+	err := v.each(func(l string) error {
+		var head recordHead
+		if json.Unmarshal([]byte(l), &head) == nil && head.Id == id && !head.Deleted {
+			line = l
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(line) == 0 {
+		return "", ErrNotFound
+	}
+	return line, nil
+}
+
+// findKey returns the ids of the records stored under key in ascending order
+func findKey(v view, key string) ([]int, error) {
+	if v.keys != nil {
+		return v.keys(key)
+	}
+	var ids []int
+	err := v.each(func(l string) error {
+		var head recordHead
+		if json.Unmarshal([]byte(l), &head) == nil && head.Key == key && !head.Deleted {
+			ids = append(ids, head.Id)
+		}
+		return nil
+	})
+	sort.Ints(ids)
+	return ids, err
+}
+
+// lastID returns the id of the last record, 0 when the database is missing or empty
+func lastID(v view) (int, error) {
+	if v.last != nil {
+		id, err := v.last()
+		if errors.Is(err, ErrDBMissing) {
+			return 0, nil
+		}
+		return id, err
+	}
+	last := ""
+	err := v.each(func(l string) error {
+		if len(strings.TrimSpace(l)) > 0 {
+			last = l
+		}
+		return nil
+	})
+	if errors.Is(err, ErrDBMissing) || errors.Is(err, ErrDBEmpty) || last == "" {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var head recordHead
+	if err := json.Unmarshal([]byte(last), &head); err != nil {
+		return 0, corrupt(err)
+	}
+	return head.Id, nil
+}
+
+// ensureDB creates db when it does not exist yet
+func (tar *Tardigrade) ensureDB(db string) error {
+	if tar.fileExists(db) {
+		return nil
+	}
+	file, err := os.OpenFile(db, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// appendLine appends an encoded record to db
+func (tar *Tardigrade) appendLine(db string, line []byte) error {
+	if kd := stateFor(db).keydir(); kd != nil {
+		return tar.appendVersion(kd, db, line)
+	}
+	file, err := os.OpenFile(db, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	if tar.Durability != SyncNone {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// appendVersion appends a version to an append storage database through its key directory
+func (tar *Tardigrade) appendVersion(kd *keydir, db string, line []byte) error {
+	file, err := os.OpenFile(db, os.O_RDWR, 0644)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrDBMissing
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := kd.append(file, line); err != nil {
+		file.Close()
+		return err
+	}
+	if tar.Durability != SyncNone {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	return file.Close()
+}
+
+// storeVersion writes the new version of a record, a modification or a tombstone. Append
+// storage appends it, otherwise edit rewrites the whole database.
+func (tar *Tardigrade) storeVersion(db string, version []byte, edit func(lines []string) ([]string, error)) error {
+	if kd := stateFor(db).keydir(); kd != nil {
+		return tar.appendVersion(kd, db, version)
+	}
+	return rewriteDB(db, tar.Durability, edit)
+}
+
+// openDB opens db for the original readers, in append storage they read the live records
+// as if the file only held those
+func (tar *Tardigrade) openDB(db string) (io.ReadCloser, error) {
+	file, err := os.Open(db)
+	if err != nil {
+		return nil, err
+	}
+	kd := stateFor(db).keydir()
+	if kd == nil {
+		return file, nil
+	}
+	r, w := io.Pipe()
+	go func() {
+		err := kd.view(file).each(func(line string) error {
+			_, err := io.WriteString(w, line+"\n")
+			return err
+		})
+		file.Close()
+		if errors.Is(err, ErrDBEmpty) {
+			err = nil
+		}
+		w.CloseWithError(err)
+	}()
+	return r, nil
+}
+
+// sizeDB returns the size of the content openDB reads, 0 when db cannot be read
+func (tar *Tardigrade) sizeDB(db string) int64 {
+	size, err := statDB(db)
+	if err != nil {
+		return 0
+	}
+	kd := stateFor(db).keydir()
+	if kd == nil {
+		return size
+	}
+	file, err := os.Open(db)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	if err := kd.update(file); err != nil {
+		return 0
+	}
+	return kd.liveSize()
+}
+
+// insert appends the record built by build under the next free id, the caller holds the
+// write lock of db
+func (tar *Tardigrade) insert(op, db, key string, build func(id int) interface{}) (int, error) {
+	if err := tar.ensureDB(db); err != nil {
+		return 0, newError(op, db, 0, err)
+	}
+	v := pathView(db)
+	if err := checkKey(db, v, key, 0); err != nil {
+		return 0, newError(op, db, 0, err)
+	}
+	id, err := lastID(v)
+	if err != nil {
+		return 0, newError(op, db, 0, err)
+	}
+	id++
+	line, err := tar.MyMarshal(build(id))
+	if err != nil {
+		return 0, newError(op, db, id, err)
+	}
+	err = tar.logged(db, "add", id, line, func() error {
+		return tar.appendLine(db, line)
+	})
+	if err != nil {
+		return 0, newError(op, db, id, err)
+	}
+	return id, nil
+}
+
+// replace stores record as the new version of record id stored under key and returns the
+// new raw line, the caller holds the write lock of db
+func (tar *Tardigrade) replace(op, db string, id int, key string, record interface{}) (string, error) {
+	v := pathView(db)
+	before, err := findLine(v, id)
+	if err != nil {
+		return "", newError(op, db, id, err)
+	}
+	if err := checkKey(db, v, key, id); err != nil {
+		return "", newError(op, db, id, err)
+	}
+	out, err := tar.MyMarshal(record)
+	if err != nil {
+		return "", newError(op, db, id, err)
+	}
+	after := strings.TrimSpace(string(out))
+
+	err = tar.logged(db, "modify", id, out, func() error {
+		return tar.storeVersion(db, out, replaceLine(before, after))
+	})
+	if err != nil {
+		return "", newError(op, db, id, err)
+	}
+	return after, nil
+}
+
+// erase removes record id and returns the raw line it had, the caller holds the write lock
+// of db
+func (tar *Tardigrade) erase(op, db string, id int) (string, error) {
+	line, err := findLine(pathView(db), id)
+	if err != nil {
+		return "", newError(op, db, id, err)
+	}
+	err = tar.logged(db, "remove", id, nil, func() error {
+		return tar.storeVersion(db, tombstone(id), removeLine(line))
+	})
+	if err != nil {
+		return "", newError(op, db, id, err)
+	}
+	return line, nil
+}
+
+// eraseAll removes the records ids with a single write, one rewrite or one append of their
+// tombstones, logged as one transaction. The caller holds the write lock of db.
+func (tar *Tardigrade) eraseAll(op, db string, ids []int) error {
+	drop, err := prepareRemoval(pathView(db), ids)
+	if err != nil {
+		return newError(op, db, 0, err)
+	}
+	err = tar.loggedTx(db, drop.entries, func() error {
+		return tar.storeVersion(db, drop.tombstones, removeLines(drop.lines))
+	})
+	return newError(op, db, 0, err)
+}
+
+// removal holds what removing a set of records writes
+type removal struct {
+	lines      map[string]bool // current lines of the records
+	tombstones []byte
+	entries    []walEntry
+}
+
+// prepareRemoval prepares the removal of the records ids found in v
+func prepareRemoval(v view, ids []int) (removal, error) {
+	drop := removal{lines: make(map[string]bool, len(ids))}
+	for _, id := range ids {
+		line, err := findLine(v, id)
+		if err != nil {
+			return drop, err
+		}
+		drop.lines[line] = true
+		drop.tombstones = append(drop.tombstones, tombstone(id)...)
+		drop.entries = append(drop.entries, walEntry{Op: "remove", Id: id})
+	}
+	return drop, nil
+}
+
+// rewriteDB atomically replaces the content of db with the lines returned by fn
+func rewriteDB(db string, durability Durability, fn func(lines []string) ([]string, error)) error {
+	input, err := os.ReadFile(db)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrDBMissing
+	}
+	if err != nil {
+		return err
+	}
+	lines, err := fn(splitLines(input))
+	if err != nil {
+		return err
+	}
+	return replaceDB(db, input, joinLines(lines), durability)
+}
+
+// replaceDB replaces the content of db like replaceFile. The id index follows the lines from
+// old, the content being replaced, to their new offsets. Without old, or when the index did
+// not describe it, the index is dropped and the next lookup rebuilds it.
+func replaceDB(db string, old, content []byte, durability Durability) error {
+	before, err := os.Stat(db)
+	if err != nil {
+		before = nil
+	}
+	if err := replaceFile(db, content, durability); err != nil {
+		return err
+	}
+	s := stateFor(db)
+	s.kdMu.Lock()
+	idx := s.idx
+	s.kdMu.Unlock()
+	if old != nil && before != nil && idx != nil && s.keydir() == nil && idx.moved(before, old, content) {
+		return nil
+	}
+	return removeIndex(db)
+}
+
+// replaceFile writes content to a temporary file next to db and renames it over db, so a
+// crash leaves either the old or the new database but never a truncated one
+func replaceFile(db string, content []byte, durability Durability) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(db); err == nil {
+		mode = info.Mode().Perm()
+	}
+	dir := filepath.Dir(db)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(db)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if durability != SyncNone {
+		if err := tmp.Sync(); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), db); err != nil {
+		return err
+	}
+	if durability == SyncOnWrite {
+		return syncDir(dir)
+	}
+	return nil
+}
+
+// syncDir flushes the directory entry of a renamed file, Windows cannot sync directories
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// removeLine returns an edit for rewriteDB dropping every line equal to line
+func removeLine(line string) func(lines []string) ([]string, error) {
+	return removeLines(map[string]bool{line: true})
+}
+
+// removeLines returns an edit for rewriteDB dropping every line in drop
+func removeLines(drop map[string]bool) func(lines []string) ([]string, error) {
+	return func(lines []string) ([]string, error) {
+		kept := lines[:0]
+		for _, l := range lines {
+			if !drop[l] {
+				kept = append(kept, l)
+			}
+		}
+		return kept, nil
+	}
+}
+
+// replaceLine returns an edit for rewriteDB swapping every line equal to before with after
+func replaceLine(before, after string) func(lines []string) ([]string, error) {
+	return func(lines []string) ([]string, error) {
+		for i, line := range lines {
+			if line == before {
+				lines[i] = after
+			}
+		}
+		return lines, nil
+	}
+}
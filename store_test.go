@@ -0,0 +1,182 @@
+package tardigrade
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRewriteKeepsIdIndex(t *testing.T) {
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "rewrite.db")
+	tar.CreateDB(db)
+	if err := tar.CreateIndex(db, "city"); err != nil {
+		t.Fatal(err)
+	}
+	for i, city := range []string{"Leeds", "York", "Leeds"} {
+		if _, err := tar.AddFlexFieldE(string(rune('a'+i)), map[string]string{"city": city}, db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rows, err := tar.FindFlexWhere("city", "=", "Leeds", db); err != nil || len(rows) != 2 {
+		t.Fatalf("FindFlexWhere = %+v, %v", rows, err)
+	}
+	idx := stateFor(db).idIndex()
+	keys := reflect.ValueOf(idx.keys).Pointer()
+
+	if _, err := tar.ModifyFlexFieldE(1, "a", map[string]string{"city": "York"}, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tar.AddFlexFieldE("d", map[string]string{"city": "Leeds"}, db); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tar.RemoveFieldE(2, db); err != nil {
+		t.Fatal(err)
+	}
+	if reflect.ValueOf(idx.keys).Pointer() != keys {
+		t.Fatal("the id index was rebuilt instead of following the rewrites")
+	}
+	if _, err := os.Stat(idxPath(db)); err != nil {
+		t.Fatalf("id index not saved: %v", err)
+	}
+
+	check := func() {
+		t.Helper()
+		rows, err := tar.FindFlexWhere("city", "=", "Leeds", db)
+		if err != nil || len(rows) != 2 || rows[0].Id != 3 || rows[1].Id != 4 {
+			t.Fatalf("FindFlexWhere Leeds = %+v, %v", rows, err)
+		}
+		rows, err = tar.FindFlexWhere("city", "=", "York", db)
+		if err != nil || len(rows) != 1 || rows[0].Id != 1 {
+			t.Fatalf("FindFlexWhere York = %+v, %v", rows, err)
+		}
+		if got := tar.SelectFlexByID(4, "raw", db); got != `{"id":4,"key":"d","fields":{"city":"Leeds"}}` {
+			t.Fatalf("SelectFlexByID(4) = %s", got)
+		}
+	}
+	check()
+	forget(db)
+	check()
+}
+
+func TestIdIndexSeesRewriteInPlace(t *testing.T) {
+	for _, keepTime := range []bool{false, true} {
+		tar := &Tardigrade{}
+		db := filepath.Join(t.TempDir(), "inplace.db")
+		tar.CreateDB(db)
+		for _, key := range []string{"a", "b"} {
+			if _, err := tar.AddFieldE(key, "1", db); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := tar.SelectByIDE(2, "raw", db); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// another tool rewrites the file in place, keeping its inode and growing it
+		content := "{\"id\":1,\"key\":\"a\",\"data\":\"longer\"}\n{\"id\":2,\"key\":\"b\",\"data\":\"longer\"}\n"
+		if err := os.WriteFile(db, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if keepTime {
+			if err := os.Chtimes(db, info.ModTime(), info.ModTime()); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for id, key := range map[int]string{1: "a", 2: "b"} {
+			got, err := tar.SelectByIDE(id, "raw", db)
+			if err != nil || got != `{"id":`+string(rune('0'+id))+`,"key":"`+key+`","data":"longer"}` {
+				t.Fatalf("keep mtime %v: SelectByIDE(%d) = %s, %v", keepTime, id, got, err)
+			}
+		}
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	db := filepath.Join(dir, "safe.db")
+	if err := os.WriteFile(db, []byte("old\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	reader, err := os.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	if err := replaceFile(db, []byte("new\n"), SyncOnWrite); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(db); string(content) != "new\n" {
+		t.Fatalf("content = %q", content)
+	}
+	if info, err := os.Stat(db); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("mode = %v, %v, want 0600 kept", info.Mode(), err)
+	}
+	// the new file is renamed over the old one, a reader still holding it sees it whole
+	if content, err := io.ReadAll(reader); err != nil || string(content) != "old\n" {
+		t.Fatalf("open reader sees %q, %v", content, err)
+	}
+
+	// a rename that fails leaves the target alone and no temporary file behind
+	target := filepath.Join(dir, "dir.db")
+	if err := os.MkdirAll(filepath.Join(target, "inside"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := replaceFile(target, []byte("new\n"), SyncOnWrite); err == nil {
+		t.Fatal("replaceFile over a directory succeeded")
+	}
+	if info, err := os.Stat(target); err != nil || !info.IsDir() {
+		t.Fatalf("target after the failed replace: %v, %v", info, err)
+	}
+	checkNoTemp(t, dir)
+}
+
+func TestRewriteDBFailureKeepsOriginal(t *testing.T) {
+	tar := &Tardigrade{}
+	dir := t.TempDir()
+	db := filepath.Join(dir, "keep.db")
+	tar.CreateDB(db)
+	for _, key := range []string{"a", "b"} {
+		if _, err := tar.AddFieldE(key, "1", db); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before, err := os.ReadFile(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	boom := errors.New("boom")
+	err = rewriteDB(db, SyncOnWrite, func(lines []string) ([]string, error) {
+		return lines[:1], boom
+	})
+	if !errors.Is(err, boom) {
+		t.Fatalf("rewriteDB = %v, want the edit error", err)
+	}
+	if after, _ := os.ReadFile(db); string(after) != string(before) {
+		t.Fatalf("failed rewrite changed the file:\n%s", after)
+	}
+	if err := rewriteDB(db, SyncOnWrite, func(lines []string) ([]string, error) { return lines[1:], nil }); err != nil {
+		t.Fatal(err)
+	}
+	if after, _ := os.ReadFile(db); string(after) != "{\"id\":2,\"key\":\"b\",\"data\":\"1\"}\n" {
+		t.Fatalf("rewritten file = %q", after)
+	}
+	checkNoTemp(t, dir)
+}
+
+// checkNoTemp fails when a temporary file of replaceFile is left in dir
+func checkNoTemp(t *testing.T, dir string) {
+	t.Helper()
+	left, err := filepath.Glob(filepath.Join(dir, ".*.tmp*"))
+	if err != nil || len(left) != 0 {
+		t.Fatalf("temporary files left behind: %v, %v", left, err)
+	}
+}
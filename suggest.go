@@ -0,0 +1,125 @@
+package tardigrade
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Suggestion is a completion of a prefix and the number of live records holding it
+type Suggestion struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Suggest returns up to limit (0 for all) completions of prefix among the keys of db (field
+// "key") or the values of a flex field, most frequent first. Keys and fields with an index of
+// their own are completed from a sorted dictionary kept up to date by every write, other
+// fields by scanning the file.
+// Usage: completions, err := tar.Suggest("user:", "key", 10, "users.db")
+func (tar *Tardigrade) Suggest(prefix, field string, limit int, db string) ([]Suggestion, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, newError("Suggest", db, 0, err)
+	}
+	defer unlock()
+
+	s, err := suggest(pathView(db), prefix, field, limit)
+	return s, newError("Suggest", db, 0, err)
+}
+
+// suggest completes prefix among the values of field in v, from its dictionary when it has one
+func suggest(v view, prefix, field string, limit int) ([]Suggestion, error) {
+	if field == "" {
+		return nil, fmt.Errorf("%w: suggestion without a field", ErrInvalidQuery)
+	}
+	if v.suggest != nil {
+		s, ok, err := v.suggest(field, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return topSuggestions(s, limit), nil
+		}
+	}
+	counts := make(map[string]int)
+	err := v.each(func(line string) error {
+		if len(strings.TrimSpace(line)) == 0 {
+			return nil
+		}
+		row, err := queryRow(line)
+		if err != nil {
+			return err
+		}
+		if value, ok := fieldValue(row, field); ok && strings.HasPrefix(value, prefix) {
+			counts[value]++
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s := make([]Suggestion, 0, len(counts))
+	for value, n := range counts {
+		s = append(s, Suggestion{Value: value, Count: n})
+	}
+	return topSuggestions(s, limit), nil
+}
+
+// topSuggestions orders s by count then value and keeps the first limit, all when 0
+func topSuggestions(s []Suggestion, limit int) []Suggestion {
+	sort.Slice(s, func(i, j int) bool {
+		if s[i].Count != s[j].Count {
+			return s[i].Count > s[j].Count
+		}
+		return s[i].Value < s[j].Value
+	})
+	if limit > 0 && limit < len(s) {
+		s = s[:limit]
+	}
+	return s
+}
+
+// suggest returns the values starting with prefix of the key index (field "key") or of the
+// index on field alone, false when there is neither. The caller holds kd.mu.
+func (kd *keydir) suggest(field, prefix string) ([]Suggestion, bool) {
+	postings := kd.keys
+	if field != "key" {
+		indexed := false
+		for _, def := range kd.indexes {
+			indexed = indexed || len(def) == 1 && def[0] == field
+		}
+		if !indexed {
+			return nil, false
+		}
+		postings = kd.postings[field]
+	}
+	terms, ok := kd.terms[field]
+	if !ok {
+		terms = make([]string, 0, len(postings))
+		for value := range postings {
+			terms = append(terms, value)
+		}
+		sort.Strings(terms)
+		if kd.terms == nil {
+			kd.terms = make(map[string][]string)
+		}
+		kd.terms[field] = terms
+	}
+	var s []Suggestion
+	for i := sort.SearchStrings(terms, prefix); i < len(terms) && strings.HasPrefix(terms[i], prefix); i++ {
+		s = append(s, Suggestion{Value: terms[i], Count: len(postings[terms[i]])})
+	}
+	return s, true
+}
+
+// Suggest returns completions of prefix among the keys or the values of field, see
+// Tardigrade.Suggest
+func (d *DB) Suggest(prefix, field string, limit int) ([]Suggestion, error) {
+	var s []Suggestion
+	err := d.read("Suggest", func(v view) (err error) {
+		s, err = suggest(v, prefix, field, limit)
+		return newError("Suggest", d.path, 0, err)
+	})
+	return s, err
+}
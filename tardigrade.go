@@ -7,10 +7,10 @@ import (
 	"bufio"
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
-	"os"
 	"runtime"
 	"strconv"
 	"strings"
@@ -39,180 +39,147 @@ func (tar *Tardigrade) GetOS() rune {
 
 // AddField take in (key, sprint) (data, string) and add to tardigrade.db
 func (tar *Tardigrade) AddField(key, data string, db string) bool {
-
-	if !tar.fileExists(db) {
-		tar.CreateDB(db)
-		if !tar.fileExists(db) {
-			return false
-		}
+	_, err := tar.AddFieldE(key, data, db)
+	if err != nil && (!tar.fileExists(db) || errors.Is(err, ErrDuplicateKey)) {
+		return false
 	}
+	CheckError("AddField", err)
+	return true
+}
 
-	id := tar.UniqueID(db) + 1
-	var getStruct = MyStruct{}
-	getStruct.Id = id
-	getStruct.Key = key
-	getStruct.Data = data
-
-	response, err := tar.MyMarshal(getStruct)
-	CheckError("Marshal", err)
-
-	file, err := os.OpenFile(db, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0644)
-	CheckError("O_APPEND", err)
-	//file.WriteString("\n")
-	file.Write(response)
+// AddFieldE appends a new record to db, creating it if needed, and returns the id assigned to it
+func (tar *Tardigrade) AddFieldE(key, data string, db string) (int, error) {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return 0, newError("AddField", db, 0, err)
+	}
+	defer unlock()
 
-	return true
+	return tar.insert("AddField", db, key, func(id int) interface{} {
+		return MyStruct{Id: id, Key: key, Data: data}
+	})
 }
 
 // RemoveField function takes an unique field id as an input and remove the matching field entry
 func (tar *Tardigrade) RemoveField(id int, db string) (string, bool) {
+	line, err := tar.RemoveFieldE(id, db)
+	if err != nil {
+		return legacyMessage("RemoveField", db, id, err), false
+	}
+	return line, true
+}
 
-	status := true
-	msg := ""
-
-	src := db
-	if !tar.fileExists(src) {
-		return (fmt.Sprintf("Database %s missing!", src)), false
-	} else {
-		fInfo, _ := os.Stat(src)
-		fsize := fInfo.Size()
-		if fsize <= 1 {
-			return (fmt.Sprintf("Database %s is empty!", src)), false
-		} else {
-			line := tar.SelectByID(id, "raw", db)
-
-			if strings.Contains(line, "Record") && strings.Contains(line, "empty") {
-				status = false
-				msg = line
-			} else {
-				msg = line
-				fpath := src
-				f, err := os.Open(fpath)
-				CheckError("RemoveField(1)", err)
-
-				var bs []byte
-				buf := bytes.NewBuffer(bs)
-
-				scanner := bufio.NewScanner(f)
-				for scanner.Scan() {
-					if scanner.Text() != line {
-						_, err := buf.Write(scanner.Bytes())
-						CheckError("RemoveField(2)", err)
-						_, err = buf.WriteString("\n")
-						CheckError("RemoveField(3)", err)
-					}
-				}
-				if err := scanner.Err(); err != nil {
-					CheckError("RemoveField(4)", err)
-				}
-
-				err = os.WriteFile(fpath, buf.Bytes(), 0666)
-				CheckError("RemoveField(5)", err)
-				f.Close()
-			}
-		}
+// RemoveFieldE removes record id from db and returns the raw line that was removed
+func (tar *Tardigrade) RemoveFieldE(id int, db string) (string, error) {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return "", newError("RemoveField", db, id, err)
 	}
-	return msg, status
+	defer unlock()
+
+	return tar.erase("RemoveField", db, id)
 }
 
 // SelectByID function returns an entry string for a specific id in all formats [ raw | json | id | key | value ]
 func (tar *Tardigrade) SelectByID(id int, f string, db string) string {
+	result, err := tar.SelectByIDE(id, f, db)
+	if errors.Is(err, ErrInvalidFormat) {
+		return "Invalid format provided!"
+	}
+	if err != nil {
+		return legacyMessage("SelectByID", db, id, err)
+	}
+	return result
+}
 
-	regx := fmt.Sprintf("\"id\":%v,", id)
+// SelectByIDE returns record id from db in one of the formats [ raw | json | id | key | value ]
+func (tar *Tardigrade) SelectByIDE(id int, f string, db string) (string, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return "", newError("SelectByID", db, id, err)
+	}
+	defer unlock()
 
-	result := ""
-	src := db
-	if !tar.fileExists(src) {
-		return (fmt.Sprintf("Database %s missing!", src))
-	} else {
-		fInfo, _ := os.Stat(src)
-		fsize := fInfo.Size()
-		if fsize <= 1 {
-			return (fmt.Sprintf("Database %s is empty!", src))
-		} else {
-			line := ""
-			file, err := os.Open(src)
-			CheckError("SelectByID(1)", err)
-			defer file.Close()
-			var r io.Reader = file
-			sc := bufio.NewScanner(r)
-			for sc.Scan() {
-				if strings.Contains(sc.Text(), regx) {
-					line = sc.Text()
-				}
-			}
-			if len(line) == 0 {
-				return (fmt.Sprintf("Record %v is empty!", id))
-			} else {
-				var s MyStruct
-				in := []byte(line)
-				err = json.Unmarshal(in, &s)
-				CheckError("SelectByID(2)", err)
-
-				if f == "json" {
-					out, _ := tar.MyIndent(&s, "", "  ")
-					result = string(out)
-				} else if f == "value" {
-					result = string(s.Data)
-				} else if f == "raw" {
-					result = line
-				} else if f == "key" {
-					result = string(s.Key)
-				} else if f == "id" {
-					result = strconv.Itoa(s.Id)
-				} else {
-					result = "Invalid format provided!"
-				}
-			}
-		}
+	line, err := findLine(pathView(db), id)
+	if err != nil {
+		return "", newError("SelectByID", db, id, err)
 	}
-	return result
+	result, err := tar.formatRecord(line, f)
+	if err != nil {
+		return "", newError("SelectByID", db, id, err)
+	}
+	return result, nil
 }
 
-// ModifyField function takes ID, Key, Value and update row = ID with new information provided
-func (tar *Tardigrade) ModifyField(id int, k, v string, db string) (msg string, status bool) {
+// formatRecord decodes a MyStruct line and renders it in format f
+func (tar *Tardigrade) formatRecord(line string, f string) (string, error) {
+	var s MyStruct
+	if err := json.Unmarshal([]byte(line), &s); err != nil {
+		return "", corrupt(err)
+	}
+	switch f {
+	case "json":
+		out, _ := tar.MyIndent(&s, "", "  ")
+		return string(out), nil
+	case "value":
+		return s.Data, nil
+	case "raw":
+		return line, nil
+	case "key":
+		return s.Key, nil
+	case "id":
+		return strconv.Itoa(s.Id), nil
+	}
+	return "", fmt.Errorf("%w: %q", ErrInvalidFormat, f)
+}
 
-	status = true
-	src := db
-	if !tar.fileExists(src) {
-		return (fmt.Sprintf("Database %s missing!", src)), status
-	} else {
+// decodeRecord finds and decodes record id
+func decodeRecord(v view, id int) (MyStruct, error) {
+	var s MyStruct
+	line, err := findLine(v, id)
+	if err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal([]byte(line), &s); err != nil {
+		return s, corrupt(err)
+	}
+	return s, nil
+}
 
-		before := tar.SelectByID(id, "raw", db)
-		if strings.Contains(before, "Record") && strings.Contains(before, "empty!") {
-			status = false
-			return before, status
-		}
-		var s MyStruct
-		s.Id = id
-		s.Key = k
-		s.Data = v
-		out, _ := tar.MyMarshal(&s)
-		after := string(out)
-
-		input, err := os.ReadFile(src)
-		CheckError("ModifyField(1)", err)
-		lines := strings.Split(string(input), "\n")
-
-		for i, line := range lines {
-			if strings.Contains(line, before) {
-				lines[i] = after
-			}
-		}
-		output := strings.Join(lines, "\n")
-		err = os.WriteFile(src, []byte(output), 0644)
-		CheckError("ModifyField(2)", err)
+// ModifyField function takes ID, Key, Value and update row = ID with new information provided
+func (tar *Tardigrade) ModifyField(id int, k, v string, db string) (msg string, status bool) {
+	msg, err := tar.ModifyFieldE(id, k, v, db)
+	switch {
+	case errors.Is(err, ErrDBMissing), errors.Is(err, ErrDBEmpty):
+		return legacyMessage("ModifyField", db, id, err), true
+	case err != nil:
+		return legacyMessage("ModifyField", db, id, err), false
+	}
+	return msg, true
+}
 
-		msg = tar.SelectByID(id, "raw", db)
-		return msg, status
+// ModifyFieldE replaces the key and data of record id and returns the new raw line
+func (tar *Tardigrade) ModifyFieldE(id int, k, v string, db string) (string, error) {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return "", newError("ModifyField", db, id, err)
 	}
+	defer unlock()
+
+	return tar.replace("ModifyField", db, id, k, &MyStruct{Id: id, Key: k, Data: v})
 }
 
 // CountSize will return number of rows in the tardigrade.db
 func (tar *Tardigrade) CountSize(db string) int {
+	defer tar.mustLock("CountSize", db, false)()
+	return tar.countSize(db)
+}
+
+// countSize counts the rows of db, the caller must hold its lock
+func (tar *Tardigrade) countSize(db string) int {
 
 	src := db
-	f, err := os.Open(src)
+	f, err := tar.openDB(src)
 	CheckError("CountSize(1)", err)
 
 	defer f.Close()
@@ -227,7 +194,7 @@ func (tar *Tardigrade) CountSize(db string) int {
 		}
 		var buffPosition int
 		for {
-			i := bytes.IndexByte(buf[buffPosition:], lineBreak)
+			i := bytes.IndexByte(buf[buffPosition:bufferSize], lineBreak)
 			if i == -1 || bufferSize == buffPosition {
 				break
 			}
@@ -238,8 +205,7 @@ func (tar *Tardigrade) CountSize(db string) int {
 			break
 		}
 	}
-	fInfo, _ := os.Stat(src)
-	fsize := fInfo.Size()
+	fsize := tar.sizeDB(src)
 	if fsize > 2 && count == 0 {
 		count = 1
 	}
@@ -263,6 +229,7 @@ func (tar *Tardigrade) UniqueID(db string) int {
 // Example: (0.1.2)
 // specify number of fields X and format [ raw | json | id | key | value ] to return FirstXFields(2)
 func (tar *Tardigrade) FirstXFields(count int, format string, db string) (string, []byte) {
+	defer tar.mustLock("FirstXFields", db, false)()
 
 	var allRecord []byte
 
@@ -270,8 +237,7 @@ func (tar *Tardigrade) FirstXFields(count int, format string, db string) (string
 	if !tar.fileExists(src) {
 		return format, []byte(fmt.Sprintf("Database %s missing!", src))
 	} else {
-		fInfo, _ := os.Stat(src)
-		fsize := fInfo.Size()
+		fsize := tar.sizeDB(src)
 		if fsize <= 1 {
 			return format, []byte(fmt.Sprintf("Database %s is empty!", src))
 		} else {
@@ -283,7 +249,7 @@ func (tar *Tardigrade) FirstXFields(count int, format string, db string) (string
 			end := count
 			line := ""
 
-			file, err := os.Open(src)
+			file, err := tar.openDB(src)
 			CheckError("FirstXFields(1)", err)
 
 			defer file.Close()
@@ -317,6 +283,7 @@ func (tar *Tardigrade) FirstXFields(count int, format string, db string) (string
 // Example:
 // specify number of fields to return LastXFields(2)
 func (tar *Tardigrade) LastXFields(count int, format string, db string) (string, []byte) {
+	defer tar.mustLock("LastXFields", db, false)()
 
 	var allRecord []byte
 
@@ -324,8 +291,7 @@ func (tar *Tardigrade) LastXFields(count int, format string, db string) (string,
 	if !tar.fileExists(src) {
 		return format, []byte(fmt.Sprintf("Database %s missing!", src))
 	} else {
-		fInfo, _ := os.Stat(src)
-		fsize := fInfo.Size()
+		fsize := tar.sizeDB(src)
 		if fsize <= 1 {
 			return format, []byte(fmt.Sprintf("Database %s is empty!", src))
 		} else {
@@ -337,8 +303,8 @@ func (tar *Tardigrade) LastXFields(count int, format string, db string) (string,
 				count = 0
 			}
 
-			if tar.CountSize(db) < count {
-				count = tar.CountSize(db)
+			if tar.countSize(db) < count {
+				count = tar.countSize(db)
 			} else if count >= 2 {
 				count = count - 1
 			}
@@ -346,10 +312,10 @@ func (tar *Tardigrade) LastXFields(count int, format string, db string) (string,
 			xFields := new(MyStruct)
 			var tmpStruct MyStruct
 
-			start = tar.CountSize(db) - count
-			end = tar.CountSize(db)
+			start = tar.countSize(db) - count
+			end = tar.countSize(db)
 
-			file, err := os.Open(src)
+			file, err := tar.openDB(src)
 			CheckError("LastXFields(1)", err)
 
 			defer file.Close()
@@ -380,6 +346,7 @@ func (tar *Tardigrade) LastXFields(count int, format string, db string) (string,
 // FirstField returns the first entry in the database in all formats [ raw | json | id | key | value ],
 // must specify format required Example: FirstField("json")
 func (tar *Tardigrade) FirstField(f string, db string) string {
+	defer tar.mustLock("FirstField", db, false)()
 
 	result := ""
 
@@ -387,14 +354,13 @@ func (tar *Tardigrade) FirstField(f string, db string) string {
 	if !tar.fileExists(src) {
 		return fmt.Sprintf("Database %s missing!", src)
 	} else {
-		fInfo, _ := os.Stat(src)
-		fsize := fInfo.Size()
+		fsize := tar.sizeDB(src)
 		if fsize <= 1 {
 			return fmt.Sprintf("Database %s is empty!", src)
 		} else {
 			lastLine := 0
 			line := ""
-			file, err := os.Open(src)
+			file, err := tar.openDB(src)
 
 			CheckError("FirstField(1)", err)
 			defer file.Close()
@@ -433,6 +399,7 @@ func (tar *Tardigrade) FirstField(f string, db string) string {
 
 // LastField returns the last entry of the database in all formats [ raw | json | id | key | value ] specify format required
 func (tar *Tardigrade) LastField(f string, db string) string {
+	defer tar.mustLock("LastField", db, false)()
 
 	result := ""
 
@@ -440,23 +407,23 @@ func (tar *Tardigrade) LastField(f string, db string) string {
 	if !tar.fileExists(src) {
 		return fmt.Sprintf("Database %s missing!", src)
 	} else {
-		fInfo, _ := os.Stat(src)
-		fsize := fInfo.Size()
+		fsize := tar.sizeDB(src)
 		if fsize <= 1 {
 			return fmt.Sprintf("Database %s is empty!", src)
 		} else {
 			lastLine := 0
 			line := ""
-			file, err := os.Open(src)
+			file, err := tar.openDB(src)
 
 			CheckError("LastField(1)", err)
 			defer file.Close()
 			var r io.Reader = file
 			sc := bufio.NewScanner(r)
 
+			total := tar.countSize(db)
 			for sc.Scan() {
 				lastLine++
-				if lastLine == tar.CountSize(db) {
+				if lastLine == total {
 					line = sc.Text()
 				}
 			}
@@ -487,61 +454,68 @@ func (tar *Tardigrade) LastField(f string, db string) string {
 // SelectSearch function takes in a single or multiple words(comma,separated) and format type, Returns the format [ raw | json | id | key | value ] and []bytes array with result
 // search will need to match ALL words for it to be true and return result.
 func (tar *Tardigrade) SelectSearch(search, format string, db string) (string, []byte) {
-	search = strings.ToLower(search)
-	search = strings.ReplaceAll(search, " ", ",")
-	split := strings.Split(search, ",")
-	size := len(split)
+	allRecords, err := tar.SelectSearchE(search, db)
+	if errors.Is(err, ErrDBMissing) || errors.Is(err, ErrDBEmpty) {
+		return format, []byte(legacyMessage("SelectSearch", db, 0, err))
+	}
+	CheckError("SelectSearch", err)
 
-	var allRecord []byte
+	allRecord, err := tar.MyMarshal(allRecords)
+	CheckError("SelectSearch", err)
+	return format, allRecord
+}
 
-	src := db
-	if !tar.fileExists(src) {
-		return format, []byte(fmt.Sprintf("Database %s missing!", src))
-	} else {
-		fInfo, _ := os.Stat(src)
-		fsize := fInfo.Size()
-		if fsize <= 1 {
-			return format, []byte(fmt.Sprintf("Database %s is empty!", src))
-		} else {
-			var allRecords []MyStruct
-			xFields := new(MyStruct)
-			var tmpStruct MyStruct
-			line := ""
+// SelectSearchE returns every record of db matching ALL comma or space separated words in search
+func (tar *Tardigrade) SelectSearchE(search string, db string) ([]MyStruct, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return nil, newError("SelectSearch", db, 0, err)
+	}
+	defer unlock()
 
-			file, err := os.Open(src)
-			CheckError("SelectSearch(1)", err)
+	a, err := analysisFor(db)
+	if err != nil {
+		return nil, newError("SelectSearch", db, 0, err)
+	}
+	allRecords, err := searchRecords(pathView(db), a, search)
+	if err != nil {
+		return nil, newError("SelectSearch", db, 0, err)
+	}
+	return allRecords, nil
+}
 
-			defer file.Close()
-			var r io.Reader = file
-			sc := bufio.NewScanner(r)
-			containsAll := true
+// searchRecords returns every record matching ALL words in search, see analysis.match
+func searchRecords(v view, a *analysis, search string) ([]MyStruct, error) {
+	split := searchWords(search)
 
-			for sc.Scan() {
-				line = strings.ToLower(sc.Text())
-				for i := 0; i < size; i++ {
-					for x := 0; x < size; x++ {
-						if !strings.Contains(line, split[x]) {
-							containsAll = false
-						}
-					}
-				}
-				if containsAll {
-					in := []byte(sc.Text())
-					err = json.Unmarshal(in, &tmpStruct)
-					CheckError("SelectSearch(2)", err)
+	var allRecords []MyStruct
+	err := v.each(func(line string) error {
+		if !a.match(line, split) {
+			return nil
+		}
+		var s MyStruct
+		if err := json.Unmarshal([]byte(line), &s); err != nil {
+			return corrupt(err)
+		}
+		allRecords = append(allRecords, s)
+		return nil
+	})
+	return allRecords, err
+}
 
-					xFields.Id = tmpStruct.Id
-					xFields.Key = string(tmpStruct.Key)
-					xFields.Data = string(tmpStruct.Data)
-					allRecords = append(allRecords, *xFields)
-				}
-				containsAll = true
+// searchWords lower cases search and splits it on commas and spaces
+func searchWords(search string) []string {
+	search = strings.ToLower(search)
+	search = strings.ReplaceAll(search, " ", ",")
+	return strings.Split(search, ",")
+}
 
-			}
-			allRecord, err = tar.MyMarshal(allRecords)
-			CheckError("SelectSearch(3)", err)
+// containsAll reports whether line contains every word
+func containsAll(line string, words []string) bool {
+	for _, word := range words {
+		if !strings.Contains(line, word) {
+			return false
 		}
 	}
-	return format, allRecord
-
+	return true
 }
@@ -0,0 +1,109 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestConcurrentWrites(t *testing.T) {
+	const workers, each = 8, 25
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "busy.db")
+	tar.CreateDB(db)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < each; i++ {
+				key := fmt.Sprintf("w%d-%d", w, i)
+				if w%2 == 0 {
+					if !tar.AddField(key, "data", db) {
+						errs <- fmt.Errorf("AddField(%s) failed", key)
+						return
+					}
+				} else if _, err := tar.AddFieldE(key, "data", db); err != nil {
+					errs <- err
+					return
+				}
+				tar.SelectByID(1, "raw", db)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := tar.CountSize(db); n != workers*each {
+		t.Fatalf("CountSize = %d, want %d", n, workers*each)
+	}
+	content, err := os.ReadFile(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[int]bool)
+	for _, line := range splitLines(content) {
+		var record MyStruct
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("line %q: %v", line, err)
+		}
+		if seen[record.Id] || record.Id < 1 || record.Id > workers*each {
+			t.Fatalf("id %d handed out twice or out of 1..%d", record.Id, workers*each)
+		}
+		seen[record.Id] = true
+	}
+}
+
+func TestConcurrentFlexModify(t *testing.T) {
+	const workers, rounds = 8, 25
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "flex.db")
+	tar.CreateDB(db)
+	for w := 1; w <= workers; w++ {
+		if !tar.AddFlexField(fmt.Sprintf("w%d", w), map[string]string{"n": "0"}, db) {
+			t.Fatal("AddFlexField failed")
+		}
+	}
+
+	// every worker rewrites the file for its own record, none may undo another's change
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 1; w <= workers; w++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			for round := 1; round <= rounds; round++ {
+				if _, ok := tar.ModifyFlexField(id, fmt.Sprintf("w%d", id), map[string]string{"n": strconv.Itoa(round)}, db); !ok {
+					errs <- fmt.Errorf("ModifyFlexField(%d) failed", id)
+					return
+				}
+				if _, err := tar.SelectFlexByIDE(id%workers+1, "raw", db); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	for id := 1; id <= workers; id++ {
+		var record FlexStruct
+		if err := json.Unmarshal([]byte(tar.SelectFlexByID(id, "raw", db)), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Fields["n"] != strconv.Itoa(rounds) {
+			t.Fatalf("record %d = %+v, lost an update", id, record)
+		}
+	}
+}
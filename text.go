@@ -0,0 +1,495 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strings"
+)
+
+// BM25 parameters: term frequency saturation and document length normalisation
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// snippetWords is the number of words around the first match shown in a snippet
+const snippetWords = 12
+
+// SearchOptions pages and formats the results of SearchText
+type SearchOptions struct {
+	Limit  int    // hits returned, zero returns all of them
+	Offset int    // hits skipped before the first one returned
+	Pre    string // inserted before every matched word of a snippet, "<mark>" when empty
+	Post   string // inserted after every matched word of a snippet, "</mark>" when empty
+
+	Fuzziness      int  // edits a query word may be away from a record word, FuzzyAuto to scale with its length
+	Transpositions bool // count swapping two adjacent letters as one edit (Damerau) rather than two
+	SuggestBelow   int  // suggest a corrected query when fewer records than this match, 1 when 0
+}
+
+// SearchHit is one record found by SearchText
+type SearchHit struct {
+	Id      int
+	Key     string
+	Score   float64         // BM25 relevance, higher is better
+	Snippet string          // words around the best match with the matched words highlighted
+	Record  json.RawMessage // the stored record, decode it into MyStruct or FlexStruct
+}
+
+// SearchResults is a page of hits ranked by relevance
+type SearchResults struct {
+	Total      int // hits matching the query, before Limit and Offset
+	Hits       []SearchHit
+	DidYouMean string // the query with misspelt words replaced by the closest words of the database, empty when none is
+}
+
+// SetFullText turns the full-text index of db on or off. With the index on, SearchText ranks
+// from an inverted index every process builds in memory on its first search and keeps up to
+// date with every write. With it off, every SearchText tokenizes the whole file.
+func (tar *Tardigrade) SetFullText(db string, enabled bool) error {
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return newError("SetFullText", db, 0, err)
+	}
+	defer unlock()
+
+	if _, err := statDB(db); err != nil {
+		return newError("SetFullText", db, 0, err)
+	}
+	meta, err := loadMeta(db)
+	if err != nil {
+		return newError("SetFullText", db, 0, err)
+	}
+	if meta.FullText == enabled {
+		return nil
+	}
+	meta.FullText = enabled
+	return newError("SetFullText", db, 0, saveMeta(db, meta))
+}
+
+// SearchText returns the records holding any word of query in their key, data or flex field
+// values, best match first. Words are compared whole and case-insensitively.
+// Usage: results, err := tar.SearchText("disk full", tardigrade.SearchOptions{Limit: 10}, "notes.db")
+func (tar *Tardigrade) SearchText(query string, opts SearchOptions, db string) (SearchResults, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return SearchResults{}, newError("SearchText", db, 0, err)
+	}
+	defer unlock()
+
+	a, err := analysisFor(db)
+	if err != nil {
+		return SearchResults{}, newError("SearchText", db, 0, err)
+	}
+	results, err := searchText(pathView(db), a, query, opts)
+	return results, newError("SearchText", db, 0, err)
+}
+
+// SearchText returns the records matching query best first, see Tardigrade.SearchText
+func (d *DB) SearchText(query string, opts SearchOptions) (SearchResults, error) {
+	var results SearchResults
+	err := d.read("SearchText", func(v view) error {
+		a, err := analysisFor(d.path)
+		if err == nil {
+			results, err = searchText(v, a, query, opts)
+		}
+		return newError("SearchText", d.path, 0, err)
+	})
+	return results, err
+}
+
+// textQuery is a search put to a text index
+type textQuery struct {
+	terms          []string // analyzed query terms
+	words          []string // query words, for spelling corrections
+	fuzziness      int
+	transpositions bool
+	suggestBelow   int
+	offset, limit  int
+}
+
+// textPage is the part of a ranking SearchOptions selects
+type textPage struct {
+	total       int
+	lines       []string
+	scores      []float64
+	terms       []string // words of the index the query matched
+	corrections []string // correction of each query word, "" for words that need none, nil when not asked
+}
+
+// searchText ranks the records of v against query analyzed by a, through the full-text index
+// when v has one and by indexing every record otherwise
+func searchText(v view, a *analysis, query string, opts SearchOptions) (SearchResults, error) {
+	words := splitWords(query)
+	q := textQuery{
+		terms:          a.queryTerms(query),
+		words:          make([]string, len(words)),
+		fuzziness:      opts.Fuzziness,
+		transpositions: opts.Transpositions,
+		suggestBelow:   opts.SuggestBelow,
+		offset:         opts.Offset,
+		limit:          opts.Limit,
+	}
+	for i, w := range words {
+		q.words[i] = query[w.Start:w.End]
+	}
+	if q.suggestBelow == 0 {
+		q.suggestBelow = 1
+	}
+	var page textPage
+	ok := false
+	if v.text != nil {
+		var err error
+		if page, ok, err = v.text(a, q); err != nil {
+			return SearchResults{}, err
+		}
+	}
+	if !ok {
+		var err error
+		if page, err = scanText(v, a, q); err != nil {
+			return SearchResults{}, err
+		}
+	}
+
+	if opts.Pre == "" && opts.Post == "" {
+		opts.Pre, opts.Post = "<mark>", "</mark>"
+	}
+	results := SearchResults{Total: page.total, Hits: make([]SearchHit, 0, len(page.lines))}
+	if page.corrections != nil {
+		results.DidYouMean = correctQuery(query, words, page.corrections)
+	}
+	for i, line := range page.lines {
+		var head recordHead
+		if err := json.Unmarshal([]byte(line), &head); err != nil {
+			return results, corrupt(err)
+		}
+		results.Hits = append(results.Hits, SearchHit{
+			Id:      head.Id,
+			Key:     head.Key,
+			Score:   page.scores[i],
+			Snippet: snippet(a, recordTexts([]byte(line)), page.terms, opts.Pre, opts.Post),
+			Record:  json.RawMessage(line),
+		})
+	}
+	return results, nil
+}
+
+// scanText builds a throwaway index of every record of v and ranks it, keeping only the
+// lines that hold a query term
+func scanText(v view, a *analysis, q textQuery) (textPage, error) {
+	idx := newTextIndex(a)
+	lines := make(map[int]string)
+	wanted := q.matcher()
+	err := v.each(func(line string) error {
+		var head recordHead
+		if json.Unmarshal([]byte(line), &head) != nil || head.Deleted {
+			return nil
+		}
+		for _, term := range idx.add(head.Id, []byte(line)) {
+			if wanted(term) {
+				lines[head.Id] = line
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return textPage{}, err
+	}
+	selected, page := idx.search(q)
+	for _, r := range selected {
+		page.lines = append(page.lines, lines[r.id])
+		page.scores = append(page.scores, r.score)
+	}
+	return page, nil
+}
+
+// textIndex is an inverted index of the terms of every record
+type textIndex struct {
+	a        *analysis
+	postings map[string]map[int]int // word -> record id -> occurrences
+	docs     map[int][]string       // record id -> its distinct words
+	lengths  map[int]int            // record id -> number of words
+	total    int                    // sum of lengths
+}
+
+// textScore is the relevance of one record
+type textScore struct {
+	id    int
+	score float64
+}
+
+// newTextIndex returns an empty index
+func newTextIndex(a *analysis) *textIndex {
+	return &textIndex{
+		a:        a,
+		postings: make(map[string]map[int]int),
+		docs:     make(map[int][]string),
+		lengths:  make(map[int]int),
+	}
+}
+
+// add indexes the words of the record stored in body under id and returns them, distinct
+func (t *textIndex) add(id int, body []byte) []string {
+	t.remove(id)
+	counts := make(map[string]int)
+	n := 0
+	for _, f := range recordTexts(body) {
+		for _, tok := range t.a.analyzer(f.name).Analyze(f.text, false) {
+			counts[tok.Term]++
+			n++
+		}
+	}
+	terms := make([]string, 0, len(counts))
+	for term, count := range counts {
+		if t.postings[term] == nil {
+			t.postings[term] = make(map[int]int)
+		}
+		t.postings[term][id] = count
+		terms = append(terms, term)
+	}
+	t.docs[id] = terms
+	t.lengths[id] = n
+	t.total += n
+	return terms
+}
+
+// remove drops record id from the index
+func (t *textIndex) remove(id int) {
+	terms, ok := t.docs[id]
+	if !ok {
+		return
+	}
+	for _, term := range terms {
+		delete(t.postings[term], id)
+		if len(t.postings[term]) == 0 {
+			delete(t.postings, term)
+		}
+	}
+	t.total -= t.lengths[id]
+	delete(t.docs, id)
+	delete(t.lengths, id)
+}
+
+// search ranks the records against q and returns the page it selects, along with the total,
+// the matched terms and, when fewer records than q.suggestBelow match, spelling corrections
+func (t *textIndex) search(q textQuery) ([]textScore, textPage) {
+	weights := t.expand(q)
+	ranked := t.rank(weights)
+	page := textPage{total: len(ranked)}
+	for term := range weights {
+		page.terms = append(page.terms, term)
+	}
+	sort.Strings(page.terms)
+	if len(ranked) < q.suggestBelow {
+		page.corrections = t.corrections(q.words)
+	}
+	return pageOf(ranked, q.offset, q.limit), page
+}
+
+// rank scores every record holding a term with BM25 scaled by the weight of the term, best
+// first and by id on equal scores
+func (t *textIndex) rank(weights map[string]float64) []textScore {
+	n := float64(len(t.docs))
+	if n == 0 {
+		return nil
+	}
+	avg := float64(t.total) / n
+	if avg == 0 {
+		avg = 1
+	}
+	terms := make([]string, 0, len(weights))
+	for term := range weights {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	scores := make(map[int]float64)
+	for _, term := range terms {
+		docs := t.postings[term]
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		for id, tf := range docs {
+			f := float64(tf)
+			norm := 1 - bm25B + bm25B*float64(t.lengths[id])/avg
+			scores[id] += weights[term] * idf * f * (bm25K1 + 1) / (f + bm25K1*norm)
+		}
+	}
+	ranked := make([]textScore, 0, len(scores))
+	for id, score := range scores {
+		ranked = append(ranked, textScore{id: id, score: score})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].score != ranked[j].score {
+			return ranked[i].score > ranked[j].score
+		}
+		return ranked[i].id < ranked[j].id
+	})
+	return ranked
+}
+
+// pageOf returns the part of ranked selected by offset and limit, zero limit meaning all
+func pageOf(ranked []textScore, offset, limit int) []textScore {
+	if offset < 0 {
+		offset = 0
+	}
+	if offset >= len(ranked) {
+		return nil
+	}
+	ranked = ranked[offset:]
+	if limit > 0 && limit < len(ranked) {
+		ranked = ranked[:limit]
+	}
+	return ranked
+}
+
+// textField is a searchable text of a record and the field it came from
+type textField struct {
+	name, text string
+}
+
+// recordTexts returns the searchable texts of a stored record: its key and data as the fields
+// "key" and "data", then the values of its flex fields in field name order
+func recordTexts(body []byte) []textField {
+	var record struct {
+		Key    string                     `json:"key"`
+		Data   string                     `json:"data"`
+		Fields map[string]json.RawMessage `json:"fields"`
+	}
+	if json.Unmarshal(body, &record) != nil {
+		return nil
+	}
+	texts := []textField{{name: "key", text: record.Key}}
+	if record.Data != "" {
+		texts = append(texts, textField{name: "data", text: record.Data})
+	}
+	names := make([]string, 0, len(record.Fields))
+	for name := range record.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		texts = append(texts, textField{name: name, text: fieldText(record.Fields[name])})
+	}
+	return texts
+}
+
+// distinct returns terms without repetitions, in order of first appearance
+func distinct(terms []string) []string {
+	seen := make(map[string]bool, len(terms))
+	out := terms[:0:0]
+	for _, term := range terms {
+		if !seen[term] {
+			seen[term] = true
+			out = append(out, term)
+		}
+	}
+	return out
+}
+
+// snippet returns the words around the first match in the text matching the most distinct
+// terms, with every matched word wrapped in pre and post
+func snippet(a *analysis, texts []textField, terms []string, pre, post string) string {
+	wanted := make(map[string]bool, len(terms))
+	for _, term := range terms {
+		wanted[term] = true
+	}
+	best, bestWords, bestMatched, bestCount := "", []Token(nil), map[int]bool(nil), -1
+	for _, f := range texts {
+		found := make(map[string]bool)
+		matched := make(map[int]bool) // start offsets of the matched words
+		for _, tok := range a.analyzer(f.name).Analyze(f.text, false) {
+			if wanted[tok.Term] {
+				found[tok.Term] = true
+				matched[tok.Start] = true
+			}
+		}
+		if len(found) > bestCount {
+			best, bestWords, bestMatched, bestCount = f.text, splitWords(f.text), matched, len(found)
+		}
+	}
+	if len(bestWords) == 0 {
+		return best
+	}
+
+	first := 0
+	for i, w := range bestWords {
+		if bestMatched[w.Start] {
+			first = i
+			break
+		}
+	}
+	from := first - snippetWords/4
+	if from < 0 {
+		from = 0
+	}
+	to := from + snippetWords
+	if to > len(bestWords) {
+		to = len(bestWords)
+	}
+
+	var b strings.Builder
+	if from > 0 {
+		b.WriteString("…")
+	}
+	pos := bestWords[from].Start
+	for _, w := range bestWords[from:to] {
+		b.WriteString(best[pos:w.Start])
+		if bestMatched[w.Start] {
+			b.WriteString(pre + best[w.Start:w.End] + post)
+		} else {
+			b.WriteString(best[w.Start:w.End])
+		}
+		pos = w.End
+	}
+	if to < len(bestWords) {
+		b.WriteString("…")
+	} else {
+		b.WriteString(best[pos:])
+	}
+	return b.String()
+}
+
+// rank ranks the live records against q from the full-text index, building it on first
+// use or after the analyzers changed, and reports false when the database has the index
+// turned off
+func (kd *keydir) rank(file io.ReaderAt, a *analysis, q textQuery) (textPage, bool, error) {
+	kd.mu.Lock()
+	if !kd.fullText {
+		kd.mu.Unlock()
+		return textPage{}, false, nil
+	}
+	if len(kd.entries) == 0 {
+		kd.mu.Unlock()
+		return textPage{}, true, ErrDBEmpty
+	}
+	if kd.text == nil || kd.text.a.signature != a.signature {
+		text := newTextIndex(a)
+		for id, e := range kd.entries {
+			line, err := readVersion(file, e)
+			if err != nil {
+				kd.mu.Unlock()
+				return textPage{}, true, err
+			}
+			text.add(id, line)
+		}
+		kd.text = text
+	}
+	selected, page := kd.text.search(q)
+	entries := make([]keydirEntry, len(selected))
+	for i, r := range selected {
+		entries[i] = kd.entries[r.id]
+	}
+	kd.mu.Unlock()
+
+	for i, e := range entries {
+		line, err := readVersion(file, e)
+		if err != nil {
+			return textPage{}, true, err
+		}
+		page.lines = append(page.lines, string(line))
+		page.scores = append(page.scores, selected[i].score)
+	}
+	return page, true, nil
+}
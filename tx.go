@@ -0,0 +1,300 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+// ErrTxDone is returned by every call made on a transaction after Commit or Rollback
+var ErrTxDone = errors.New("transaction already committed or rolled back")
+
+// Tx is a set of writes applied to a database all at once by Commit or not at all.
+// A transaction holds the exclusive lock of its database from Begin until Commit or
+// Rollback, so keep it short and only use the Tx methods while it is open.
+type Tx struct {
+	db      *DB
+	unlock  func()
+	lines   []string   // working copy of the database including the writes made so far
+	entries []walEntry // writes to log on commit
+	lastID  int
+	unique  bool // the database enforces unique keys
+	done    bool
+}
+
+// Begin starts a transaction on the database
+// Usage: tx, err := db.Begin(); defer tx.Rollback(); ... err = tx.Commit()
+func (d *DB) Begin() (*Tx, error) {
+	unlock, err := d.tar.writeLock(d.path)
+	if err != nil {
+		return nil, newError("Begin", d.path, 0, err)
+	}
+	d.mu.Lock()
+	release := func() {
+		d.mu.Unlock()
+		unlock()
+	}
+	if err := d.ready("Begin", true); err != nil {
+		release()
+		return nil, err
+	}
+	lines, err := d.lines()
+	if err != nil {
+		release()
+		return nil, newError("Begin", d.path, 0, err)
+	}
+	meta, err := loadMeta(d.path)
+	if err != nil {
+		release()
+		return nil, newError("Begin", d.path, 0, err)
+	}
+	return &Tx{db: d, unlock: release, lines: lines, lastID: d.lastID, unique: meta.UniqueKeys}, nil
+}
+
+// Add appends a new record and returns the id assigned to it
+func (tx *Tx) Add(key, data string) (int, error) {
+	return tx.add("Add", key, func(id int) interface{} {
+		return MyStruct{Id: id, Key: key, Data: data}
+	})
+}
+
+// AddFlex appends a new flexible record and returns the id assigned to it
+func (tx *Tx) AddFlex(key string, fields map[string]string) (int, error) {
+	return tx.add("AddFlex", key, func(id int) interface{} {
+		return FlexStruct{Id: id, Key: key, Fields: fields}
+	})
+}
+
+// Get returns record id as seen by the transaction
+func (tx *Tx) Get(id int) (MyStruct, error) {
+	if err := tx.check("Get"); err != nil {
+		return MyStruct{}, err
+	}
+	s, err := decodeRecord(tx.view(), id)
+	return s, newError("Get", tx.db.path, id, err)
+}
+
+// GetFlex returns flexible record id as seen by the transaction
+func (tx *Tx) GetFlex(id int) (FlexStruct, error) {
+	if err := tx.check("GetFlex"); err != nil {
+		return FlexStruct{}, err
+	}
+	record, err := decodeFlex(tx.view(), id)
+	return record, newError("GetFlex", tx.db.path, id, err)
+}
+
+// Search returns every record matching ALL comma or space separated words in search
+func (tx *Tx) Search(search string) ([]MyStruct, error) {
+	if err := tx.check("Search"); err != nil {
+		return nil, err
+	}
+	a, err := analysisFor(tx.db.path)
+	if err != nil {
+		return nil, newError("Search", tx.db.path, 0, err)
+	}
+	records, err := searchRecords(tx.view(), a, search)
+	return records, newError("Search", tx.db.path, 0, err)
+}
+
+// SearchFlex returns every flexible record matching ALL comma or space separated words in search
+func (tx *Tx) SearchFlex(search string) ([]FlexStruct, error) {
+	if err := tx.check("SearchFlex"); err != nil {
+		return nil, err
+	}
+	a, err := analysisFor(tx.db.path)
+	if err != nil {
+		return nil, newError("SearchFlex", tx.db.path, 0, err)
+	}
+	records, err := searchFlex(tx.view(), a, search)
+	return records, newError("SearchFlex", tx.db.path, 0, err)
+}
+
+// Modify replaces the key and data of record id
+func (tx *Tx) Modify(id int, key, data string) error {
+	return tx.modify("Modify", id, key, MyStruct{Id: id, Key: key, Data: data})
+}
+
+// ModifyFlex replaces the key and fields of flexible record id
+func (tx *Tx) ModifyFlex(id int, key string, fields map[string]string) error {
+	return tx.modify("ModifyFlex", id, key, FlexStruct{Id: id, Key: key, Fields: fields})
+}
+
+// Remove deletes record id
+func (tx *Tx) Remove(id int) error {
+	if err := tx.check("Remove"); err != nil {
+		return err
+	}
+	line, err := findLine(tx.view(), id)
+	if err != nil {
+		return newError("Remove", tx.db.path, id, err)
+	}
+	tx.lines, _ = removeLine(line)(tx.lines)
+	tx.entries = append(tx.entries, walEntry{Op: "remove", Id: id})
+	return nil
+}
+
+// Commit writes every change made by the transaction with a single atomic rewrite, or a
+// single append in append storage, and releases the database
+func (tx *Tx) Commit() error {
+	if err := tx.check("Commit"); err != nil {
+		return err
+	}
+	defer tx.finish()
+	if len(tx.entries) == 0 {
+		return nil
+	}
+	d := tx.db
+	undo, err := d.state.appendWAL(d.opts.Durability, true, tx.entries...)
+	if err != nil {
+		return newError("Commit", d.path, 0, err)
+	}
+	if err := tx.apply(); err != nil {
+		return newError("Commit", d.path, 0, errors.Join(err, undo()))
+	}
+	d.state.appliedWAL()
+	for _, e := range tx.final() {
+		d.tar.percolate(d.path, e.Op, e.Record)
+	}
+	return newError("Commit", d.path, 0, d.state.afterWAL(d.opts.Durability))
+}
+
+// final returns the last state of every record the transaction wrote, in the order they were
+// first written: an add, possibly modified since, stays an add and removed records are left
+// out
+func (tx *Tx) final() []walEntry {
+	last := make(map[int]walEntry)
+	var ids []int
+	for _, e := range tx.entries {
+		first, seen := last[e.Id]
+		if !seen {
+			ids = append(ids, e.Id)
+		} else if first.Op == "add" && e.Op == "modify" {
+			e.Op = "add"
+		}
+		last[e.Id] = e
+	}
+	var final []walEntry
+	for _, id := range ids {
+		if e := last[id]; e.Op != "remove" {
+			final = append(final, e)
+		}
+	}
+	return final
+}
+
+// Rollback discards every change made by the transaction and releases the database, it is
+// a no-op after Commit so it can always be deferred
+func (tx *Tx) Rollback() error {
+	if tx.done {
+		return nil
+	}
+	tx.finish()
+	return nil
+}
+
+// apply writes the working copy to the database, or only the new versions in append storage
+func (tx *Tx) apply() error {
+	d := tx.db
+	if d.state.keydir() == nil {
+		old, err := os.ReadFile(d.path)
+		if err != nil {
+			return err
+		}
+		if err := replaceDB(d.path, old, joinLines(tx.lines), d.opts.Durability); err != nil {
+			return err
+		}
+		return d.reopen()
+	}
+	var versions []byte
+	for _, e := range tx.entries {
+		if e.Op == "remove" {
+			versions = append(versions, tombstone(e.Id)...)
+		} else {
+			versions = append(versions, e.Record...)
+			versions = append(versions, '\n')
+		}
+	}
+	return d.put(versions)
+}
+
+// add appends the record built by build to the working copy under the next free id
+func (tx *Tx) add(op, key string, build func(id int) interface{}) (int, error) {
+	if err := tx.check(op); err != nil {
+		return 0, err
+	}
+	if tx.unique {
+		if err := uniqueKey(tx.view(), key, 0); err != nil {
+			return 0, newError(op, tx.db.path, 0, err)
+		}
+	}
+	id := tx.lastID + 1
+	line, err := tx.db.tar.MyMarshal(build(id))
+	if err != nil {
+		return 0, newError(op, tx.db.path, id, err)
+	}
+	record := strings.TrimSpace(string(line))
+	tx.lines = append(tx.lines, record)
+	tx.entries = append(tx.entries, walEntry{Op: "add", Id: id, Record: json.RawMessage(record)})
+	tx.lastID = id
+	return id, nil
+}
+
+// modify swaps the working copy line holding record id with the encoding of v
+func (tx *Tx) modify(op string, id int, key string, v interface{}) error {
+	if err := tx.check(op); err != nil {
+		return err
+	}
+	before, err := findLine(tx.view(), id)
+	if err != nil {
+		return newError(op, tx.db.path, id, err)
+	}
+	if tx.unique {
+		if err := uniqueKey(tx.view(), key, id); err != nil {
+			return newError(op, tx.db.path, id, err)
+		}
+	}
+	after, err := tx.db.tar.MyMarshal(v)
+	if err != nil {
+		return newError(op, tx.db.path, id, err)
+	}
+	record := strings.TrimSpace(string(after))
+	tx.lines, _ = replaceLine(before, record)(tx.lines)
+	tx.entries = append(tx.entries, walEntry{Op: "modify", Id: id, Record: json.RawMessage(record)})
+	return nil
+}
+
+// check fails every call made after the transaction finished
+func (tx *Tx) check(op string) error {
+	if tx.done {
+		return newError(op, tx.db.path, 0, ErrTxDone)
+	}
+	return nil
+}
+
+// finish releases the locks held by the transaction
+func (tx *Tx) finish() {
+	tx.done = true
+	tx.unlock()
+}
+
+// view returns the view of the working copy of the transaction
+func (tx *Tx) view() view {
+	return view{each: tx.scan}
+}
+
+// scan walks the working copy of the transaction
+func (tx *Tx) scan(fn func(line string) error) error {
+	if len(tx.lines) == 0 {
+		return ErrDBEmpty
+	}
+	for _, line := range tx.lines {
+		if err := fn(line); err != nil {
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return nil
+}
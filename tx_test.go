@@ -0,0 +1,168 @@
+package tardigrade
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTxCommitAndRollback(t *testing.T) {
+	for _, mode := range []StorageMode{StorageRewrite, StorageAppend} {
+		d, err := Open(filepath.Join(t.TempDir(), "tx.db"), Options{Create: true, Storage: mode})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Add("a", "1"); err != nil {
+			t.Fatal(err)
+		}
+
+		tx, err := d.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Add("b", "2"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tx.Add("c", "3"); !errors.Is(err, ErrTxDone) {
+			t.Fatalf("mode %d: Add after Rollback = %v, want ErrTxDone", mode, err)
+		}
+
+		tx, err = d.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := tx.Add("b", "2")
+		if err != nil || id != 2 {
+			t.Fatalf("mode %d: tx.Add = %d, %v, want id 2", mode, id, err)
+		}
+		if err := tx.Modify(1, "a", "changed"); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := tx.Get(1); err != nil || got.Data != "changed" {
+			t.Fatalf("mode %d: tx.Get(1) = %+v, %v", mode, got, err)
+		}
+		if err := tx.Remove(2); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+		rows, err := d.Search("")
+		if err != nil || len(rows) != 1 || rows[0].Data != "changed" {
+			t.Fatalf("mode %d: after Commit %+v, %v", mode, rows, err)
+		}
+		if last, err := d.LastID(); err != nil || mode == StorageAppend && last != 2 {
+			t.Fatalf("mode %d: LastID = %d, %v", mode, last, err)
+		}
+		d.Close()
+	}
+}
+
+func TestTxTornAppend(t *testing.T) {
+	d, err := Open(filepath.Join(t.TempDir(), "torn.db"), Options{Create: true, Storage: StorageAppend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Add("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	tx, err := d.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b", "c", "d"} {
+		if _, err := tx.Add(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+
+	// a crash after writing the first two versions of the transaction
+	content, err := os.ReadFile(d.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := splitLines(content)
+	if len(lines) != 5 || batchSize([]byte(lines[1])) != 3 {
+		t.Fatalf("transaction written as %q", lines)
+	}
+	if err := os.WriteFile(d.Path(), joinLines(lines[:4]), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(hintPath(d.Path()))
+	forget(d.Path())
+
+	d, err = Open(d.Path(), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n, err := d.Count(); err != nil || n != 1 {
+		t.Fatalf("Count = %d, %v, want only the record written before the transaction", n, err)
+	}
+	id, err := d.Add("e", "5")
+	if err != nil || id != 2 {
+		t.Fatalf("Add = %d, %v, want id 2 over the cut off transaction", id, err)
+	}
+	content, err = os.ReadFile(d.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := splitLines(content); len(lines) != 2 {
+		t.Fatalf("file after the next write = %q", lines)
+	}
+}
+
+func TestTxUncommittedInWAL(t *testing.T) {
+	d := openWALDB(t, Options{})
+	tx, err := d.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Add("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Add("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := readWAL(walPath(d.Path()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := entries[len(entries)-1]; last.Op != "commit" || last.Tx != entries[0].Seq {
+		t.Fatalf("log = %+v, want the transaction closed by a commit entry", entries)
+	}
+	d.Close()
+
+	// entries of a transaction whose commit entry never made it to disk
+	crashEntry(t, d.Path(), "add", 3, `{"id":3,"key":"c","data":"3"}`)
+	content, err := os.ReadFile(walPath(d.Path()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := splitLines(content)
+	lines[len(lines)-1] = lines[len(lines)-1][:len(lines[len(lines)-1])-1] + `,"tx":99}`
+	if err := os.WriteFile(walPath(d.Path()), joinLines(lines), 0644); err != nil {
+		t.Fatal(err)
+	}
+	forget(d.Path())
+
+	d, err = Open(d.Path(), Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n, err := d.Count(); err != nil || n != 2 {
+		t.Fatalf("Count = %d, %v, want the uncommitted add skipped", n, err)
+	}
+}
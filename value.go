@@ -0,0 +1,575 @@
+package tardigrade
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// FlexRecord is a flexible record whose fields hold typed values. Fields read back as string,
+// int64, float64, bool, []interface{}, map[string]interface{} and nil for null. Times and bytes are stored
+// as RFC 3339 and base64 strings, so they read back as strings that Time and Bytes parse.
+type FlexRecord struct {
+	Id     int                    `json:"id"`
+	Key    string                 `json:"key"`
+	Fields map[string]interface{} `json:"fields"`
+}
+
+// UnmarshalJSON decodes a flexible record keeping integers exact
+func (r *FlexRecord) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Id     int                    `json:"id"`
+		Key    string                 `json:"key"`
+		Fields map[string]interface{} `json:"fields"`
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.UseNumber()
+	if err := d.Decode(&raw); err != nil {
+		return err
+	}
+	r.Id, r.Key, r.Fields = raw.Id, raw.Key, make(map[string]interface{}, len(raw.Fields))
+	for name, value := range raw.Fields {
+		r.Fields[name] = decodedValue(value)
+	}
+	return nil
+}
+
+// MarshalJSON encodes a flexible record, writing whole floats with a fraction so that they
+// read back as float64 rather than int64
+func (r FlexRecord) MarshalJSON() ([]byte, error) {
+	type plain FlexRecord
+	fields := make(map[string]interface{}, len(r.Fields))
+	for name, value := range r.Fields {
+		fields[name] = encodedValue(value)
+	}
+	if r.Fields == nil {
+		fields = nil
+	}
+	buffer := &bytes.Buffer{}
+	encoder := json.NewEncoder(buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(plain{Id: r.Id, Key: r.Key, Fields: fields}); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSpace(buffer.Bytes()), nil
+}
+
+// UnmarshalJSON decodes a flexible record, turning typed values into their text so that
+// records written with AddFlexTyped read back through the string API
+func (s *FlexStruct) UnmarshalJSON(b []byte) error {
+	var raw struct {
+		Id     int                        `json:"id"`
+		Key    string                     `json:"key"`
+		Fields map[string]json.RawMessage `json:"fields"`
+	}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	s.Id, s.Key, s.Fields = raw.Id, raw.Key, nil
+	if raw.Fields != nil {
+		s.Fields = make(map[string]string, len(raw.Fields))
+		for name, value := range raw.Fields {
+			s.Fields[name] = fieldText(value)
+		}
+	}
+	return nil
+}
+
+// AddFlexTyped adds a flexible record with typed field values and returns the id assigned to
+// it. Values may be strings, integers, floats, bools, time.Time, []byte, nil for null and
+// slices or string keyed maps of those.
+// Usage: id, err := tar.AddFlexTyped("order:1", map[string]interface{}{"cost": 299, "paid": true, "tags": []string{"eu", "new"}}, "orders.db")
+func (tar *Tardigrade) AddFlexTyped(key string, fields map[string]interface{}, db string) (int, error) {
+	typed, err := typedFields(fields)
+	if err != nil {
+		return 0, newError("AddFlexTyped", db, 0, err)
+	}
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return 0, newError("AddFlexTyped", db, 0, err)
+	}
+	defer unlock()
+
+	return tar.insert("AddFlexTyped", db, key, func(id int) interface{} {
+		return FlexRecord{Id: id, Key: key, Fields: typed}
+	})
+}
+
+// ModifyFlexTyped replaces the key and fields of a flexible record with typed values and
+// returns the new raw line
+func (tar *Tardigrade) ModifyFlexTyped(id int, key string, fields map[string]interface{}, db string) (string, error) {
+	typed, err := typedFields(fields)
+	if err != nil {
+		return "", newError("ModifyFlexTyped", db, id, err)
+	}
+	unlock, err := tar.writeLock(db)
+	if err != nil {
+		return "", newError("ModifyFlexTyped", db, id, err)
+	}
+	defer unlock()
+
+	return tar.replace("ModifyFlexTyped", db, id, key, &FlexRecord{Id: id, Key: key, Fields: typed})
+}
+
+// GetFlexRecord returns flexible record id with typed field values. Records written through
+// the string API hold strings only, the typed accessors of FlexRecord parse them.
+func (tar *Tardigrade) GetFlexRecord(id int, db string) (FlexRecord, error) {
+	unlock, err := tar.readLock(db)
+	if err != nil {
+		return FlexRecord{}, newError("GetFlexRecord", db, id, err)
+	}
+	defer unlock()
+
+	record, err := decodeFlexRecord(pathView(db), id)
+	return record, newError("GetFlexRecord", db, id, err)
+}
+
+// GetFlexInt returns field of flexible record id as an integer
+// Usage: cost, err := tar.GetFlexInt(1, "cost", "orders.db")
+func (tar *Tardigrade) GetFlexInt(id int, field string, db string) (int64, error) {
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return 0, err
+	}
+	n, err := record.Int(field)
+	return n, newError("GetFlexInt", db, id, err)
+}
+
+// GetFlexFloat returns field of flexible record id as a float
+func (tar *Tardigrade) GetFlexFloat(id int, field string, db string) (float64, error) {
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return 0, err
+	}
+	f, err := record.Float(field)
+	return f, newError("GetFlexFloat", db, id, err)
+}
+
+// GetFlexBool returns field of flexible record id as a bool
+func (tar *Tardigrade) GetFlexBool(id int, field string, db string) (bool, error) {
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return false, err
+	}
+	b, err := record.Bool(field)
+	return b, newError("GetFlexBool", db, id, err)
+}
+
+// GetFlexTime returns field of flexible record id as a time
+func (tar *Tardigrade) GetFlexTime(id int, field string, db string) (time.Time, error) {
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return time.Time{}, err
+	}
+	t, err := record.Time(field)
+	return t, newError("GetFlexTime", db, id, err)
+}
+
+// GetFlexBytes returns field of flexible record id as bytes
+func (tar *Tardigrade) GetFlexBytes(id int, field string, db string) ([]byte, error) {
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return nil, err
+	}
+	b, err := record.Bytes(field)
+	return b, newError("GetFlexBytes", db, id, err)
+}
+
+// GetFlexList returns field of flexible record id as a list
+func (tar *Tardigrade) GetFlexList(id int, field string, db string) ([]interface{}, error) {
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return nil, err
+	}
+	list, err := record.List(field)
+	return list, newError("GetFlexList", db, id, err)
+}
+
+// GetFlexObject returns field of flexible record id as an object
+func (tar *Tardigrade) GetFlexObject(id int, field string, db string) (map[string]interface{}, error) {
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := record.Object(field)
+	return obj, newError("GetFlexObject", db, id, err)
+}
+
+// String returns field as text, lists and objects as compact JSON
+func (r FlexRecord) String(field string) (string, error) {
+	value, err := r.field(field)
+	if err != nil {
+		return "", err
+	}
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", fmt.Errorf("%w: field %q: %v", ErrFieldType, field, err)
+	}
+	return string(b), nil
+}
+
+// Int returns field as an integer, parsing it when it is stored as text
+func (r FlexRecord) Int(field string) (int64, error) {
+	value, err := r.field(field)
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case int64:
+		return v, nil
+	case float64:
+		if v == math.Trunc(v) && v >= math.MinInt64 && v < math.MaxInt64 {
+			return int64(v), nil
+		}
+	case string:
+		if n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, typeMismatch(field, "an integer", value)
+}
+
+// Float returns field as a float, parsing it when it is stored as text
+func (r FlexRecord) Float(field string) (float64, error) {
+	value, err := r.field(field)
+	if err != nil {
+		return 0, err
+	}
+	switch v := value.(type) {
+	case float64:
+		return v, nil
+	case int64:
+		return float64(v), nil
+	case string:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+			return f, nil
+		}
+	}
+	return 0, typeMismatch(field, "a number", value)
+}
+
+// Bool returns field as a bool, parsing it when it is stored as text
+func (r FlexRecord) Bool(field string) (bool, error) {
+	value, err := r.field(field)
+	if err != nil {
+		return false, err
+	}
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		if b, err := strconv.ParseBool(strings.TrimSpace(v)); err == nil {
+			return b, nil
+		}
+	}
+	return false, typeMismatch(field, "a bool", value)
+}
+
+// Time returns field as a time, stored as RFC 3339 text or one of the date layouts queries
+// understand
+func (r FlexRecord) Time(field string) (time.Time, error) {
+	value, err := r.field(field)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if s, ok := value.(string); ok {
+		if t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(s)); err == nil {
+			return t, nil
+		}
+		if t, ok := parseDate(s); ok {
+			return t, nil
+		}
+	}
+	return time.Time{}, typeMismatch(field, "a time", value)
+}
+
+// Bytes returns field as bytes, stored as base64 text
+func (r FlexRecord) Bytes(field string) ([]byte, error) {
+	value, err := r.field(field)
+	if err != nil {
+		return nil, err
+	}
+	if s, ok := value.(string); ok {
+		if b, err := base64.StdEncoding.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, typeMismatch(field, "base64 bytes", value)
+}
+
+// List returns field as a list, decoding it when it is stored as JSON text
+func (r FlexRecord) List(field string) ([]interface{}, error) {
+	value, err := r.field(field)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case []interface{}:
+		return v, nil
+	case string:
+		var list []interface{}
+		if decodeText(v, &list) == nil && list != nil {
+			return list, nil
+		}
+	}
+	return nil, typeMismatch(field, "a list", value)
+}
+
+// Object returns field as an object, decoding it when it is stored as JSON text
+func (r FlexRecord) Object(field string) (map[string]interface{}, error) {
+	value, err := r.field(field)
+	if err != nil {
+		return nil, err
+	}
+	switch v := value.(type) {
+	case map[string]interface{}:
+		return v, nil
+	case string:
+		var obj map[string]interface{}
+		if decodeText(v, &obj) == nil && obj != nil {
+			return obj, nil
+		}
+	}
+	return nil, typeMismatch(field, "an object", value)
+}
+
+// field returns the value of field, failing with errFieldNotFound
+func (r FlexRecord) field(name string) (interface{}, error) {
+	value, ok := r.Fields[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errFieldNotFound, name)
+	}
+	return value, nil
+}
+
+// typeMismatch reports that field holds value rather than want
+func typeMismatch(field, want string, value interface{}) error {
+	return fmt.Errorf("%w: field %q holds %T, not %s", ErrFieldType, field, value, want)
+}
+
+// decodeText decodes JSON text held in a string field into v, typed like FlexRecord values
+func decodeText(s string, v interface{}) error {
+	d := json.NewDecoder(strings.NewReader(s))
+	d.UseNumber()
+	if err := d.Decode(v); err != nil {
+		return err
+	}
+	switch x := v.(type) {
+	case *interface{}:
+		*x = decodedValue(*x)
+	case *[]interface{}:
+		decodedValue(*x)
+	case *map[string]interface{}:
+		decodedValue(*x)
+	}
+	return nil
+}
+
+// decodedValue turns the json.Number values of a decoded value into int64 or float64
+func decodedValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = decodedValue(v[i])
+		}
+	case map[string]interface{}:
+		for name := range v {
+			v[name] = decodedValue(v[name])
+		}
+	}
+	return value
+}
+
+// encodedValue returns value with its whole floats as JSON numbers that keep a fraction
+func encodedValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e21 {
+			return json.Number(strconv.FormatFloat(v, 'f', 1, 64))
+		}
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i := range v {
+			list[i] = encodedValue(v[i])
+		}
+		return list
+	case map[string]interface{}:
+		obj := make(map[string]interface{}, len(v))
+		for name := range v {
+			obj[name] = encodedValue(v[name])
+		}
+		return obj
+	}
+	return value
+}
+
+// typedFields converts every field value into what is stored for it
+func typedFields(fields map[string]interface{}) (map[string]interface{}, error) {
+	typed := make(map[string]interface{}, len(fields))
+	for name, value := range fields {
+		v, err := typedValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("field %q: %w", name, err)
+		}
+		typed[name] = v
+	}
+	return typed, nil
+}
+
+// typedValue converts value into a string, int64, float64, bool, list or object, times and
+// bytes into their RFC 3339 and base64 text, nil into null
+func typedValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case time.Time:
+		return v.Format(time.RFC3339Nano), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), nil
+	case json.Number:
+		if _, err := v.Float64(); err != nil {
+			return nil, fmt.Errorf("%w: %q is not a number", ErrFieldType, v)
+		}
+		return decodedValue(v), nil
+	}
+	rv := reflect.ValueOf(value)
+	switch rv.Kind() {
+	case reflect.String:
+		return rv.String(), nil
+	case reflect.Bool:
+		return rv.Bool(), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int(), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if rv.Uint() > math.MaxInt64 {
+			return nil, fmt.Errorf("%w: %d overflows int64", ErrFieldType, rv.Uint())
+		}
+		return int64(rv.Uint()), nil
+	case reflect.Float32, reflect.Float64:
+		f := rv.Float()
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return nil, fmt.Errorf("%w: %v is not a JSON number", ErrFieldType, f)
+		}
+		if rv.Kind() == reflect.Float32 {
+			f, _ = strconv.ParseFloat(strconv.FormatFloat(f, 'g', -1, 32), 64)
+		}
+		return f, nil
+	case reflect.Slice, reflect.Array:
+		list := make([]interface{}, rv.Len())
+		for i := range list {
+			v, err := typedValue(rv.Index(i).Interface())
+			if err != nil {
+				return nil, err
+			}
+			list[i] = v
+		}
+		return list, nil
+	case reflect.Map:
+		if rv.Type().Key().Kind() != reflect.String {
+			break
+		}
+		obj := make(map[string]interface{}, rv.Len())
+		for it := rv.MapRange(); it.Next(); {
+			v, err := typedValue(it.Value().Interface())
+			if err != nil {
+				return nil, err
+			}
+			obj[it.Key().String()] = v
+		}
+		return obj, nil
+	case reflect.Ptr, reflect.Interface:
+		if rv.IsNil() {
+			return nil, nil
+		}
+		return typedValue(rv.Elem().Interface())
+	}
+	return nil, fmt.Errorf("%w: cannot store %T", ErrFieldType, value)
+}
+
+// decodeFlexRecord finds flexible record id and decodes its typed values
+func decodeFlexRecord(v view, id int) (FlexRecord, error) {
+	var record FlexRecord
+	line, err := findLine(v, id)
+	if err != nil {
+		return record, err
+	}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return record, corrupt(err)
+	}
+	return record, nil
+}
+
+// AddFlexTyped appends a flexible record with typed values and returns its id, see
+// Tardigrade.AddFlexTyped
+func (d *DB) AddFlexTyped(key string, fields map[string]interface{}) (int, error) {
+	typed, err := typedFields(fields)
+	if err != nil {
+		return 0, newError("AddFlexTyped", d.path, 0, err)
+	}
+	return d.add("AddFlexTyped", key, func(id int) interface{} {
+		return FlexRecord{Id: id, Key: key, Fields: typed}
+	})
+}
+
+// ModifyFlexTyped replaces the key and fields of flexible record id with typed values
+func (d *DB) ModifyFlexTyped(id int, key string, fields map[string]interface{}) error {
+	typed, err := typedFields(fields)
+	if err != nil {
+		return newError("ModifyFlexTyped", d.path, id, err)
+	}
+	return d.modify("ModifyFlexTyped", id, key, FlexRecord{Id: id, Key: key, Fields: typed})
+}
+
+// GetFlexRecord returns flexible record id with typed field values
+func (d *DB) GetFlexRecord(id int) (FlexRecord, error) {
+	var record FlexRecord
+	err := d.read("GetFlexRecord", func(v view) (err error) {
+		record, err = decodeFlexRecord(v, id)
+		return newError("GetFlexRecord", d.path, id, err)
+	})
+	return record, err
+}
+
+// AddFlexTyped appends a flexible record with typed values and returns its id
+func (tx *Tx) AddFlexTyped(key string, fields map[string]interface{}) (int, error) {
+	typed, err := typedFields(fields)
+	if err != nil {
+		return 0, newError("AddFlexTyped", tx.db.path, 0, err)
+	}
+	return tx.add("AddFlexTyped", key, func(id int) interface{} {
+		return FlexRecord{Id: id, Key: key, Fields: typed}
+	})
+}
+
+// ModifyFlexTyped replaces the key and fields of flexible record id with typed values
+func (tx *Tx) ModifyFlexTyped(id int, key string, fields map[string]interface{}) error {
+	typed, err := typedFields(fields)
+	if err != nil {
+		return newError("ModifyFlexTyped", tx.db.path, id, err)
+	}
+	return tx.modify("ModifyFlexTyped", id, key, FlexRecord{Id: id, Key: key, Fields: typed})
+}
+
+// GetFlexRecord returns flexible record id with typed values as seen by the transaction
+func (tx *Tx) GetFlexRecord(id int) (FlexRecord, error) {
+	if err := tx.check("GetFlexRecord"); err != nil {
+		return FlexRecord{}, err
+	}
+	record, err := decodeFlexRecord(tx.view(), id)
+	return record, newError("GetFlexRecord", tx.db.path, id, err)
+}
@@ -0,0 +1,44 @@
+package tardigrade
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTypedValuesRoundTrip(t *testing.T) {
+	tar := &Tardigrade{}
+	db := filepath.Join(t.TempDir(), "typed.db")
+	tar.CreateDB(db)
+	at := time.Date(2026, 1, 18, 21, 38, 18, 5, time.UTC)
+	id, err := tar.AddFlexTyped("a", map[string]interface{}{
+		"count": 3, "ratio": 3.0, "half": 0.5, "list": []interface{}{2.0, 2},
+		"at": at, "raw": []byte{0, 1, 2},
+	}, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record, err := tar.GetFlexRecord(id, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, ok := record.Fields["count"].(int64); !ok || v != 3 {
+		t.Fatalf("count = %#v, want int64 3", record.Fields["count"])
+	}
+	if v, ok := record.Fields["ratio"].(float64); !ok || v != 3 {
+		t.Fatalf("ratio = %#v, want float64 3", record.Fields["ratio"])
+	}
+	if list, _ := record.List("list"); len(list) != 2 || list[0] != 2.0 || list[1] != int64(2) {
+		t.Fatalf("list = %#v", list)
+	}
+	if got, err := record.Time("at"); err != nil || !got.Equal(at) {
+		t.Fatalf("Time = %v, %v", got, err)
+	}
+	if got, err := record.Bytes("raw"); err != nil || !bytes.Equal(got, []byte{0, 1, 2}) {
+		t.Fatalf("Bytes = %v, %v", got, err)
+	}
+	if got := tar.SelectByID(id, "raw", db); !bytes.Contains([]byte(got), []byte(`"ratio":3.0`)) {
+		t.Fatalf("stored line %s", got)
+	}
+}
@@ -0,0 +1,626 @@
+package tardigrade
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCheckpointEvery is the number of log entries after which a checkpoint is taken
+const DefaultCheckpointEvery = 1000
+
+// walEntry is one line of the write-ahead log. Add and modify entries carry the complete
+// line written to the database so replaying an entry twice gives the same result.
+type walEntry struct {
+	Seq    uint64          `json:"seq"`
+	Time   int64           `json:"time"`
+	Op     string          `json:"op"` // add | modify | remove | commit | checkpoint
+	Id     int             `json:"id,omitempty"`
+	Tx     uint64          `json:"tx,omitempty"` // transaction the entry belongs to, see committed
+	Record json.RawMessage `json:"record,omitempty"`
+}
+
+// walState caches the tail of the log of a database, it lives in the shared dbState
+type walState struct {
+	size       int64  // log size the cache was computed for
+	seq        uint64 // last sequence number written
+	checkpoint uint64 // sequence number of the last checkpoint
+	applied    uint64 // last sequence number this process knows to be applied to the database
+	every      int    // checkpoint after this many entries, 0 disables automatic checkpoints
+	archive    string // directory receiving checkpointed segments and base copies
+}
+
+// walPath returns the write-ahead log kept next to db
+func walPath(db string) string {
+	return db + ".wal"
+}
+
+// readWAL returns every entry stored in the log file at path
+func readWAL(path string) ([]walEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []walEntry
+	err = scanLines(file, func(line string) error {
+		if len(strings.TrimSpace(line)) == 0 {
+			return nil
+		}
+		var e walEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			// a torn last entry means the write it describes was never applied
+			return errStop
+		}
+		entries = append(entries, e)
+		return nil
+	})
+	return entries, err
+}
+
+// loadWAL refreshes the cached log tail, it returns nil when db has no log
+func (s *dbState) loadWAL() (*walState, error) {
+	info, err := os.Stat(walPath(s.path))
+	if errors.Is(err, os.ErrNotExist) {
+		s.wal = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.wal == nil {
+		s.wal = &walState{size: -1}
+	}
+	if info.Size() == s.wal.size {
+		return s.wal, nil
+	}
+	entries, err := readWAL(walPath(s.path))
+	if err != nil {
+		return nil, err
+	}
+	s.wal.size = info.Size()
+	for _, e := range entries {
+		s.wal.seq = e.Seq
+		if e.Op == "checkpoint" {
+			s.wal.checkpoint = e.Seq
+		}
+	}
+	return s.wal, nil
+}
+
+// logWAL appends an entry to the log of the database before the write it describes is
+// applied, databases without a log are left alone. The caller holds the write lock.
+func (s *dbState) logWAL(durability Durability, op string, id int, record []byte) (func() error, error) {
+	return s.appendWAL(durability, false, walEntry{Op: op, Id: id, Record: json.RawMessage(bytes.TrimSpace(record))})
+}
+
+// appendWAL numbers entries and writes them to the log with a single write. With tx set
+// they form one transaction closed by a commit entry, replay ignores transactions whose
+// commit entry never made it to disk. The returned function cuts the entries off the log
+// again when the write they describe fails.
+func (s *dbState) appendWAL(durability Durability, tx bool, entries ...walEntry) (func() error, error) {
+	undo := func() error { return nil }
+	w, err := s.loadWAL()
+	if w == nil || err != nil || len(entries) == 0 {
+		return undo, err
+	}
+	now := time.Now().UnixNano()
+	if tx {
+		entries = append(entries, walEntry{Op: "commit"})
+	}
+	var buf bytes.Buffer
+	seq := w.seq
+	for i := range entries {
+		seq++
+		entries[i].Seq, entries[i].Time = seq, now
+		if tx {
+			entries[i].Tx = w.seq + 1
+		}
+		line, err := json.Marshal(entries[i])
+		if err != nil {
+			return undo, err
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	size, last := w.size, w.seq
+	undo = func() error {
+		if err := os.Truncate(walPath(s.path), size); err != nil {
+			return err
+		}
+		w.seq, w.size = last, size
+		return nil
+	}
+	file, err := os.OpenFile(walPath(s.path), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return undo, err
+	}
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		file.Close()
+		return undo, errors.Join(err, undo())
+	}
+	if durability != SyncNone {
+		if err := file.Sync(); err != nil {
+			file.Close()
+			return undo, errors.Join(err, undo())
+		}
+	}
+	if err := file.Close(); err != nil {
+		return undo, errors.Join(err, undo())
+	}
+	w.seq = seq
+	w.size += int64(buf.Len())
+	return undo, nil
+}
+
+// appliedWAL records that every entry logged so far was applied to the database
+func (s *dbState) appliedWAL() {
+	if s.wal != nil {
+		s.wal.applied = s.wal.seq
+	}
+}
+
+// syncWAL makes sure the entries of the log were applied before another write goes on top
+// of them. Entries this process did not apply itself are checked against the database, and
+// replayed when a writer crashed between logging and applying them. The caller holds the
+// write lock.
+func (s *dbState) syncWAL(durability Durability) error {
+	w, err := s.loadWAL()
+	if w == nil || err != nil || w.seq <= w.checkpoint || w.seq <= w.applied {
+		return err
+	}
+	entries, err := readWAL(walPath(s.path))
+	if err != nil {
+		return err
+	}
+	after := w.checkpoint
+	if w.applied > after {
+		after = w.applied
+	}
+	final := make(map[int]walEntry)
+	for _, e := range committed(entries) {
+		if e.Seq > after {
+			final[e.Id] = e
+		}
+	}
+	v := pathView(s.path)
+	for id, e := range final {
+		line, err := v.get(id)
+		switch {
+		case e.Op == "remove" && errors.Is(err, ErrNotFound):
+		case e.Op != "remove" && err == nil && line == string(e.Record):
+		case err != nil && !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrDBMissing):
+			return err
+		default:
+			return s.replayWAL(durability)
+		}
+	}
+	w.applied = w.seq
+	return nil
+}
+
+// committed drops the entries of transactions without a commit entry and the markers
+func committed(entries []walEntry) []walEntry {
+	done := make(map[uint64]bool)
+	for _, e := range entries {
+		if e.Op == "commit" {
+			done[e.Tx] = true
+		}
+	}
+	var kept []walEntry
+	for _, e := range entries {
+		if e.Op != "commit" && e.Op != "checkpoint" && (e.Tx == 0 || done[e.Tx]) {
+			kept = append(kept, e)
+		}
+	}
+	return kept
+}
+
+// afterWAL takes a checkpoint once enough entries piled up, the caller holds the write lock
+func (s *dbState) afterWAL(durability Durability) error {
+	if s.wal == nil || s.wal.every <= 0 || s.wal.seq-s.wal.checkpoint < uint64(s.wal.every) {
+		return nil
+	}
+	return s.checkpointWAL(durability)
+}
+
+// enableWAL creates the log of the database if needed, replays entries left behind by a
+// crash and records the checkpoint settings. The caller holds the write lock.
+func (s *dbState) enableWAL(durability Durability, every int, archive string) error {
+	created := false
+	if _, err := os.Stat(walPath(s.path)); errors.Is(err, os.ErrNotExist) {
+		// a new log carries on the numbering of the archive, which may still hold the log
+		// of a deleted database of the same name
+		last, err := lastArchived(archive, filepath.Base(s.path))
+		if err != nil {
+			return err
+		}
+		var content []byte
+		if last > 0 {
+			marker, err := json.Marshal(walEntry{Seq: last, Time: time.Now().UnixNano(), Op: "checkpoint"})
+			if err != nil {
+				return err
+			}
+			content = append(marker, '\n')
+		}
+		if err := replaceFile(walPath(s.path), content, durability); err != nil {
+			return err
+		}
+		created = true
+	}
+	w, err := s.loadWAL()
+	if err != nil {
+		return err
+	}
+	if every == 0 {
+		every = DefaultCheckpointEvery
+	}
+	w.every, w.archive = every, archive
+	if archive != "" {
+		if err := os.MkdirAll(archive, 0755); err != nil {
+			return err
+		}
+	}
+	if w.seq > w.checkpoint {
+		if err := s.replayWAL(durability); err != nil {
+			return err
+		}
+	}
+	if archive != "" {
+		bases, err := listBases(archive, filepath.Base(s.path))
+		if err != nil {
+			return err
+		}
+		if len(bases) == 0 || created {
+			if _, err := s.baseBackup(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// logged runs apply between writing its log entry and the automatic checkpoint check, then
+// queues the alerts of db the stored record matches. A failed apply takes its entry off the
+// log again. The caller holds the write lock of db.
+func (tar *Tardigrade) logged(db string, op string, id int, record []byte, apply func() error) error {
+	s := stateFor(db)
+	undo, err := s.logWAL(tar.Durability, op, id, record)
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return errors.Join(err, undo())
+	}
+	s.appliedWAL()
+	tar.percolate(db, op, record)
+	return s.afterWAL(tar.Durability)
+}
+
+// loggedTx runs apply between writing entries to the log as one transaction and the automatic
+// checkpoint check, like logged for a write touching several records. It does not check
+// alerts, only removals go through it. The caller holds the write lock of db.
+func (tar *Tardigrade) loggedTx(db string, entries []walEntry, apply func() error) error {
+	s := stateFor(db)
+	undo, err := s.appendWAL(tar.Durability, len(entries) > 1, entries...)
+	if err != nil {
+		return err
+	}
+	if err := apply(); err != nil {
+		return errors.Join(err, undo())
+	}
+	s.appliedWAL()
+	return s.afterWAL(tar.Durability)
+}
+
+// replayWAL applies every entry written after the last checkpoint, then checkpoints
+func (s *dbState) replayWAL(durability Durability) error {
+	entries, err := readWAL(walPath(s.path))
+	if err != nil {
+		return err
+	}
+	var pending []walEntry
+	for _, e := range committed(entries) {
+		if e.Seq > s.wal.checkpoint {
+			pending = append(pending, e)
+		}
+	}
+	if len(pending) > 0 {
+		input, err := os.ReadFile(s.path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		kd := s.keydir()
+		lines := splitLines(input)
+		if kd != nil {
+			lines = liveLines(lines)
+		}
+		lines, versions := applyWAL(lines, pending)
+		switch {
+		case len(versions) == 0:
+		case kd != nil:
+			tar := Tardigrade{Durability: durability}
+			if err := tar.appendVersion(kd, s.path, joinLines(versions)); err != nil {
+				return err
+			}
+		default:
+			if err := replaceDB(s.path, input, joinLines(lines), durability); err != nil {
+				return err
+			}
+		}
+	}
+	return s.checkpointWAL(durability)
+}
+
+// applyWAL replays entries over the lines of a database. Besides the new lines it returns
+// the versions and tombstones append storage has to write to get the same result.
+func applyWAL(lines []string, entries []walEntry) ([]string, []string) {
+	index := make(map[int]int, len(lines))
+	for i, line := range lines {
+		var head recordHead
+		if json.Unmarshal([]byte(line), &head) == nil {
+			index[head.Id] = i
+		}
+	}
+	before := make(map[int]string) // lines of the records touched, as they were
+	var touched []int
+	for _, e := range entries {
+		i, exists := index[e.Id]
+		if _, seen := before[e.Id]; !seen {
+			touched = append(touched, e.Id)
+			before[e.Id] = ""
+			if exists {
+				before[e.Id] = lines[i]
+			}
+		}
+		switch e.Op {
+		case "add":
+			if !exists {
+				index[e.Id] = len(lines)
+				lines = append(lines, string(e.Record))
+			}
+		case "modify":
+			if exists {
+				lines[i] = string(e.Record)
+			}
+		case "remove":
+			if exists {
+				lines = append(lines[:i], lines[i+1:]...)
+				delete(index, e.Id)
+				for id, j := range index {
+					if j > i {
+						index[id] = j - 1
+					}
+				}
+			}
+		}
+	}
+	var versions []string
+	for _, id := range touched {
+		i, exists := index[id]
+		switch {
+		case exists && lines[i] != before[id]:
+			versions = append(versions, lines[i])
+		case !exists && before[id] != "":
+			versions = append(versions, strings.TrimSpace(string(tombstone(id))))
+		}
+	}
+	return lines, versions
+}
+
+// checkpointWAL folds the log into the database: the database is flushed, the entries are
+// moved to the archive when one is configured and the log shrinks to a checkpoint marker
+func (s *dbState) checkpointWAL(durability Durability) error {
+	w, err := s.loadWAL()
+	if w == nil || err != nil {
+		return err
+	}
+	if durability != SyncNone {
+		if file, err := os.OpenFile(s.path, os.O_RDWR, 0644); err == nil {
+			file.Sync()
+			file.Close()
+		}
+	}
+	if w.archive != "" && w.seq > w.checkpoint {
+		segment := filepath.Join(w.archive, fmt.Sprintf("%s.%020d-%020d.wal", filepath.Base(s.path), w.checkpoint+1, w.seq))
+		content, err := os.ReadFile(walPath(s.path))
+		if err != nil {
+			return err
+		}
+		if err := replaceFile(segment, content, durability); err != nil {
+			return err
+		}
+	}
+	marker, err := json.Marshal(walEntry{Seq: w.seq, Time: time.Now().UnixNano(), Op: "checkpoint"})
+	if err != nil {
+		return err
+	}
+	marker = append(marker, '\n')
+	if err := replaceFile(walPath(s.path), marker, durability); err != nil {
+		return err
+	}
+	w.checkpoint, w.applied, w.size = w.seq, w.seq, int64(len(marker))
+	return nil
+}
+
+// baseBackup copies the database into the archive, tagged with the last log sequence number
+// it contains and the time it was taken. The caller holds at least the read lock.
+func (s *dbState) baseBackup() (string, error) {
+	w, err := s.loadWAL()
+	if err != nil {
+		return "", err
+	}
+	if w == nil || w.archive == "" {
+		return "", errors.New("base backups need a WAL archive")
+	}
+	content, err := os.ReadFile(s.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	name := fmt.Sprintf("%s.base-%020d-%d", filepath.Base(s.path), w.seq, time.Now().UnixNano())
+	dst := filepath.Join(w.archive, name)
+	return dst, replaceFile(dst, content, SyncOnWrite)
+}
+
+// walBase is a base copy found in the archive
+type walBase struct {
+	path string
+	seq  uint64
+	time int64
+}
+
+// listBases returns the base copies of the database named name, oldest first
+func listBases(archive, name string) ([]walBase, error) {
+	matches, err := filepath.Glob(filepath.Join(archive, name+".base-*"))
+	if err != nil {
+		return nil, err
+	}
+	var bases []walBase
+	for _, m := range matches {
+		parts := strings.Split(strings.TrimPrefix(filepath.Base(m), name+".base-"), "-")
+		if len(parts) != 2 {
+			continue
+		}
+		seq, err1 := strconv.ParseUint(parts[0], 10, 64)
+		nanos, err2 := strconv.ParseInt(parts[1], 10, 64)
+		if err1 == nil && err2 == nil {
+			bases = append(bases, walBase{path: m, seq: seq, time: nanos})
+		}
+	}
+	sort.Slice(bases, func(i, j int) bool { return bases[i].time < bases[j].time })
+	return bases, nil
+}
+
+// listSegments returns the archived log segments of the database named name in sequence
+// order, skipping those of databases whose name merely starts with it
+func listSegments(archive, name string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(archive, name+".*.wal"))
+	if err != nil {
+		return nil, err
+	}
+	var segments []string
+	for _, m := range matches {
+		parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(filepath.Base(m), name+"."), ".wal"), "-")
+		if len(parts) != 2 || len(parts[0]) != 20 || len(parts[1]) != 20 {
+			continue
+		}
+		_, err1 := strconv.ParseUint(parts[0], 10, 64)
+		_, err2 := strconv.ParseUint(parts[1], 10, 64)
+		if err1 == nil && err2 == nil {
+			segments = append(segments, m)
+		}
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// lastArchived returns the highest sequence number held by the archive for the database
+// named name, 0 without an archive
+func lastArchived(archive, name string) (uint64, error) {
+	if archive == "" {
+		return 0, nil
+	}
+	bases, err := listBases(archive, name)
+	if err != nil {
+		return 0, err
+	}
+	segments, err := listSegments(archive, name)
+	if err != nil {
+		return 0, err
+	}
+	var last uint64
+	for _, b := range bases {
+		if b.seq > last {
+			last = b.seq
+		}
+	}
+	for _, segment := range segments {
+		to := strings.TrimSuffix(filepath.Base(segment), ".wal")
+		if seq, err := strconv.ParseUint(to[len(to)-20:], 10, 64); err == nil && seq > last {
+			last = seq
+		}
+	}
+	return last, nil
+}
+
+// recoverTo rebuilds the database as it was at t into dst, from the newest base copy taken
+// before t plus every archived and live log entry written up to t
+func (s *dbState) recoverTo(t time.Time, dst string) error {
+	w, err := s.loadWAL()
+	if err != nil {
+		return err
+	}
+	if w == nil || w.archive == "" {
+		return errors.New("point-in-time recovery needs a WAL archive")
+	}
+	bases, err := listBases(w.archive, filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	var base *walBase
+	for i := range bases {
+		if bases[i].time <= t.UnixNano() {
+			base = &bases[i]
+		}
+	}
+	if base == nil {
+		return fmt.Errorf("%w: no base copy taken before %s", ErrNotFound, t.Format(time.RFC3339))
+	}
+
+	segments, err := listSegments(w.archive, filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	segments = append(segments, walPath(s.path))
+	var entries []walEntry
+	seen := make(map[uint64]bool)
+	for _, segment := range segments {
+		list, err := readWAL(segment)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		for _, e := range committed(list) {
+			if e.Seq > base.seq && e.Time <= t.UnixNano() && !seen[e.Seq] {
+				seen[e.Seq] = true
+				entries = append(entries, e)
+			}
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+
+	content, err := os.ReadFile(base.path)
+	if err != nil {
+		return err
+	}
+	lines := splitLines(content)
+	if s.keydir() != nil {
+		lines = liveLines(lines)
+	}
+	lines, _ = applyWAL(lines, entries)
+	return replaceDB(dst, nil, joinLines(lines), SyncOnWrite)
+}
+
+// splitLines breaks the content of a database into its lines
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// joinLines is the inverse of splitLines
+func joinLines(lines []string) []byte {
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(line)
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
@@ -0,0 +1,311 @@
+package tardigrade
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openWALDB opens a new database with a write-ahead log
+func openWALDB(t *testing.T, opts Options) *DB {
+	t.Helper()
+	opts.Create, opts.WAL = true, true
+	d, err := Open(filepath.Join(t.TempDir(), "wal.db"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// crashEntry appends an entry to the log of db as a writer that died before applying it would
+func crashEntry(t *testing.T, db string, op string, id int, record string) {
+	t.Helper()
+	entries, err := readWAL(walPath(db))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := walEntry{Seq: entries[len(entries)-1].Seq + 1, Time: time.Now().UnixNano(), Op: op, Id: id}
+	if record != "" {
+		e.Record = json.RawMessage(record)
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.OpenFile(walPath(db), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALReplayOnOpen(t *testing.T) {
+	d := openWALDB(t, Options{})
+	if _, err := d.Add("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	crashEntry(t, d.Path(), "modify", 1, `{"id":1,"key":"a","data":"2"}`)
+	forget(d.Path())
+
+	d, err := Open(d.Path(), Options{WAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	got, err := d.Get(1)
+	if err != nil || got.Data != "2" {
+		t.Fatalf("Get(1) = %+v, %v, want the replayed modification", got, err)
+	}
+}
+
+func TestWALReplayBeforePathWrite(t *testing.T) {
+	for _, mode := range []StorageMode{StorageRewrite, StorageAppend} {
+		d := openWALDB(t, Options{Storage: mode})
+		if _, err := d.Add("a", "1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		crashEntry(t, d.Path(), "add", 2, `{"id":2,"key":"b","data":"2"}`)
+		forget(d.Path())
+
+		tar := &Tardigrade{}
+		id, err := tar.AddFieldE("c", "3", d.Path())
+		if err != nil || id != 3 {
+			t.Fatalf("mode %d: AddFieldE = %d, %v, want id 3 after the replay", mode, id, err)
+		}
+		if got := tar.SelectByID(2, "raw", d.Path()); got != `{"id":2,"key":"b","data":"2"}` {
+			t.Fatalf("mode %d: SelectByID(2) = %s", mode, got)
+		}
+		entries, err := readWAL(walPath(d.Path()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if last := entries[len(entries)-1]; last.Op != "add" || last.Id != 3 {
+			t.Fatalf("mode %d: last log entry = %+v", mode, last)
+		}
+	}
+}
+
+func TestWALFailedWriteLeavesNoEntry(t *testing.T) {
+	d := openWALDB(t, Options{})
+	defer d.Close()
+	if _, err := d.Add("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadFile(walPath(d.Path()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tar := &Tardigrade{}
+	unlock, err := tar.writeLock(d.Path())
+	if err != nil {
+		t.Fatal(err)
+	}
+	boom := errors.New("boom")
+	err = tar.logged(d.Path(), "modify", 1, []byte(`{"id":1,"key":"a","data":"lost"}`), func() error { return boom })
+	unlock()
+	if !errors.Is(err, boom) {
+		t.Fatalf("logged = %v, want the apply error", err)
+	}
+	after, err := os.ReadFile(walPath(d.Path()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(after) != string(before) {
+		t.Fatalf("log kept the failed entry:\n%s", after)
+	}
+	if err := d.Modify(1, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := d.Get(1); got.Data != "2" {
+		t.Fatalf("Get(1) = %+v", got)
+	}
+}
+
+func TestWALCheckpoint(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "archive")
+	d := openWALDB(t, Options{CheckpointEvery: 2, WALArchive: archive})
+	defer d.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := d.Add(key, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	entries, err := readWAL(walPath(d.Path()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Op != "checkpoint" || entries[0].Seq != 2 || entries[1].Seq != 3 {
+		t.Fatalf("log after the automatic checkpoint = %+v", entries)
+	}
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	segments, err := filepath.Glob(filepath.Join(archive, "wal.db.*.wal"))
+	if err != nil || len(segments) != 2 {
+		t.Fatalf("archived segments = %v, %v", segments, err)
+	}
+}
+
+func TestWALCloseReportsLockTimeout(t *testing.T) {
+	d := openWALDB(t, Options{LockTimeout: 50 * time.Millisecond})
+	if _, err := d.Add("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	other, err := acquireFileLock(d.Path(), true, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.release()
+	if !d.Locked() {
+		t.Skip("no cross-process lock on this platform")
+	}
+	if err := d.Close(); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Close under another writer = %v, want ErrLockTimeout", err)
+	}
+	if err := d.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("second Close = %v, want ErrClosed", err)
+	}
+}
+
+func TestWALRecoverTo(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "archive")
+	d := openWALDB(t, Options{CheckpointEvery: 2, WALArchive: archive})
+	defer d.Close()
+	for _, key := range []string{"a", "b", "c"} {
+		if _, err := d.Add(key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(time.Millisecond)
+	at := time.Now()
+	time.Sleep(time.Millisecond)
+	if err := d.Modify(1, "a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(2); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "recovered.db")
+	if err := d.RecoverTo(at, dst); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "{\"id\":1,\"key\":\"a\",\"data\":\"1\"}\n{\"id\":2,\"key\":\"b\",\"data\":\"1\"}\n{\"id\":3,\"key\":\"c\",\"data\":\"1\"}\n"
+	if string(content) != want {
+		t.Fatalf("recovered %q, want %q", content, want)
+	}
+	if err := d.RecoverTo(at.Add(-time.Hour), dst); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("RecoverTo before the base copy = %v, want ErrNotFound", err)
+	}
+}
+
+func TestWALSharedArchive(t *testing.T) {
+	dir, archive := t.TempDir(), filepath.Join(t.TempDir(), "archive")
+	opts := Options{Create: true, WAL: true, WALArchive: archive}
+	app, err := Open(filepath.Join(dir, "app.db"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer app.Close()
+	v2, err := Open(filepath.Join(dir, "app.db.v2"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer v2.Close()
+	if _, err := app.Add("a1", "1"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"b1", "b2", "b3"} {
+		if _, err := v2.Add(key, "1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := app.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := v2.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(t.TempDir(), "recovered.db")
+	if err := app.RecoverTo(time.Now(), dst); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(dst); string(content) != "{\"id\":1,\"key\":\"a1\",\"data\":\"1\"}\n" {
+		t.Fatalf("recovered %q, want the records of app.db only", content)
+	}
+	segments, err := listSegments(archive, "app.db")
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("segments of app.db = %v, %v", segments, err)
+	}
+}
+
+func TestDeleteDBKeepsArchive(t *testing.T) {
+	archive := filepath.Join(t.TempDir(), "archive")
+	d := openWALDB(t, Options{WALArchive: archive})
+	if _, err := d.Add("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Checkpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Add("b", "2"); err != nil {
+		t.Fatal(err)
+	}
+	crashEntry(t, d.Path(), "add", 3, `{"id":3,"key":"c","data":"3"}`)
+	d.Close()
+	kept, err := filepath.Glob(filepath.Join(archive, "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tar := &Tardigrade{}
+	if _, ok := tar.DeleteDB(d.Path()); !ok {
+		t.Fatal("DeleteDB failed")
+	}
+	left, err := filepath.Glob(filepath.Join(archive, "*"))
+	if err != nil || len(left) != len(kept) {
+		t.Fatalf("archive after DeleteDB = %v, %v, want %v", left, err, kept)
+	}
+	if _, err := os.Stat(walPath(d.Path())); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("log left behind: %v", err)
+	}
+
+	// a new database of the same name carries on the archived numbering
+	tar.CreateDB(d.Path())
+	d, err = Open(d.Path(), Options{WAL: true, WALArchive: archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if n, err := d.Count(); err != nil || n != 0 {
+		t.Fatalf("Count of the new database = %d, %v, want 0", n, err)
+	}
+	if _, err := d.Add("x", "9"); err != nil {
+		t.Fatal(err)
+	}
+	dst := filepath.Join(t.TempDir(), "recovered.db")
+	if err := d.RecoverTo(time.Now(), dst); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(dst); string(content) != "{\"id\":1,\"key\":\"x\",\"data\":\"9\"}\n" {
+		t.Fatalf("recovered %q, want the new database only", content)
+	}
+}